@@ -12,6 +12,12 @@ import (
 
 const bufferSize = 65526
 
+// buffersWriter writes several buffers by a single system call,
+// as the conns of a netpoll.Server do.
+type buffersWriter interface {
+	WriteBuffers(bufs [][]byte) (int64, error)
+}
+
 // Batch interface is used to write batch messages.
 type Batch interface {
 	// SetConcurrency sets a callback function concurrency to enable auto batch writer for improving throughput.
@@ -42,6 +48,7 @@ type messages struct {
 	buffer          []byte
 	readPool        *buffer.Pool
 	writePool       *buffer.Pool
+	header          [10]byte
 	closed          int32
 }
 
@@ -172,6 +179,12 @@ func (m *messages) ReadMessage(buf []byte) (p []byte, err error) {
 
 func (m *messages) WriteMessage(b []byte) error {
 	m.writing.Lock()
+	if w, ok := m.writer.(buffersWriter); ok {
+		// Writes the header and the payload by writev without copying.
+		_, err := w.WriteBuffers([][]byte{m.header[:putUvarint(m.header[:], uint64(len(b)))], b})
+		m.writing.Unlock()
+		return messageError(err)
+	}
 	var length = uint64(len(b))
 	var size = 10 + length
 	var writeBuffer []byte
@@ -202,15 +215,31 @@ func (m *messages) WriteMessage(b []byte) error {
 	i += n
 	_, err := m.writer.Write(writeBuffer[:i])
 	m.writing.Unlock()
+	if m.shared {
+		m.writePool.PutBuffer(writeBuffer)
+	}
+	return messageError(err)
+}
+
+// putUvarint encodes the length x into buf and returns the number of bytes written.
+func putUvarint(buf []byte, x uint64) int {
+	i := 0
+	for x >= 0x80 {
+		buf[i] = byte(x) | 0x80
+		x >>= 7
+		i++
+	}
+	buf[i] = byte(x)
+	return i + 1
+}
+
+func messageError(err error) error {
 	if err != nil {
 		errMsg := err.Error()
 		if strings.Contains(errMsg, "use of closed network connection") || strings.Contains(errMsg, "connection reset by peer") {
 			err = io.EOF
 		}
 	}
-	if m.shared {
-		m.writePool.PutBuffer(writeBuffer)
-	}
 	return err
 }
 
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/php2go/netpollmux/mux"
+	"github.com/php2go/netpollmux/netpoll"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Collector writes its metrics to a Writer.
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc is an adapter to allow the use of ordinary functions as Collector.
+type CollectorFunc func(w *Writer)
+
+// Collect calls f(w).
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// Label is a name and value pair of a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples bytes.Buffer
+}
+
+// Writer groups the samples by metric family and renders them
+// in the Prometheus text exposition format.
+type Writer struct {
+	families []*family
+	index    map[string]*family
+}
+
+func (w *Writer) family(name, help, typ string) *family {
+	if w.index == nil {
+		w.index = make(map[string]*family)
+	}
+	f, ok := w.index[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		w.index[name] = f
+		w.families = append(w.families, f)
+	}
+	return f
+}
+
+// Counter writes a sample of the counter name.
+func (w *Writer) Counter(name, help string, value float64, labels ...Label) {
+	sample(&w.family(name, help, "counter").samples, name, value, labels)
+}
+
+// Gauge writes a sample of the gauge name.
+func (w *Writer) Gauge(name, help string, value float64, labels ...Label) {
+	sample(&w.family(name, help, "gauge").samples, name, value, labels)
+}
+
+// Histogram writes the samples of the histogram name.
+func (w *Writer) Histogram(name, help string, h mux.Histogram, labels ...Label) {
+	f := w.family(name, help, "histogram")
+	le := make([]Label, len(labels)+1)
+	copy(le, labels)
+	for i, bound := range h.Buckets {
+		le[len(labels)] = Label{"le", formatFloat(bound)}
+		sample(&f.samples, name+"_bucket", float64(h.Counts[i]), le)
+	}
+	le[len(labels)] = Label{"le", "+Inf"}
+	sample(&f.samples, name+"_bucket", float64(h.Count), le)
+	sample(&f.samples, name+"_sum", h.Sum, labels)
+	sample(&f.samples, name+"_count", float64(h.Count), labels)
+}
+
+// WriteTo renders the families to out in the order they were first written.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range w.families {
+		buf.WriteString("# HELP ")
+		buf.WriteString(f.name)
+		buf.WriteByte(' ')
+		buf.WriteString(helpEscaper.Replace(f.help))
+		buf.WriteString("\n# TYPE ")
+		buf.WriteString(f.name)
+		buf.WriteByte(' ')
+		buf.WriteString(f.typ)
+		buf.WriteByte('\n')
+		buf.Write(f.samples.Bytes())
+	}
+	return buf.WriteTo(out)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func sample(buf *bytes.Buffer, name string, value float64, labels []Label) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(l.Name)
+			buf.WriteString(`="`)
+			buf.WriteString(labelEscaper.Replace(l.Value))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(value))
+	buf.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler renders the metrics of the collectors.
+type Handler struct {
+	Collectors []Collector
+}
+
+// NewHandler returns a new Handler with the collectors.
+func NewHandler(collectors ...Collector) *Handler {
+	return &Handler{Collectors: collectors}
+}
+
+// ServeHTTP implements the http.Handler ServeHTTP method.
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var w Writer
+	for _, c := range h.Collectors {
+		c.Collect(&w)
+	}
+	var buf bytes.Buffer
+	w.WriteTo(&buf)
+	rw.Header().Set("Content-Type", ContentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	rw.Write(buf.Bytes())
+}
+
+// Server returns a Collector of the statistics of the netpoll server s,
+// labeled with server="name".
+func Server(name string, s *netpoll.Server) Collector {
+	return CollectorFunc(func(w *Writer) {
+		collectStats(w, Label{"server", name}, s.Stats())
+	})
+}
+
+// Route returns a Collector of the request metrics and the netpoll
+// server statistics of the route r.
+func Route(r *mux.Route) Collector {
+	return CollectorFunc(func(w *Writer) {
+		for i, stats := range r.PollStats() {
+			collectStats(w, Label{"server", strconv.Itoa(i)}, stats)
+		}
+		metrics := r.Metrics()
+		if metrics == nil {
+			return
+		}
+		for _, rs := range metrics.Snapshot() {
+			route, method := Label{"route", rs.Route}, Label{"method", rs.Method}
+			codes := make([]int, 0, len(rs.Requests))
+			for code := range rs.Requests {
+				codes = append(codes, code)
+			}
+			sort.Ints(codes)
+			for _, code := range codes {
+				w.Counter("mux_requests_total", "Number of the requests.", float64(rs.Requests[code]),
+					route, method, Label{"code", strconv.Itoa(code)})
+			}
+			w.Histogram("mux_request_duration_seconds", "Duration of the requests in seconds.",
+				rs.Latency, route, method)
+			w.Histogram("mux_response_size_bytes", "Size of the response bodies in bytes.",
+				rs.Size, route, method)
+		}
+	})
+}
+
+// Mount enables the request metrics of the route r, and serves the metrics
+// of r on path by its router. It has no effect on the requests if r.Handler
+// is set to a handler other than r.
+func Mount(r *mux.Route, path string) {
+	r.SetMetrics(true)
+	r.Handle(path, NewHandler(Route(r)))
+}
+
+func collectStats(w *Writer, server Label, stats netpoll.Stats) {
+	w.Gauge("netpoll_conns", "Number of the conns served by the workers.", float64(stats.Conns), server)
+	w.Counter("netpoll_accepted_total", "Number of the accepted conns.", float64(stats.Accepted), server)
+	w.Counter("netpoll_rescheduled_total", "Number of the conns moved by the rescheduler.",
+		float64(stats.Rescheduled), server)
+	w.Counter("netpoll_panics_total", "Number of the Handler panics recovered.", float64(stats.Panics), server)
+	for _, ws := range stats.Workers {
+		worker := Label{"worker", strconv.Itoa(ws.Index)}
+		shared := Label{"shared", strconv.FormatBool(ws.Shared)}
+		running := 0.0
+		if ws.Running {
+			running = 1
+		}
+		w.Gauge("netpoll_worker_running", "Whether the worker is polling.", running, server, worker, shared)
+		w.Gauge("netpoll_worker_conns", "Number of the conns served by the worker.", float64(ws.Conns),
+			server, worker, shared)
+		w.Counter("netpoll_worker_events_total", "Number of the poll events processed by the worker.",
+			float64(ws.Events), server, worker, shared)
+		w.Counter("netpoll_worker_busy_seconds_total", "Time spent serving the events in seconds.",
+			ws.Busy.Seconds(), server, worker, shared)
+		w.Counter("netpoll_worker_sleeps_total", "Number of times the worker went to sleep.",
+			float64(ws.Sleeps), server, worker, shared)
+		w.Counter("netpoll_worker_wakes_total", "Number of times the worker was woken up.",
+			float64(ws.Wakes), server, worker, shared)
+		w.Gauge("netpoll_worker_tasks", "Number of the running task goroutines.", float64(ws.Tasks),
+			server, worker, shared)
+		w.Counter("netpoll_worker_tasks_spawned_total", "Number of the spawned task goroutines.",
+			float64(ws.TasksSpawned), server, worker, shared)
+	}
+}
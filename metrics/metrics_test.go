@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/php2go/netpollmux/mux"
+)
+
+func TestWriter(t *testing.T) {
+	var w Writer
+	w.Counter("requests_total", "Number of\nrequests.", 1, Label{"path", `/a"b\`})
+	w.Gauge("conns", "Number of conns.", 2)
+	w.Counter("requests_total", "Number of\nrequests.", 3, Label{"path", "/c"})
+	w.Histogram("latency_seconds", "Latency.", mux.Histogram{
+		Buckets: []float64{0.1, 1},
+		Counts:  []uint64{1, 2},
+		Count:   3,
+		Sum:     2.5,
+	}, Label{"path", "/c"})
+	var buf bytes.Buffer
+	w.WriteTo(&buf)
+	expect := `# HELP requests_total Number of\nrequests.
+# TYPE requests_total counter
+requests_total{path="/a\"b\\"} 1
+requests_total{path="/c"} 3
+# HELP conns Number of conns.
+# TYPE conns gauge
+conns 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/c",le="0.1"} 1
+latency_seconds_bucket{path="/c",le="1"} 2
+latency_seconds_bucket{path="/c",le="+Inf"} 3
+latency_seconds_sum{path="/c"} 2.5
+latency_seconds_count{path="/c"} 3
+`
+	if buf.String() != expect {
+		t.Error(buf.String())
+	}
+}
+
+func TestMount(t *testing.T) {
+	m := mux.NewRoute()
+	m.SetPoll(true)
+	m.HandleFunc("/hello/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World"))
+	}).Methods("GET")
+	Mount(m, "/metrics")
+	l, err := net.Listen("tcp", ":9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Serve(l)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	for _, path := range []string{"/hello/a", "/hello/b", "/missing"} {
+		resp, err := http.Get("http://127.0.0.1:9999" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	resp, err := http.Get("http://127.0.0.1:9999/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Error(resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`mux_requests_total{route="/hello/{name}",method="GET",code="200"} 2`,
+		`mux_request_duration_seconds_count{route="/hello/{name}",method="GET"} 2`,
+		`mux_response_size_bytes_bucket{route="/hello/{name}",method="GET",le="100"} 2`,
+		`mux_response_size_bytes_sum{route="/hello/{name}",method="GET"} 22`,
+		`mux_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`netpoll_accepted_total{server="0"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Error(line, string(body))
+		}
+	}
+	m.Close()
+	<-done
+}
@@ -0,0 +1,198 @@
+package mux
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Unmatched is the route label of the requests not matched by any route.
+const Unmatched = "unmatched"
+
+var (
+	// DefaultLatencyBuckets are the upper bounds in seconds of the latency histograms.
+	DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// DefaultSizeBuckets are the upper bounds in bytes of the response size histograms.
+	DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+// Histogram is a snapshot of a histogram.
+type Histogram struct {
+	// Buckets are the upper bounds of the buckets in increasing order.
+	Buckets []float64
+	// Counts[i] is the number of the observations less than or equal to
+	// Buckets[i].
+	Counts []uint64
+	// Count is the number of all the observations.
+	Count uint64
+	// Sum is the sum of all the observations.
+	Sum float64
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Buckets: h.buckets, Counts: make([]uint64, len(h.counts)), Count: h.count, Sum: h.sum}
+	var cumulative uint64
+	for i, n := range h.counts {
+		cumulative += n
+		s.Counts[i] = cumulative
+	}
+	return s
+}
+
+// RouteStats is a snapshot of the request metrics of a route and method.
+type RouteStats struct {
+	// Route is the path template of the route, or Unmatched.
+	Route string
+	// Method is the request method.
+	Method string
+	// Requests is the number of the requests by the response status code.
+	Requests map[int]uint64
+	// Latency is the histogram of the request durations in seconds.
+	Latency Histogram
+	// Size is the histogram of the response body sizes in bytes.
+	Size Histogram
+}
+
+type routeKey struct {
+	route  string
+	method string
+}
+
+type routeMetrics struct {
+	requests map[int]uint64
+	latency  *histogram
+	size     *histogram
+}
+
+// Metrics collects the request metrics of a Route by route and method.
+type Metrics struct {
+	// LatencyBuckets are the latency histogram buckets in seconds.
+	// If nil, DefaultLatencyBuckets is used.
+	LatencyBuckets []float64
+	// SizeBuckets are the response size histogram buckets in bytes.
+	// If nil, DefaultSizeBuckets is used.
+	SizeBuckets []float64
+
+	mut    sync.Mutex
+	routes map[routeKey]*routeMetrics
+}
+
+// Observe records a request to the route with the method, the response
+// status code, the response body size and the request duration.
+func (m *Metrics) Observe(route, method string, code int, size int64, d time.Duration) {
+	key := routeKey{route: route, method: method}
+	m.mut.Lock()
+	if m.routes == nil {
+		m.routes = make(map[routeKey]*routeMetrics)
+	}
+	rm, ok := m.routes[key]
+	if !ok {
+		latencyBuckets, sizeBuckets := m.LatencyBuckets, m.SizeBuckets
+		if latencyBuckets == nil {
+			latencyBuckets = DefaultLatencyBuckets
+		}
+		if sizeBuckets == nil {
+			sizeBuckets = DefaultSizeBuckets
+		}
+		rm = &routeMetrics{
+			requests: make(map[int]uint64),
+			latency:  newHistogram(latencyBuckets),
+			size:     newHistogram(sizeBuckets),
+		}
+		m.routes[key] = rm
+	}
+	rm.requests[code]++
+	rm.latency.observe(d.Seconds())
+	rm.size.observe(float64(size))
+	m.mut.Unlock()
+}
+
+// Snapshot returns the request metrics sorted by route and method.
+func (m *Metrics) Snapshot() []RouteStats {
+	m.mut.Lock()
+	stats := make([]RouteStats, 0, len(m.routes))
+	for key, rm := range m.routes {
+		requests := make(map[int]uint64, len(rm.requests))
+		for code, n := range rm.requests {
+			requests[code] = n
+		}
+		stats = append(stats, RouteStats{
+			Route:    key.route,
+			Method:   key.method,
+			Requests: requests,
+			Latency:  rm.latency.snapshot(),
+			Size:     rm.size.snapshot(),
+		})
+	}
+	m.mut.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Route != stats[j].Route {
+			return stats[i].Route < stats[j].Route
+		}
+		return stats[i].Method < stats[j].Method
+	})
+	return stats
+}
+
+// recordRoute is the Router middleware recording the path template of the
+// matched route on the Response, so that the request is routed only once.
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for w != nil {
+			if res, ok := w.(*Response); ok {
+				if route := mux.CurrentRoute(req); route != nil {
+					if tpl, err := route.GetPathTemplate(); err == nil {
+						res.route = tpl
+					}
+				}
+				break
+			}
+			u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+			if !ok {
+				break
+			}
+			w = u.Unwrap()
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// serveHTTP serves the request and records its metrics if enabled.
+func (m *Route) serveHTTP(handler http.Handler, res *Response, req *http.Request) {
+	metrics := m.metrics
+	if metrics == nil {
+		handler.ServeHTTP(res, req)
+		res.FinishRequest()
+		return
+	}
+	start := time.Now()
+	handler.ServeHTTP(res, req)
+	res.FinishRequest()
+	route := res.route
+	if route == "" {
+		route = Unmatched
+	}
+	metrics.Observe(route, req.Method, res.status, res.size, time.Since(start))
+}
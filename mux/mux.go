@@ -2,16 +2,22 @@ package mux
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/php2go/netpollmux/internal/logger"
 	"github.com/php2go/netpollmux/netpoll"
 )
 
+// proxyHeaderTimeout is the timeout of reading a PROXY protocol header,
+// as the default of the netpoll Server.
+const proxyHeaderTimeout = time.Second * 5
+
 // DefaultServer is the default HTTP server.
 var DefaultServer = NewRoute()
 
@@ -28,11 +34,14 @@ type Route struct {
 	// instead.
 	TLSConfig *tls.Config
 
-	fast      bool
-	poll      bool
-	mut       sync.Mutex
-	listeners []net.Listener
-	pollers   []*netpoll.Server
+	fast          bool
+	poll          bool
+	proxyProtocol bool
+	metrics       *Metrics
+	routing       bool
+	mut           sync.Mutex
+	listeners     []net.Listener
+	pollers       []*netpoll.Server
 }
 
 // NewRoute returns a new NewRouter instance.
@@ -50,6 +59,48 @@ func (m *Route) SetPoll(poll bool) {
 	m.poll = poll
 }
 
+// SetProxyProtocol enables the Server to read the PROXY protocol header
+// sent by a proxy or a load balancer, so that the remote address of the
+// requests is the address of the client. A conn whose header is not read
+// within 5 seconds is closed.
+func (m *Route) SetProxyProtocol(enable bool) {
+	m.proxyProtocol = enable
+}
+
+// SetMetrics enables the Server to collect the request metrics. The route
+// of a request is recorded by a middleware of the Router, so the requests
+// not dispatched by the Router are counted as Unmatched.
+func (m *Route) SetMetrics(enable bool) {
+	if !enable {
+		m.metrics = nil
+		return
+	}
+	if m.metrics == nil {
+		m.metrics = &Metrics{}
+	}
+	if !m.routing && m.Router != nil {
+		m.routing = true
+		m.Router.Use(recordRoute)
+	}
+}
+
+// Metrics returns the request metrics, or nil if they are not enabled.
+func (m *Route) Metrics() *Metrics {
+	return m.metrics
+}
+
+// PollStats returns the statistics of the netpoll servers.
+func (m *Route) PollStats() []netpoll.Stats {
+	m.mut.Lock()
+	pollers := m.pollers
+	m.mut.Unlock()
+	stats := make([]netpoll.Stats, 0, len(pollers))
+	for _, poller := range pollers {
+		stats = append(stats, poller.Stats())
+	}
+	return stats
+}
+
 // Run listens on the TCP network address addr and then calls
 // Serve with m to handle requests on incoming connections.
 // Accepted connections are configured to enable TCP keep-alives.
@@ -131,9 +182,14 @@ func (m *Route) serve(l net.Listener, config *tls.Config) error {
 			reader  *bufio.Reader
 			rw      *bufio.ReadWriter
 			conn    net.Conn
+			proxy   *netpoll.ProxyHeader
 			serving sync.Mutex
 		}
 		h.SetUpgrade(func(conn net.Conn) (netpoll.Context, error) {
+			var proxy *netpoll.ProxyHeader
+			if info, ok := conn.(netpoll.ConnInfo); ok {
+				proxy = info.ProxyHeader()
+			}
 			if config != nil {
 				tlsConn := tls.Server(conn, config)
 				if err := tlsConn.Handshake(); err != nil {
@@ -144,7 +200,7 @@ func (m *Route) serve(l net.Listener, config *tls.Config) error {
 			}
 			reader := bufio.NewReader(conn)
 			rw := bufio.NewReadWriter(reader, bufio.NewWriter(conn))
-			return &Context{reader: reader, conn: conn, rw: rw}, nil
+			return &Context{reader: reader, conn: conn, rw: rw, proxy: proxy}, nil
 		})
 		if m.fast {
 			h.SetServe(func(context netpoll.Context) error {
@@ -157,9 +213,9 @@ func (m *Route) serve(l net.Listener, config *tls.Config) error {
 					ctx.serving.Unlock()
 					return err
 				}
-				res := NewResponse(req, ctx.conn, ctx.rw)
-				handler.ServeHTTP(res, req)
-				res.FinishRequest()
+				r := setRemote(req, ctx.conn, ctx.proxy)
+				res := NewResponse(r, ctx.conn, ctx.rw)
+				m.serveHTTP(handler, res, r)
 				ctx.serving.Unlock()
 				FreeRequest(req)
 				FreeResponse(res)
@@ -176,22 +232,35 @@ func (m *Route) serve(l net.Listener, config *tls.Config) error {
 					ctx.serving.Unlock()
 					return err
 				}
+				req = setRemote(req, ctx.conn, ctx.proxy)
 				res := NewResponse(req, ctx.conn, ctx.rw)
-				handler.ServeHTTP(res, req)
-				res.FinishRequest()
+				m.serveHTTP(handler, res, req)
 				ctx.serving.Unlock()
 				FreeResponse(res)
 				return nil
 			})
 		}
 		poller := &netpoll.Server{
-			Handler: h,
+			Handler:       h,
+			ProxyProtocol: m.proxyProtocol,
 		}
 		m.mut.Lock()
 		m.pollers = append(m.pollers, poller)
 		m.mut.Unlock()
 		return poller.Serve(l)
 	}
+	if m.proxyProtocol {
+		m.mut.Lock()
+		m.listeners = append(m.listeners, l)
+		m.mut.Unlock()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return err
+			}
+			go m.serveProxyConn(conn, config)
+		}
+	}
 	if config != nil {
 		l = tls.NewListener(l, config)
 	}
@@ -204,7 +273,7 @@ func (m *Route) serve(l net.Listener, config *tls.Config) error {
 			if err != nil {
 				return err
 			}
-			go m.serveFastConn(conn)
+			go m.serveFastConn(conn, nil)
 		}
 	} else {
 		for {
@@ -212,11 +281,33 @@ func (m *Route) serve(l net.Listener, config *tls.Config) error {
 			if err != nil {
 				return err
 			}
-			go m.serveConn(conn)
+			go m.serveConn(conn, nil)
 		}
 	}
 }
 
+// serveProxyConn reads the PROXY protocol header of the conn, and then
+// serves the conn over TLS if config is not nil.
+func (m *Route) serveProxyConn(conn net.Conn, config *tls.Config) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	proxy, err := netpoll.ReadProxyHeader(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn = &proxyConn{Conn: conn, reader: reader, header: proxy}
+	if config != nil {
+		conn = tls.Server(conn, config)
+	}
+	if m.fast {
+		m.serveFastConn(conn, proxy)
+	} else {
+		m.serveConn(conn, proxy)
+	}
+}
+
 // Close closes the HTTP server.
 func (m *Route) Close() error {
 	m.mut.Lock()
@@ -233,7 +324,38 @@ func (m *Route) Close() error {
 	return nil
 }
 
-func (m *Route) serveConn(conn net.Conn) {
+// Shutdown gracefully shuts down the HTTP server. It closes the listeners
+// and shuts down the pollers, which wait for their busy conns to become
+// idle. Conns served by goroutines are not tracked and are not waited for.
+// If ctx expires first, the pollers are closed and ctx's error is returned.
+func (m *Route) Shutdown(ctx context.Context) error {
+	m.mut.Lock()
+	listeners, pollers := m.listeners, m.pollers
+	m.listeners = []net.Listener{}
+	m.pollers = []*netpoll.Server{}
+	m.mut.Unlock()
+	for _, lis := range listeners {
+		lis.Close()
+	}
+	var wg sync.WaitGroup
+	var errs = make([]error, len(pollers))
+	for i, poller := range pollers {
+		wg.Add(1)
+		go func(i int, poller *netpoll.Server) {
+			defer wg.Done()
+			errs[i] = poller.Shutdown(ctx)
+		}(i, poller)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Route) serveConn(conn net.Conn, proxy *netpoll.ProxyHeader) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
 	rw := bufio.NewReadWriter(reader, bufio.NewWriter(conn))
@@ -248,14 +370,14 @@ func (m *Route) serveConn(conn net.Conn) {
 		if err != nil {
 			break
 		}
+		req = setRemote(req, conn, proxy)
 		res := NewResponse(req, conn, rw)
-		handler.ServeHTTP(res, req)
-		res.FinishRequest()
+		m.serveHTTP(handler, res, req)
 		FreeResponse(res)
 	}
 }
 
-func (m *Route) serveFastConn(conn net.Conn) {
+func (m *Route) serveFastConn(conn net.Conn, proxy *netpoll.ProxyHeader) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
 	rw := bufio.NewReadWriter(reader, bufio.NewWriter(conn))
@@ -270,9 +392,9 @@ func (m *Route) serveFastConn(conn net.Conn) {
 		if err != nil {
 			break
 		}
-		res := NewResponse(req, conn, rw)
-		handler.ServeHTTP(res, req)
-		res.FinishRequest()
+		r := setRemote(req, conn, proxy)
+		res := NewResponse(r, conn, rw)
+		m.serveHTTP(handler, res, r)
 		FreeRequest(req)
 		FreeResponse(res)
 	}
@@ -1,9 +1,13 @@
 package mux
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"net"
 	"net/http"
+
+	"github.com/php2go/netpollmux/netpoll"
 )
 
 const (
@@ -11,9 +15,38 @@ const (
 	XForwardedFor = "X-Forwarded-For"
 )
 
+// proxyHeaderKey is the context key of the PROXY protocol header of a request.
+type proxyHeaderKey struct{}
+
+// ProxyHeader returns the PROXY protocol header of the conn which the
+// request was read from, or nil if the PROXY protocol is not enabled.
+func ProxyHeader(req *http.Request) *netpoll.ProxyHeader {
+	proxy, _ := req.Context().Value(proxyHeaderKey{}).(*netpoll.ProxyHeader)
+	return proxy
+}
+
+// setRemote sets the remote address of the request read from the conn,
+// and the PROXY protocol header of the conn if any.
+func setRemote(req *http.Request, conn net.Conn, proxy *netpoll.ProxyHeader) *http.Request {
+	req.RemoteAddr = conn.RemoteAddr().String()
+	if proxy != nil {
+		req = req.WithContext(context.WithValue(req.Context(), proxyHeaderKey{}, proxy))
+	}
+	return req
+}
+
+// RemoteAddr returns the IP of the client of the request. The address
+// from the PROXY protocol header is trusted over the X-Real-IP and
+// X-Forwarded-For headers.
 func RemoteAddr(req *http.Request) (addr string) {
 	addr = req.RemoteAddr
-	if ip := req.Header.Get(XRealIP); ip != "" {
+	if proxy := ProxyHeader(req); proxy != nil && !proxy.Local && proxy.SourceAddr != nil {
+		var err error
+		addr, _, err = net.SplitHostPort(proxy.SourceAddr.String())
+		if err != nil {
+			return ""
+		}
+	} else if ip := req.Header.Get(XRealIP); ip != "" {
 		addr = ip
 	} else if ip = req.Header.Get(XForwardedFor); ip != "" {
 		addr = ip
@@ -38,3 +71,28 @@ func IpTo4(addr string) uint32 {
 	ip = ip.To4()
 	return binary.BigEndian.Uint32(ip)
 }
+
+// proxyConn is a net.Conn whose PROXY protocol header has been read.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	header *netpoll.ProxyHeader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if !c.header.Local && c.header.DestinationAddr != nil {
+		return c.header.DestinationAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if !c.header.Local && c.header.SourceAddr != nil {
+		return c.header.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,41 @@
+package mux
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/php2go/netpollmux/netpoll"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.0.1:1234"
+	if addr := RemoteAddr(req); addr != "192.168.0.1" {
+		t.Error(addr)
+	}
+	req.Header.Set(XForwardedFor, "192.168.0.2")
+	if addr := RemoteAddr(req); addr != "192.168.0.2" {
+		t.Error(addr)
+	}
+	req.Header.Set(XRealIP, "192.168.0.3")
+	if addr := RemoteAddr(req); addr != "192.168.0.3" {
+		t.Error(addr)
+	}
+	conn, _ := net.Pipe()
+	proxy := &netpoll.ProxyHeader{Version: 2, SourceAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}}
+	req = setRemote(req, &proxyConn{Conn: conn, header: proxy}, proxy)
+	if ProxyHeader(req) != proxy {
+		t.Error(ProxyHeader(req))
+	}
+	if req.RemoteAddr != "10.0.0.1:1234" {
+		t.Error(req.RemoteAddr)
+	}
+	if addr := RemoteAddr(req); addr != "10.0.0.1" {
+		t.Error(addr)
+	}
+	proxy.Local = true
+	if addr := RemoteAddr(req); addr != "192.168.0.3" {
+		t.Error(addr)
+	}
+}
@@ -2,6 +2,7 @@ package mux
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -12,6 +13,8 @@ import (
 	"sync/atomic"
 	"time"
 	"unsafe"
+
+	"github.com/php2go/netpollmux/netpoll"
 )
 
 const (
@@ -111,6 +114,12 @@ var responsePool = sync.Pool{
 	},
 }
 
+var headerBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 var headerHeaderPool = sync.Pool{
 	New: func() interface{} {
 		return make(http.Header)
@@ -149,6 +158,7 @@ type Response struct {
 	handlerHeader http.Header
 	setHeader     header
 	written       int64 // number of bytes written in body
+	size          int64 // number of bytes written in body since the header
 	noCache       bool
 	contentLength int64 // explicitly-declared Content-Length; or -1
 	status        int
@@ -156,6 +166,10 @@ type Response struct {
 	dateBuf       [len(TimeFormat)]byte
 	clenBuf       [10]byte
 	statusBuf     [3]byte
+	chunkBuf      [18]byte
+	bw            netpoll.BuffersWriter // writes the header and the body by writev
+	hbuf          *bytes.Buffer         // the header not written to rw yet
+	route         string                // the path template of the matched route
 
 	bufferPool  *sync.Pool
 	handlerDone atomicBool // set true when the handler exits
@@ -184,6 +198,9 @@ func NewResponseSize(req *http.Request, conn net.Conn, rw *bufio.ReadWriter, siz
 	res.req = req
 	res.conn = conn
 	res.rw = rw
+	res.bw, _ = conn.(netpoll.BuffersWriter)
+	res.hbuf = nil
+	res.route = ""
 	res.cw.res = res
 	res.bufferPool = bufferPool
 	res.buffer = bufferPool.Get().([]byte)
@@ -220,6 +237,7 @@ func (w *Response) Write(data []byte) (n int, err error) {
 		w.written = written
 		if !w.noCache && w.written <= int64(len(w.buffer)) {
 			n = copy(w.buffer[offset:w.written], data)
+			w.size += int64(n)
 			return
 		}
 		if !w.noCache {
@@ -229,7 +247,9 @@ func (w *Response) Write(data []byte) (n int, err error) {
 			}
 		}
 	}
-	return w.cw.Write(data)
+	n, err = w.cw.Write(data)
+	w.size += int64(n)
+	return
 }
 
 // WriteHeader sends an HTTP response header with the provided
@@ -392,6 +412,10 @@ func (cw *chunkWriter) Write(p []byte) (n int, err error) {
 		// Eat writes.
 		return len(p), nil
 	}
+	if cw.vectored(len(p)) {
+		return cw.writeBuffers(p)
+	}
+	cw.writePendingHeader()
 	if cw.chunking {
 		_, err = fmt.Fprintf(cw.res.rw, chunk, len(p))
 		if err != nil {
@@ -409,10 +433,65 @@ func (cw *chunkWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// vectored reports whether the pending header and the n bytes of the body
+// would overflow the empty bufio writer, so that they are better written
+// by writev than copied.
+func (cw *chunkWriter) vectored(n int) bool {
+	res := cw.res
+	if res.bw == nil || res.rw.Writer.Buffered() > 0 {
+		return false
+	}
+	if res.hbuf != nil {
+		n += res.hbuf.Len()
+	}
+	return n >= res.rw.Writer.Available()
+}
+
+// writeBuffers writes the pending header and the body p with its chunk
+// framing by writev.
+func (cw *chunkWriter) writeBuffers(p []byte) (n int, err error) {
+	res := cw.res
+	bufs := make([][]byte, 0, 4)
+	if res.hbuf != nil {
+		bufs = append(bufs, res.hbuf.Bytes())
+	}
+	if cw.chunking {
+		bufs = append(bufs, append(strconv.AppendInt(res.chunkBuf[:0], int64(len(p)), 16), crlf...))
+	}
+	bufs = append(bufs, p)
+	if cw.chunking {
+		bufs = append(bufs, crlf)
+	}
+	_, err = res.bw.WriteBuffers(bufs)
+	cw.freeHeaderBuffer()
+	if err != nil {
+		res.conn.Close()
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writePendingHeader copies the pending header to the bufio writer.
+func (cw *chunkWriter) writePendingHeader() {
+	if hbuf := cw.res.hbuf; hbuf != nil {
+		cw.res.rw.Write(hbuf.Bytes())
+		cw.freeHeaderBuffer()
+	}
+}
+
+func (cw *chunkWriter) freeHeaderBuffer() {
+	if hbuf := cw.res.hbuf; hbuf != nil {
+		cw.res.hbuf = nil
+		hbuf.Reset()
+		headerBufferPool.Put(hbuf)
+	}
+}
+
 func (cw *chunkWriter) flush() {
 	if !cw.wroteHeader {
 		cw.writeHeader(nil)
 	}
+	cw.writePendingHeader()
 	cw.res.rw.Flush()
 }
 
@@ -420,6 +499,7 @@ func (cw *chunkWriter) close() {
 	if !cw.wroteHeader {
 		cw.writeHeader(nil)
 	}
+	cw.writePendingHeader()
 	if cw.chunking {
 		bw := cw.res.rw // conn's bufio writer
 		// zero chunk to mark EOF
@@ -469,30 +549,37 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 	if co := w.handlerHeader.Get(connection); co != emptyString {
 		w.setHeader.connection = co
 	}
-	w.rw.WriteString(httpVersion)
+	// The header is kept in hbuf to be written along with the body by
+	// writev if the conn supports it.
+	var hw headerWriter = w.rw.Writer
+	if w.bw != nil && w.rw.Writer.Buffered() == 0 {
+		w.hbuf = headerBufferPool.Get().(*bytes.Buffer)
+		hw = w.hbuf
+	}
+	hw.WriteString(httpVersion)
 	if text := http.StatusText(w.status); len(text) > 0 {
-		w.rw.Write(strconv.AppendInt(w.statusBuf[:0], int64(w.status), 10))
-		w.rw.WriteByte(' ')
-		w.rw.WriteString(text)
-		w.rw.Write(crlf)
+		hw.Write(strconv.AppendInt(w.statusBuf[:0], int64(w.status), 10))
+		hw.WriteByte(' ')
+		hw.WriteString(text)
+		hw.Write(crlf)
 	} else {
 		// don't worry about performance
-		fmt.Fprintf(w.rw, "%03d status code %d\r\n", w.status, w.status)
+		fmt.Fprintf(hw, "%03d status code %d\r\n", w.status, w.status)
 	}
-	w.setHeader.Write(w.rw.Writer)
+	w.setHeader.Write(hw)
 	for key := range w.handlerHeader {
 		value := w.handlerHeader.Get(key)
 		if key == date || key == contentLength || key == transferEncoding || key == contentType || key == connection {
 			continue
 		}
 		if len(key) > 0 && len(value) > 0 {
-			w.rw.WriteString(key)
-			w.rw.Write(colonSpace)
-			w.rw.WriteString(value)
-			w.rw.Write(crlf)
+			hw.WriteString(key)
+			hw.Write(colonSpace)
+			hw.WriteString(value)
+			hw.Write(crlf)
 		}
 	}
-	w.rw.Write(crlf)
+	hw.Write(crlf)
 }
 
 // TimeFormat is the time format to use when generating times in HTTP
@@ -525,6 +612,13 @@ func appendTime(b []byte, t time.Time) []byte {
 		'G', 'M', 'T')
 }
 
+// headerWriter is implemented by *bufio.Writer and *bytes.Buffer.
+type headerWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
 type header struct {
 	date             []byte
 	contentLength    string
@@ -554,7 +648,7 @@ var (
 // This method has a value receiver, despite the somewhat large size
 // of h, because it prevents an allocation. The escape analysis isn't
 // smart enough to realize this function doesn't mutate h.
-func (h header) Write(w *bufio.Writer) {
+func (h header) Write(w headerWriter) {
 	if h.date != nil {
 		w.Write(headerDate)
 		w.Write(h.date)
@@ -0,0 +1,34 @@
+package netpoll
+
+// distributeCPUs returns the CPU and the NUMA node of each of the n workers.
+// The CPUs of the set are grouped by the nodes, and the workers are
+// distributed across the nodes in turn.
+func distributeCPUs(set []int, nodes [][]int, n int) (cpus []int, nodeOf []int) {
+	in := make(map[int]bool, len(set))
+	for _, cpu := range set {
+		in[cpu] = true
+	}
+	var groups [][]int
+	for _, node := range nodes {
+		var group []int
+		for _, cpu := range node {
+			if in[cpu] {
+				group = append(group, cpu)
+			}
+		}
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		groups = [][]int{set}
+	}
+	cpus, nodeOf = make([]int, n), make([]int, n)
+	for i := 0; i < n; i++ {
+		node := i % len(groups)
+		group := groups[node]
+		cpus[i] = group[(i/len(groups))%len(group)]
+		nodeOf[i] = node
+	}
+	return
+}
@@ -0,0 +1,24 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+// setAffinity is not supported.
+func setAffinity(cpus []int) error {
+	return nil
+}
+
+// getAffinity returns nil since the CPU affinity is not supported.
+func getAffinity() ([]int, error) {
+	return nil, nil
+}
+
+// numaNodes returns nil since the topology is unknown.
+func numaNodes() [][]int {
+	return nil
+}
+
+// incomingCPU returns -1 since SO_INCOMING_CPU is not supported.
+func incomingCPU(fd int) int {
+	return -1
+}
@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soIncomingCPU = 0x31
+	maxCPUs       = 1024
+)
+
+type cpuMask [maxCPUs / 64]uint64
+
+// setAffinity sets the CPU affinity of the calling thread to the cpus.
+func setAffinity(cpus []int) error {
+	var mask cpuMask
+	for _, cpu := range cpus {
+		if cpu >= 0 && cpu < maxCPUs {
+			mask[cpu/64] |= 1 << (uint(cpu) % 64)
+		}
+	}
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// getAffinity returns the CPU affinity of the calling thread.
+func getAffinity() ([]int, error) {
+	var mask cpuMask
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if e != 0 {
+		return nil, e
+	}
+	var cpus []int
+	for cpu := 0; cpu < maxCPUs; cpu++ {
+		if mask[cpu/64]&(1<<(uint(cpu)%64)) != 0 {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// numaNodes returns the CPUs of every NUMA node, or nil if the topology
+// is unknown.
+func numaNodes() [][]int {
+	var nodes [][]int
+	paths, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*/cpulist")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if cpus, err := parseCPUList(strings.TrimSpace(string(data))); err == nil && len(cpus) > 0 {
+			nodes = append(nodes, cpus)
+		}
+	}
+	return nodes
+}
+
+// parseCPUList parses a CPU list such as "0-3,8,10-11".
+func parseCPUList(s string) (cpus []int, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// incomingCPU returns the CPU that handled the packets of the socket fd,
+// or -1 if it is unknown.
+func incomingCPU(fd int) int {
+	cpu, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, soIncomingCPU)
+	if err != nil {
+		return -1
+	}
+	return cpu
+}
@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0-2,5,7-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []int{0, 1, 2, 5, 7, 8}
+	if len(cpus) != len(expect) {
+		t.Fatal(cpus)
+	}
+	for i := range cpus {
+		if cpus[i] != expect[i] {
+			t.Error(cpus)
+		}
+	}
+	if _, err := parseCPUList("0-a"); err == nil {
+		t.Error("no error")
+	}
+	if cpus, _ := parseCPUList(""); cpus != nil {
+		t.Error(cpus)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		cpus, err := getAffinity()
+		if err != nil || len(cpus) == 0 {
+			t.Error(cpus, err)
+			return
+		}
+		if err := setAffinity(cpus[len(cpus)-1:]); err != nil {
+			t.Error(err)
+		}
+		if pinned, _ := getAffinity(); len(pinned) != 1 || pinned[0] != cpus[len(cpus)-1] {
+			t.Error(pinned)
+		}
+	}()
+	<-done
+}
+
+func TestIncomingCPU(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("Hello World"))
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Read(make([]byte, 64))
+	raw, _ := c.(*net.TCPConn).SyscallConn()
+	raw.Control(func(fd uintptr) {
+		if cpu := incomingCPU(int(fd)); cpu < 0 {
+			t.Error(cpu)
+		}
+	})
+	if cpu := incomingCPU(-1); cpu != -1 {
+		t.Error(cpu)
+	}
+}
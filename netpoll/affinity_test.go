@@ -0,0 +1,23 @@
+package netpoll
+
+import (
+	"testing"
+)
+
+func TestDistributeCPUs(t *testing.T) {
+	nodes := [][]int{{0, 1, 2, 3}, {4, 5, 6, 7}}
+	cpus, nodeOf := distributeCPUs([]int{0, 1, 4, 5, 6}, nodes, 6)
+	expectCPUs := []int{0, 4, 1, 5, 0, 6}
+	expectNodes := []int{0, 1, 0, 1, 0, 1}
+	for i := range cpus {
+		if cpus[i] != expectCPUs[i] || nodeOf[i] != expectNodes[i] {
+			t.Error(i, cpus[i], nodeOf[i])
+		}
+	}
+	cpus, nodeOf = distributeCPUs([]int{2, 3}, nil, 3)
+	for i, cpu := range []int{2, 3, 2} {
+		if cpus[i] != cpu || nodeOf[i] != 0 {
+			t.Error(i, cpus[i], nodeOf[i])
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package netpoll
+
+import (
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+)
+
+// WorkerInfo describes a worker that a conn can be assigned to.
+type WorkerInfo struct {
+	// Index is the index of the worker in the server.
+	Index int
+	// Shared reports whether the worker serves its conns by async tasks.
+	Shared bool
+	// Conns is the number of the conns served by the worker.
+	Conns int
+	// Load is the number of the reads of the conns served by the worker
+	// in the last rescheduling interval.
+	Load int64
+}
+
+// Balancer assigns the new conns to the workers.
+//
+// When a Balancer is set, the server does not move the conns between
+// the workers, so that a conn stays on the worker it is assigned to, and
+// the unshared workers serve as many conns as the Balancer assigns them.
+type Balancer interface {
+	// Balance returns the index in workers of the worker to serve the conn c.
+	// The workers of a listener are always passed in the same order.
+	// If the index is out of range, the default assignment is used.
+	Balance(c net.Conn, workers []WorkerInfo) int
+}
+
+// RoundRobinBalancer assigns the conns to the workers in turn.
+type RoundRobinBalancer struct {
+	next uint64
+}
+
+// Balance implements the Balancer Balance method.
+func (b *RoundRobinBalancer) Balance(c net.Conn, workers []WorkerInfo) int {
+	return int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(workers)))
+}
+
+// LeastConnectionsBalancer assigns a conn to the worker with the fewest conns.
+type LeastConnectionsBalancer struct{}
+
+// Balance implements the Balancer Balance method.
+func (b LeastConnectionsBalancer) Balance(c net.Conn, workers []WorkerInfo) int {
+	index := -1
+	for i := range workers {
+		if index < 0 || workers[i].Conns < workers[index].Conns {
+			index = i
+		}
+	}
+	return index
+}
+
+// SourceIPHashBalancer assigns the conns from the same IP to the same worker, as long as the number of the workers does not change. With the
+// PROXY protocol, the IP is the one of the proxy.
+type SourceIPHashBalancer struct{}
+
+// Balance implements the Balancer Balance method.
+func (b SourceIPHashBalancer) Balance(c net.Conn, workers []WorkerInfo) int {
+	h := fnv.New32a()
+	switch addr := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		h.Write(addr.IP)
+	case nil:
+	default:
+		h.Write([]byte(addr.String()))
+	}
+	return int(h.Sum32() % uint32(len(workers)))
+}
+
+// LeastLoadBalancer assigns a conn to the worker with the least recent load,
+// and then with the fewest conns.
+type LeastLoadBalancer struct{}
+
+// Balance implements the Balancer Balance method.
+func (b LeastLoadBalancer) Balance(c net.Conn, workers []WorkerInfo) int {
+	index := -1
+	for i := range workers {
+		if index < 0 || workers[i].Load < workers[index].Load ||
+			workers[i].Load == workers[index].Load && workers[i].Conns < workers[index].Conns {
+			index = i
+		}
+	}
+	return index
+}
@@ -0,0 +1,83 @@
+package netpoll
+
+import (
+	"net"
+	"testing"
+)
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := &RoundRobinBalancer{}
+	workers := make([]WorkerInfo, 3)
+	for i := 0; i < 6; i++ {
+		if index := b.Balance(nil, workers); index != i%3 {
+			t.Error(i, index)
+		}
+	}
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	workers := []WorkerInfo{{Conns: 3}, {Conns: 1, Load: 9}, {Conns: 2}}
+	if index := (LeastConnectionsBalancer{}).Balance(nil, workers); index != 1 {
+		t.Error(index)
+	}
+}
+
+func TestSourceIPHashBalancer(t *testing.T) {
+	workers := make([]WorkerInfo, 8)
+	b := SourceIPHashBalancer{}
+	c := &addrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}}
+	index := b.Balance(c, workers)
+	c.addr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}
+	if b.Balance(c, workers) != index {
+		t.Error("different worker for the same IP")
+	}
+	indexes := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		c.addr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1000}
+		indexes[b.Balance(c, workers)] = true
+	}
+	if len(indexes) < 2 {
+		t.Error(indexes)
+	}
+}
+
+func TestLeastLoadBalancer(t *testing.T) {
+	workers := []WorkerInfo{{Conns: 1, Load: 5}, {Conns: 3, Load: 2}, {Conns: 2, Load: 2}}
+	if index := (LeastLoadBalancer{}).Balance(nil, workers); index != 2 {
+		t.Error(index)
+	}
+}
+
+func TestBalancerUnsharedWorkers(t *testing.T) {
+	workers := []WorkerInfo{{Conns: 1, Load: 4}, {Conns: 2, Shared: true}, {Load: 1}, {Conns: 1, Load: 3, Shared: true}}
+	rr := &RoundRobinBalancer{}
+	for i := 0; i < 8; i++ {
+		if index := rr.Balance(nil, workers); index != i%4 {
+			t.Error(i, index)
+		}
+	}
+	if index := (LeastConnectionsBalancer{}).Balance(nil, workers); index != 2 {
+		t.Error(index)
+	}
+	if index := (LeastLoadBalancer{}).Balance(nil, workers); index != 1 {
+		t.Error(index)
+	}
+	b := SourceIPHashBalancer{}
+	indexes := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		c := &addrConn{addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1000}}
+		indexes[b.Balance(c, workers)] = true
+	}
+	if len(indexes) != len(workers) {
+		t.Error(indexes)
+	}
+}
@@ -0,0 +1,28 @@
+package netpoll
+
+// BuffersWriter is implemented by the conns of a Server, which write
+// several buffers by a single system call. The conns also write a
+// *net.Buffers passed to their ReadFrom this way. Note that io.Copy from
+// a *net.Buffers calls its WriteTo instead, which writes the buffers one
+// by one to a conn.
+type BuffersWriter interface {
+	// WriteBuffers writes the bufs in order as if they were concatenated.
+	WriteBuffers(bufs [][]byte) (int64, error)
+}
+
+// BuffersReader is implemented by the conns of a Server, which read
+// into several buffers by a single system call.
+type BuffersReader interface {
+	// ReadBuffers reads into the bufs in order as if they were concatenated.
+	ReadBuffers(bufs [][]byte) (int64, error)
+}
+
+// advance skips n bytes of the bufs, where the first off bytes of bufs[0]
+// have been skipped before.
+func advance(bufs [][]byte, off, n int) ([][]byte, int) {
+	for len(bufs) > 0 && n >= len(bufs[0])-off {
+		n -= len(bufs[0]) - off
+		bufs, off = bufs[1:], 0
+	}
+	return bufs, off + n
+}
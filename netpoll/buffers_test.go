@@ -0,0 +1,21 @@
+package netpoll
+
+import (
+	"testing"
+)
+
+func TestAdvance(t *testing.T) {
+	bufs := [][]byte{[]byte("ab"), []byte("cde"), []byte("f")}
+	if rest, off := advance(bufs, 0, 0); len(rest) != 3 || off != 0 {
+		t.Error(len(rest), off)
+	}
+	if rest, off := advance(bufs, 0, 3); len(rest) != 2 || off != 1 {
+		t.Error(len(rest), off)
+	}
+	if rest, off := advance(bufs, 1, 1); len(rest) != 2 || off != 0 {
+		t.Error(len(rest), off)
+	}
+	if rest, off := advance(bufs, 0, 6); len(rest) != 0 || off != 0 {
+		t.Error(len(rest), off)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// maxIovecs is the maximum number of the buffers of a single readv or writev.
+const maxIovecs = 1024
+
+// iovecs returns the iovecs of the bufs, skipping the first off bytes of bufs[0].
+func iovecs(bufs [][]byte, off int) []syscall.Iovec {
+	n := len(bufs)
+	if n > maxIovecs {
+		n = maxIovecs
+	}
+	iovs := make([]syscall.Iovec, 0, n)
+	for i, b := range bufs {
+		if i == 0 {
+			b = b[off:]
+		}
+		if len(b) == 0 {
+			continue
+		}
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		if iovs = append(iovs, iov); len(iovs) == maxIovecs {
+			break
+		}
+	}
+	return iovs
+}
+
+func writev(fd int, bufs [][]byte, off int) (int, error) {
+	iovs := iovecs(bufs, off)
+	if len(iovs) == 0 {
+		return 0, nil
+	}
+	n, _, e := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	if e != 0 {
+		return 0, e
+	}
+	return int(n), nil
+}
+
+func readv(fd int, bufs [][]byte) (int, error) {
+	iovs := iovecs(bufs, 0)
+	if len(iovs) == 0 {
+		return 0, nil
+	}
+	n, _, e := syscall.Syscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	if e != 0 {
+		return -1, e
+	}
+	return int(n), nil
+}
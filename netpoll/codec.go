@@ -0,0 +1,260 @@
+package netpoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrFrameTooLarge is the error returned by a Codec when a frame exceeds
+// its maximum length.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrLengthSize is the error returned by LengthCodec when its Size is not
+// 1, 2, 4 or 8.
+var ErrLengthSize = errors.New("length size must be 1, 2, 4 or 8")
+
+// ErrFixedSize is the error when the Size of a FixedCodec is not positive.
+var ErrFixedSize = errors.New("fixed size must be positive")
+
+// ErrDelimiter is the error when the Delimiter of a DelimiterCodec is empty.
+var ErrDelimiter = errors.New("delimiter must be not empty")
+
+// Codec splits a stream into frames and frames the payloads written to it.
+type Codec interface {
+	// Decode returns the payload of the first frame of data and the number
+	// of bytes of the frame, or zero if data does not hold a complete frame.
+	Decode(data []byte) (payload []byte, n int, err error)
+	// Encode appends the frame of the payload to dst and returns the
+	// extended buffer.
+	Encode(dst, payload []byte) []byte
+}
+
+// LengthCodec frames a payload by prefixing its length in Size bytes.
+type LengthCodec struct {
+	// Size is the number of bytes of the length, which is 1, 2, 4 or 8.
+	Size int
+	// Order is the byte order of the length. If nil, binary.BigEndian is used.
+	Order binary.ByteOrder
+	// MaxLength limits the length of a payload. If zero, there is no limit
+	// other than the Size.
+	MaxLength int
+}
+
+func (c *LengthCodec) order() binary.ByteOrder {
+	if c.Order == nil {
+		return binary.BigEndian
+	}
+	return c.Order
+}
+
+// Decode implements the Codec Decode method.
+func (c *LengthCodec) Decode(data []byte) (payload []byte, n int, err error) {
+	if len(data) < c.Size {
+		return nil, 0, nil
+	}
+	var length uint64
+	switch c.Size {
+	case 1:
+		length = uint64(data[0])
+	case 2:
+		length = uint64(c.order().Uint16(data))
+	case 4:
+		length = uint64(c.order().Uint32(data))
+	case 8:
+		length = c.order().Uint64(data)
+	default:
+		return nil, 0, ErrLengthSize
+	}
+	if c.MaxLength > 0 && length > uint64(c.MaxLength) || length > uint64(maxInt-c.Size) {
+		return nil, 0, ErrFrameTooLarge
+	}
+	n = c.Size + int(length)
+	if len(data) < n {
+		return nil, 0, nil
+	}
+	return data[c.Size:n], n, nil
+}
+
+// Encode implements the Codec Encode method. It panics with ErrLengthSize
+// if the Size is invalid, or with ErrFrameTooLarge if the length of the
+// payload does not fit in Size bytes.
+func (c *LengthCodec) Encode(dst, payload []byte) []byte {
+	if c.tooLarge(len(payload)) {
+		panic(ErrFrameTooLarge)
+	}
+	var length [8]byte
+	switch c.Size {
+	case 1:
+		length[0] = byte(len(payload))
+	case 2:
+		c.order().PutUint16(length[:], uint16(len(payload)))
+	case 4:
+		c.order().PutUint32(length[:], uint32(len(payload)))
+	case 8:
+		c.order().PutUint64(length[:], uint64(len(payload)))
+	default:
+		panic(ErrLengthSize)
+	}
+	dst = append(dst, length[:c.Size]...)
+	return append(dst, payload...)
+}
+
+// tooLarge reports whether the length n does not fit in Size bytes.
+func (c *LengthCodec) tooLarge(n int) bool {
+	return c.Size < 8 && c.Size > 0 && uint64(n) >= 1<<(8*uint(c.Size))
+}
+
+// VarintCodec frames a payload by prefixing its length as an unsigned
+// varint, which is the framing of the socket messages.
+type VarintCodec struct {
+	// MaxLength limits the length of a payload. If zero, there is no limit.
+	MaxLength int
+}
+
+// Decode implements the Codec Decode method.
+func (c *VarintCodec) Decode(data []byte) (payload []byte, n int, err error) {
+	length, size := binary.Uvarint(data)
+	if size == 0 {
+		return nil, 0, nil
+	} else if size < 0 {
+		return nil, 0, ErrFrameTooLarge
+	}
+	if c.MaxLength > 0 && length > uint64(c.MaxLength) || length > uint64(maxInt-size) {
+		return nil, 0, ErrFrameTooLarge
+	}
+	n = size + int(length)
+	if len(data) < n {
+		return nil, 0, nil
+	}
+	return data[size:n], n, nil
+}
+
+// Encode implements the Codec Encode method.
+func (c *VarintCodec) Encode(dst, payload []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	dst = append(dst, length[:binary.PutUvarint(length[:], uint64(len(payload)))]...)
+	return append(dst, payload...)
+}
+
+// DelimiterCodec frames a payload by terminating it with the Delimiter.
+type DelimiterCodec struct {
+	// Delimiter terminates every frame. It must be not empty.
+	Delimiter []byte
+	// MaxLength limits the length of a payload. If zero, there is no limit.
+	MaxLength int
+}
+
+// Decode implements the Codec Decode method.
+func (c *DelimiterCodec) Decode(data []byte) (payload []byte, n int, err error) {
+	i := bytes.Index(data, c.Delimiter)
+	if i < 0 {
+		if c.MaxLength > 0 && len(data) >= c.MaxLength+len(c.Delimiter) {
+			return nil, 0, ErrFrameTooLarge
+		}
+		return nil, 0, nil
+	}
+	if c.MaxLength > 0 && i > c.MaxLength {
+		return nil, 0, ErrFrameTooLarge
+	}
+	return data[:i], i + len(c.Delimiter), nil
+}
+
+// Encode implements the Codec Encode method.
+func (c *DelimiterCodec) Encode(dst, payload []byte) []byte {
+	dst = append(dst, payload...)
+	return append(dst, c.Delimiter...)
+}
+
+// LineCodec frames a payload as a line terminated by "\n". A "\r"
+// before the "\n" is dropped from the decoded payload.
+type LineCodec struct {
+	// MaxLength limits the length of a line. If zero, there is no limit.
+	MaxLength int
+}
+
+// Decode implements the Codec Decode method.
+func (c *LineCodec) Decode(data []byte) (payload []byte, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		// Leaves room for the "\r\n".
+		if c.MaxLength > 0 && len(data) >= c.MaxLength+2 {
+			return nil, 0, ErrFrameTooLarge
+		}
+		return nil, 0, nil
+	}
+	payload = data[:i]
+	if i > 0 && payload[i-1] == '\r' {
+		payload = payload[:i-1]
+	}
+	if c.MaxLength > 0 && len(payload) > c.MaxLength {
+		return nil, 0, ErrFrameTooLarge
+	}
+	return payload, i + 1, nil
+}
+
+// Encode implements the Codec Encode method.
+func (c *LineCodec) Encode(dst, payload []byte) []byte {
+	dst = append(dst, payload...)
+	return append(dst, '\n')
+}
+
+// FixedCodec frames a payload by its fixed Size.
+type FixedCodec struct {
+	// Size is the length of every payload.
+	Size int
+}
+
+// Decode implements the Codec Decode method.
+func (c *FixedCodec) Decode(data []byte) (payload []byte, n int, err error) {
+	if c.Size < 1 || len(data) < c.Size {
+		return nil, 0, nil
+	}
+	return data[:c.Size], c.Size, nil
+}
+
+// Encode implements the Codec Encode method. A payload is padded with
+// zeros or truncated to the Size.
+func (c *FixedCodec) Encode(dst, payload []byte) []byte {
+	if len(payload) > c.Size {
+		payload = payload[:c.Size]
+	}
+	dst = append(dst, payload...)
+	for i := len(payload); i < c.Size; i++ {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// checkEncode returns ErrFrameTooLarge if the payload cannot be framed by
+// the built-in codec, whose Encode would panic.
+func checkEncode(codec Codec, payload []byte) error {
+	if c, ok := codec.(*LengthCodec); ok && c.tooLarge(len(payload)) {
+		return ErrFrameTooLarge
+	}
+	return nil
+}
+
+// validateCodec checks the configuration of the built-in codecs, which
+// would otherwise fail on every frame or never complete one.
+func validateCodec(codec Codec) error {
+	switch c := codec.(type) {
+	case *LengthCodec:
+		switch c.Size {
+		case 1, 2, 4, 8:
+		default:
+			return ErrLengthSize
+		}
+	case *DelimiterCodec:
+		if len(c.Delimiter) == 0 {
+			return ErrDelimiter
+		}
+	case *FixedCodec:
+		if c.Size < 1 {
+			return ErrFixedSize
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package netpoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	var codecs = []Codec{
+		&LengthCodec{Size: 1},
+		&LengthCodec{Size: 2},
+		&LengthCodec{Size: 4, Order: binary.LittleEndian},
+		&LengthCodec{Size: 8},
+		&VarintCodec{},
+		&DelimiterCodec{Delimiter: []byte("\r\n")},
+		&LineCodec{},
+		&FixedCodec{Size: 5},
+	}
+	for _, codec := range codecs {
+		var data []byte
+		data = codec.Encode(data, []byte("hello"))
+		data = codec.Encode(data, []byte("world"))
+		for i := 0; i < len(data)/2; i++ {
+			if _, n, err := codec.Decode(data[:i]); err != nil || n != 0 {
+				t.Errorf("%T %d %v", codec, n, err)
+			}
+		}
+		payload, n, err := codec.Decode(data)
+		if err != nil {
+			t.Error(err)
+		} else if string(payload) != "hello" || n != len(data)/2 {
+			t.Errorf("%T %s %d", codec, payload, n)
+		}
+		payload, n, err = codec.Decode(data[n:])
+		if err != nil {
+			t.Error(err)
+		} else if string(payload) != "world" || n != len(data)/2 {
+			t.Errorf("%T %s %d", codec, payload, n)
+		}
+	}
+}
+
+func TestCodecMaxLength(t *testing.T) {
+	var codecs = []Codec{
+		&LengthCodec{Size: 2, MaxLength: 4},
+		&VarintCodec{MaxLength: 4},
+		&DelimiterCodec{Delimiter: []byte("\n"), MaxLength: 4},
+		&LineCodec{MaxLength: 4},
+	}
+	for _, codec := range codecs {
+		data := codec.Encode(nil, []byte("hello"))
+		if _, _, err := codec.Decode(data); err != ErrFrameTooLarge {
+			t.Errorf("%T %v", codec, err)
+		}
+		data = codec.Encode(nil, []byte("hell"))
+		if payload, _, err := codec.Decode(data); err != nil || string(payload) != "hell" {
+			t.Errorf("%T %s %v", codec, payload, err)
+		}
+	}
+	if _, _, err := (&DelimiterCodec{Delimiter: []byte("\n"), MaxLength: 4}).Decode([]byte("hello!")); err != ErrFrameTooLarge {
+		t.Error(err)
+	}
+	if _, _, err := (&LengthCodec{Size: 3}).Decode([]byte("hello")); err != ErrLengthSize {
+		t.Error(err)
+	}
+}
+
+func TestLengthCodecEncode(t *testing.T) {
+	var encode = func(codec *LengthCodec, payload []byte) (err interface{}) {
+		defer func() { err = recover() }()
+		codec.Encode(nil, payload)
+		return
+	}
+	if err := encode(&LengthCodec{Size: 1}, make([]byte, 256)); err != ErrFrameTooLarge {
+		t.Error(err)
+	}
+	if err := encode(&LengthCodec{Size: 1}, make([]byte, 255)); err != nil {
+		t.Error(err)
+	}
+	if err := encode(&LengthCodec{Size: 3}, []byte("hello")); err != ErrLengthSize {
+		t.Error(err)
+	}
+}
+
+func TestLineCodec(t *testing.T) {
+	codec := &LineCodec{}
+	payload, n, err := codec.Decode([]byte("hello\r\nworld\n"))
+	if err != nil || string(payload) != "hello" || n != 7 {
+		t.Error(string(payload), n, err)
+	}
+	if data := (&FixedCodec{Size: 4}).Encode(nil, []byte("hello")); !bytes.Equal(data, []byte("hell")) {
+		t.Error(data)
+	}
+	if data := (&FixedCodec{Size: 4}).Encode(nil, []byte("he")); !bytes.Equal(data, []byte("he\x00\x00")) {
+		t.Error(data)
+	}
+}
@@ -0,0 +1,31 @@
+package netpoll
+
+import (
+	"time"
+)
+
+// ConnInfo is implemented by the net.Conn passed to Handler.Upgrade by
+// a Server or a Dialer, so that a Handler can get the metadata of the
+// conn from its Context.
+type ConnInfo interface {
+	// ID returns the unique ID of the conn in the process.
+	ID() uint64
+	// Created returns the time when the conn was accepted or dialed.
+	Created() time.Time
+	// BytesRead returns the number of the bytes read from the conn.
+	BytesRead() int64
+	// BytesWritten returns the number of the bytes written to the conn.
+	BytesWritten() int64
+	// Reads returns the number of the Read calls of the conn.
+	Reads() int64
+	// Worker returns the index of the worker currently serving the conn,
+	// and whether it is a shared worker serving its conns by async tasks.
+	Worker() (index int, shared bool)
+	// Value returns the value set by SetValue.
+	Value() interface{}
+	// SetValue sets the user value of the conn.
+	SetValue(v interface{})
+	// ProxyHeader returns the PROXY protocol header of the conn, or nil
+	// if Server.ProxyProtocol is not enabled.
+	ProxyHeader() *ProxyHeader
+}
@@ -0,0 +1,52 @@
+package netpoll
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Dialer dials the connections served by the workers of a Server, so that
+// a proxy can serve both sides of a connection by the same poll.
+//
+// The dialed conns are counted neither against the limits of the Server
+// nor in its accepted conns.
+type Dialer struct {
+	// Server serves the dialed conns. Its workers are started by the first
+	// dial if it is not serving yet.
+	Server *Server
+	// Handler optionally specifies the Handler of the dialed conns.
+	// If nil, Server.Handler is used.
+	Handler Handler
+	// Timeout is the maximum amount of time a dial waits for the connect
+	// to complete. If zero, there is no timeout other than the deadline
+	// of the context.
+	Timeout time.Duration
+}
+
+// Dial connects to the address on the named network.
+//
+// The network must be "tcp", "tcp4", "tcp6" or "unix". The data read from
+// the returned conn is served by the Handler, and the conn is closed when
+// the Handler returns an error.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context. The context only affects the connect.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	return d.dial(ctx, network, address)
+}
+
+func (d *Dialer) handler() Handler {
+	if d.Handler != nil {
+		return d.Handler
+	}
+	return d.Server.Handler
+}
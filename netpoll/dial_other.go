@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package netpoll
+
+import (
+	"context"
+	"net"
+)
+
+// dial serves the dialed conn by its own goroutine for consisted with other system.
+func (d *Dialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	handler := d.handler()
+	if handler == nil {
+		return nil, ErrHandler
+	}
+	if d.Server.shuttingDown() {
+		return nil, ErrServerClosed
+	}
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	go serveConn(handler, c)
+	return c, nil
+}
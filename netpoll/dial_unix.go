@@ -0,0 +1,165 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func (d *Dialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	s := d.Server
+	handler := d.handler()
+	if handler == nil {
+		return nil, ErrHandler
+	}
+	if s.shuttingDown() {
+		return nil, ErrServerClosed
+	}
+	family, sa, rAddr, err := resolveSockaddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: network, Addr: rAddr, Err: err}
+	}
+	if err = s.startWorkers(); err != nil {
+		return nil, opError(err)
+	}
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, opError(os.NewSyscallError("socket", err))
+	}
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, opError(os.NewSyscallError("setnonblock", err))
+	}
+	now := time.Now().UnixNano()
+	c := &conn{id: atomic.AddUint64(&connID, 1), fd: fd, rAddr: rAddr, handler: handler, dialed: true, readable: make(chan struct{}, 1), created: now, active: now}
+	switch err = syscall.Connect(fd, sa); err {
+	case nil:
+	case syscall.EINPROGRESS:
+		c.connecting = 1
+		c.connected = make(chan struct{})
+	default:
+		syscall.Close(fd)
+		return nil, opError(os.NewSyscallError("connect", err))
+	}
+	if lsa, err := syscall.Getsockname(fd); err == nil {
+		c.lAddr = sockaddrToAddr(network, lsa)
+	}
+	s.lock.Lock()
+	w := s.dialer.assignWorker(c)
+	c.w = w
+	w.Increase(c)
+	s.lock.Unlock()
+	if atomic.LoadInt32(&w.closed) != 0 {
+		// The worker was closed before it took the conn.
+		c.abort()
+		return nil, opError(ErrServerClosed)
+	}
+	s.wakeReschedule()
+	if c.connected != nil {
+		select {
+		case <-c.connected:
+		case <-ctx.Done():
+			if atomic.CompareAndSwapInt32(&c.connecting, 1, 0) {
+				c.abort()
+				if ctx.Err() == context.DeadlineExceeded {
+					return nil, opError(ErrDeadlineExceeded)
+				}
+				return nil, opError(ctx.Err())
+			}
+			<-c.connected
+		}
+		if atomic.LoadInt32(&c.closed) != 0 {
+			// The conn was closed with its worker while connecting.
+			if s.shuttingDown() {
+				return nil, opError(ErrServerClosed)
+			}
+			return nil, opError(os.NewSyscallError("connect", syscall.ECONNABORTED))
+		}
+		if errno, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR); err != nil || errno != 0 {
+			c.abort()
+			if err == nil {
+				err = syscall.Errno(errno)
+			}
+			return nil, opError(os.NewSyscallError("connect", err))
+		}
+	}
+	s.connState(c, StateNew, nil)
+	c.lock.Lock()
+	w = c.w
+	c.lock.Unlock()
+	go w.upgrade(c)
+	return c, nil
+}
+
+// abort removes the dialed conn c from its worker and closes it
+// before it is upgraded.
+func (c *conn) abort() {
+	atomic.StoreInt32(&c.closing, 1)
+	c.lock.Lock()
+	w := c.w
+	c.lock.Unlock()
+	w.Decrease(c)
+	c.Close()
+}
+
+// resolveSockaddr resolves the address on the named network to a socket address.
+func resolveSockaddr(network, address string) (family int, sa syscall.Sockaddr, addr net.Addr, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		tcpAddr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		ip := tcpAddr.IP
+		if len(ip) == 0 {
+			if network == "tcp6" {
+				ip = net.IPv6loopback
+			} else {
+				ip = net.IPv4(127, 0, 0, 1)
+			}
+			tcpAddr = &net.TCPAddr{IP: ip, Port: tcpAddr.Port}
+		}
+		if ip4 := ip.To4(); ip4 != nil && network != "tcp6" {
+			sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+			copy(sa4.Addr[:], ip4)
+			return syscall.AF_INET, sa4, tcpAddr, nil
+		}
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], ip.To16())
+		if tcpAddr.Zone != "" {
+			if ifi, err := net.InterfaceByName(tcpAddr.Zone); err == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+		return syscall.AF_INET6, sa6, tcpAddr, nil
+	case "unix":
+		return syscall.AF_UNIX, &syscall.SockaddrUnix{Name: address}, &net.UnixAddr{Net: network, Name: address}, nil
+	}
+	return 0, nil, nil, net.UnknownNetworkError(network)
+}
+
+func sockaddrToAddr(network string, sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: append([]byte{}, sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		return &net.TCPAddr{IP: append([]byte{}, sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Net: network, Name: sa.Name}
+	}
+	return nil
+}
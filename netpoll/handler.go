@@ -4,20 +4,36 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/php2go/netpollmux/internal/buffer"
+	"github.com/php2go/netpollmux/internal/scheduler"
 )
 
+const (
+	maxInFlight = 128
+	maxQueued   = 1024
+)
+
+// DefaultMaxFrameLength is the default MaxFrameLength of the FrameHandler.
+const DefaultMaxFrameLength = 4 << 20
+
 // ErrHandlerFunc is the error when the HandlerFunc is nil
 var ErrHandlerFunc = errors.New("HandlerFunc must be not nil")
 
 // ErrUpgradeFunc is the error when the Upgrade func is nil
 var ErrUpgradeFunc = errors.New("Upgrade function must be not nil")
 
+// ErrCodec is the error when the Codec is nil
+var ErrCodec = errors.New("Codec must be not nil")
+
 // ErrServeFunc is the error when the Serve func is nil
 
 var ErrServeFunc = errors.New("Serve function must be not nil")
 
+// ErrHandlerClosed is the error when the handler has been closed.
+var ErrHandlerClosed = errors.New("handler closed")
+
 // Context is returned by Upgrade for serving.
 type Context interface{}
 
@@ -29,6 +45,13 @@ type Handler interface {
 	Serve(Context) error
 }
 
+// BackpressureHandler is implemented by a Handler that wants to be notified
+// when the reads of a conn are paused because its pending writes reached
+// Server.WriteHighWatermark, and when they are resumed.
+type BackpressureHandler interface {
+	Backpressure(ctx Context, paused bool)
+}
+
 // NewHandler returns a new Handler.
 func NewHandler(upgrade func(net.Conn) (Context, error), serve func(Context) error) Handler {
 	return &ConnHandler{upgrade: upgrade, serve: serve}
@@ -86,15 +109,62 @@ type DataHandler struct {
 	upgrade    func(net.Conn) (net.Conn, error)
 	// HandlerFunc is the data Serve function.
 	HandlerFunc func(req []byte) (res []byte)
+	// AsyncHandlerFunc is the asynchronous data Serve function. If not nil,
+	// it is used instead of the HandlerFunc and every request is served by
+	// a worker of a bounded pool, so a slow request does not block the next
+	// requests of the conn. It must call reply once with the response, which
+	// is written whenever it is ready, so the responses may be out of order.
+	AsyncHandlerFunc func(req []byte, reply func(res []byte))
+	// Workers limits the number of the workers serving the AsyncHandlerFunc.
+	// Default Workers is runtime.NumCPU().
+	Workers int
+	// MaxInFlight limits the number of the requests of a conn being served
+	// by the AsyncHandlerFunc. When the limit is reached, a conn of the
+	// Server stops reading until a request is replied, while Serve blocks
+	// on other conns.
+	// Default MaxInFlight is 128.
+	MaxInFlight int
+	// MaxQueued limits the number of the requests of all the conns waiting
+	// for a worker of the AsyncHandlerFunc. When the limit is reached, the
+	// conns wait as for MaxInFlight.
+	// Default MaxQueued is 1024.
+	MaxQueued int
+	once      sync.Once
+	scheduler scheduler.Scheduler
+	lock      sync.Mutex
+	queue     chan struct{}
+	waiters   []readHolder
+	servers   int
+	closed    bool
 }
 
-type context struct {
-	reading sync.Mutex
-	writing sync.Mutex
-	upgrade bool
-	conn    net.Conn
-	pool    *buffer.Pool
-	buffer  []byte
+// readHolder is implemented by the conns of the Server, whose reads are
+// held instead of blocking a worker while the DataHandler is full.
+type readHolder interface {
+	holdReads()
+	releaseReads()
+	isClosed() bool
+}
+
+// serverHandler is implemented by the Handlers holding resources while
+// they are served, as the DataHandler with an AsyncHandlerFunc. The servers
+// hold it while serving, and release it on Close.
+type serverHandler interface {
+	holdServer()
+	releaseServer()
+}
+
+type dataContext struct {
+	reading  sync.Mutex
+	writing  sync.Mutex
+	upgrade  bool
+	conn     net.Conn
+	pool     *buffer.Pool
+	buffer   []byte
+	inFlight chan struct{}
+	holder   readHolder
+	// err is the first error of writing the asynchronous replies.
+	err error
 }
 
 // SetUpgrade sets the Upgrade function for upgrading the net.Conn.
@@ -104,12 +174,11 @@ func (h *DataHandler) SetUpgrade(upgrade func(net.Conn) (net.Conn, error)) {
 
 // Upgrade sets the net.Conn to a Context.
 func (h *DataHandler) Upgrade(conn net.Conn) (Context, error) {
-	if h.BufferSize < 1 {
-		h.BufferSize = bufferSize
-	}
-	if h.HandlerFunc == nil {
+	if h.HandlerFunc == nil && h.AsyncHandlerFunc == nil {
 		return nil, ErrHandlerFunc
 	}
+	h.once.Do(h.init)
+	holder, _ := conn.(readHolder)
 	var upgrade bool
 	if h.upgrade != nil {
 		c, err := h.upgrade(conn)
@@ -120,18 +189,90 @@ func (h *DataHandler) Upgrade(conn net.Conn) (Context, error) {
 			conn = c
 		}
 	}
-	var ctx = &context{upgrade: upgrade, conn: conn}
+	var ctx = &dataContext{upgrade: upgrade, conn: conn}
 	if h.NoShared {
 		ctx.buffer = make([]byte, h.BufferSize)
 	} else {
 		ctx.pool = buffer.AssignPool(h.BufferSize)
 	}
+	if h.AsyncHandlerFunc != nil {
+		h.lock.Lock()
+		closed := h.closed
+		h.lock.Unlock()
+		if closed {
+			return nil, ErrHandlerClosed
+		}
+		ctx.inFlight = make(chan struct{}, h.MaxInFlight)
+		ctx.holder = holder
+	}
 	return ctx, nil
 }
 
+// init sets the defaults once for all the conns, and starts the workers
+// of the AsyncHandlerFunc.
+func (h *DataHandler) init() {
+	if h.BufferSize < 1 {
+		h.BufferSize = bufferSize
+	}
+	if h.AsyncHandlerFunc == nil {
+		return
+	}
+	if h.MaxInFlight < 1 {
+		h.MaxInFlight = maxInFlight
+	}
+	if h.MaxQueued < 1 {
+		h.MaxQueued = maxQueued
+	}
+	h.queue = make(chan struct{}, h.MaxQueued)
+	h.lock.Lock()
+	if !h.closed {
+		h.scheduler = scheduler.NewScheduler(h.Workers, nil)
+	}
+	h.lock.Unlock()
+}
+
+// Close stops the workers of the AsyncHandlerFunc after the running requests
+// return. It is called when the last Server serving the DataHandler is closed.
+func (h *DataHandler) Close() error {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return nil
+	}
+	h.closed = true
+	s := h.scheduler
+	h.lock.Unlock()
+	if s != nil {
+		s.Close()
+	}
+	return nil
+}
+
+// holdServer counts a Server serving the DataHandler.
+func (h *DataHandler) holdServer() {
+	h.lock.Lock()
+	h.servers++
+	h.lock.Unlock()
+}
+
+// releaseServer closes the DataHandler when the last Server serving it
+// is closed.
+func (h *DataHandler) releaseServer() {
+	h.lock.Lock()
+	h.servers--
+	last := h.servers == 0
+	h.lock.Unlock()
+	if last {
+		h.Close()
+	}
+}
+
 // Serve should serve a single request with the Context ctx.
 func (h *DataHandler) Serve(ctx Context) error {
-	c := ctx.(*context)
+	c := ctx.(*dataContext)
+	if h.AsyncHandlerFunc != nil {
+		return h.serveAsync(c)
+	}
 	var conn = c.conn
 	var n int
 	var err error
@@ -173,3 +314,363 @@ func (h *DataHandler) Serve(ctx Context) error {
 	}
 	return err
 }
+
+// serveAsync reads a single request of the Context c and schedules it
+// to the AsyncHandlerFunc.
+func (h *DataHandler) serveAsync(c *dataContext) error {
+	c.writing.Lock()
+	err := c.err
+	c.writing.Unlock()
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	closed := h.closed
+	h.lock.Unlock()
+	if closed {
+		return ErrHandlerClosed
+	}
+	if !h.acquire(c) {
+		return EAGAIN
+	}
+	var conn = c.conn
+	var n int
+	var buf []byte
+	if h.NoShared {
+		buf = c.buffer
+	} else {
+		buf = c.pool.GetBuffer()
+	}
+	if c.upgrade {
+		c.reading.Lock()
+	}
+	n, err = conn.Read(buf)
+	if c.upgrade {
+		c.reading.Unlock()
+	}
+	if err != nil {
+		if !h.NoShared {
+			c.pool.PutBuffer(buf)
+		}
+		h.dequeue()
+		h.release(c)
+		return err
+	}
+	req := buf[:n]
+	// The buffer of NoShared is reused by the next read,
+	// while the pooled buffer is owned by the request until it is replied.
+	var owned = !h.NoShared && h.NoCopy
+	if !owned {
+		req = make([]byte, n)
+		copy(req, buf[:n])
+		if !h.NoShared {
+			c.pool.PutBuffer(buf)
+		}
+	}
+	var replied int32
+	reply := func(res []byte) {
+		if !atomic.CompareAndSwapInt32(&replied, 0, 1) {
+			return
+		}
+		c.writing.Lock()
+		if c.err == nil && c.holder != nil && c.holder.isClosed() {
+			c.err = ErrConnClosed
+		}
+		if len(res) > 0 && c.err == nil {
+			_, c.err = conn.Write(res)
+		}
+		c.writing.Unlock()
+		if owned {
+			c.pool.PutBuffer(buf)
+		}
+		h.release(c)
+	}
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		h.dequeue()
+		reply(nil)
+		return ErrHandlerClosed
+	}
+	h.scheduler.Schedule(func() {
+		h.dequeue()
+		h.AsyncHandlerFunc(req, reply)
+	})
+	h.lock.Unlock()
+	return nil
+}
+
+// acquire takes a slot of the conn c and a slot of the queue before reading
+// a request. A conn of the Server does not wait for them: its reads are held
+// until a slot frees, and acquire reports false.
+func (h *DataHandler) acquire(c *dataContext) bool {
+	if c.holder == nil {
+		c.inFlight <- struct{}{}
+		h.queue <- struct{}{}
+		return true
+	}
+	ok, full := h.tryAcquire(c)
+	if ok {
+		return true
+	}
+	c.holder.holdReads()
+	if full {
+		h.lock.Lock()
+		h.waiters = append(h.waiters, c.holder)
+		h.lock.Unlock()
+	}
+	// Retries in case a slot has been freed before the reads were held.
+	if ok, _ = h.tryAcquire(c); ok {
+		c.holder.releaseReads()
+	}
+	return ok
+}
+
+// tryAcquire takes the slots without waiting. If it fails, it reports
+// whether the queue was full.
+func (h *DataHandler) tryAcquire(c *dataContext) (ok bool, full bool) {
+	select {
+	case c.inFlight <- struct{}{}:
+	default:
+		return false, false
+	}
+	select {
+	case h.queue <- struct{}{}:
+	default:
+		<-c.inFlight
+		return false, true
+	}
+	return true, false
+}
+
+// release frees the slot of the conn c once its request is replied.
+func (h *DataHandler) release(c *dataContext) {
+	<-c.inFlight
+	if c.holder != nil {
+		c.holder.releaseReads()
+	}
+}
+
+// dequeue frees a slot of the queue once a request runs, and releases
+// the conns waiting for it.
+func (h *DataHandler) dequeue() {
+	<-h.queue
+	h.lock.Lock()
+	waiters := h.waiters
+	h.waiters = nil
+	h.lock.Unlock()
+	for _, holder := range waiters {
+		holder.releaseReads()
+	}
+}
+
+// FrameHandler implements the Handler interface. It splits the stream of a
+// conn into frames by the Codec and calls the HandlerFunc once per frame.
+type FrameHandler struct {
+	// Codec splits the stream into frames and frames the responses.
+	Codec Codec
+	// NoShared disables the FrameHandler to use the buffer pool for high performance.
+	// Default NoShared is false to use the buffer pool for low memory usage.
+	NoShared bool
+	// NoCopy passes the frames underlying buffer to the HandlerFunc when NoCopy is true,
+	// The bytes passed are reused by later frames, so do not retain them.
+	// Default NoCopy is false to make a copy of every frame.
+	NoCopy bool
+	// BufferSize represents the read buffer size.
+	BufferSize int
+	// MaxFrameLength limits the bytes of an incomplete frame buffered until
+	// it is complete, whatever the limits of the Codec are. The conn is
+	// closed with ErrFrameTooLarge beyond it. If zero, DefaultMaxFrameLength
+	// is used.
+	MaxFrameLength int
+	upgrade        func(net.Conn) (net.Conn, error)
+	// HandlerFunc is the frame Serve function. A nil res writes no response.
+	// A res too large for the Codec closes the conn with ErrFrameTooLarge.
+	HandlerFunc func(req []byte) (res []byte)
+}
+
+type frameContext struct {
+	reading sync.Mutex
+	writing sync.Mutex
+	upgrade bool
+	conn    net.Conn
+	pool    *buffer.Pool
+	buffer  []byte
+	// pending accumulates the bytes of the incomplete frame.
+	pending []byte
+	output  []byte
+}
+
+// SetUpgrade sets the Upgrade function for upgrading the net.Conn.
+func (h *FrameHandler) SetUpgrade(upgrade func(net.Conn) (net.Conn, error)) {
+	h.upgrade = upgrade
+}
+
+// Upgrade sets the net.Conn to a Context.
+func (h *FrameHandler) Upgrade(conn net.Conn) (Context, error) {
+	if h.BufferSize < 1 {
+		h.BufferSize = bufferSize
+	}
+	if h.HandlerFunc == nil {
+		return nil, ErrHandlerFunc
+	}
+	if h.Codec == nil {
+		return nil, ErrCodec
+	}
+	if err := validateCodec(h.Codec); err != nil {
+		return nil, err
+	}
+	var upgrade bool
+	if h.upgrade != nil {
+		c, err := h.upgrade(conn)
+		if err != nil {
+			return nil, err
+		} else if c != nil && c != conn {
+			upgrade = true
+			conn = c
+		}
+	}
+	var ctx = &frameContext{upgrade: upgrade, conn: conn}
+	if h.NoShared {
+		ctx.buffer = make([]byte, h.BufferSize)
+	} else {
+		ctx.pool = buffer.AssignPool(h.BufferSize)
+	}
+	return ctx, nil
+}
+
+// Serve should serve the complete frames of a single read with the Context ctx.
+func (h *FrameHandler) Serve(ctx Context) error {
+	c := ctx.(*frameContext)
+	var conn = c.conn
+	var buf []byte
+	if h.NoShared {
+		buf = c.buffer
+	} else {
+		buf = c.pool.GetBuffer()
+	}
+	if c.upgrade {
+		c.reading.Lock()
+	}
+	n, err := conn.Read(buf)
+	if c.upgrade {
+		c.reading.Unlock()
+	}
+	if err != nil {
+		if err == EAGAIN {
+			// Keeps the pending bytes until the conn is readable again.
+			if !h.NoShared {
+				c.pool.PutBuffer(buf)
+			}
+			return err
+		}
+		h.free(c, buf)
+		return err
+	}
+	var data = buf[:n]
+	if len(c.pending) > 0 {
+		c.pending = growBuffer(c.pending, n)
+		c.pending = append(c.pending, data...)
+		data = c.pending
+	}
+	var output []byte
+	if h.NoShared {
+		output = c.output[:0]
+	} else {
+		output = buffer.GetBuffer(h.BufferSize)[:0]
+	}
+	var outputCap = cap(output)
+	for len(data) > 0 {
+		var payload []byte
+		if payload, n, err = h.Codec.Decode(data); err != nil || n == 0 {
+			break
+		}
+		req := payload
+		if !h.NoCopy {
+			req = make([]byte, len(payload))
+			copy(req, payload)
+		}
+		if res := h.HandlerFunc(req); res != nil {
+			// Closes the conn instead of panicking in Encode.
+			if err = checkEncode(h.Codec, res); err != nil {
+				break
+			}
+			output = h.Codec.Encode(output, res)
+		}
+		data = data[n:]
+	}
+	if err != nil || len(data) > h.maxFrameLength() {
+		h.free(c, buf)
+		if !h.NoShared && cap(output) == outputCap {
+			buffer.PutBuffer(output)
+		}
+		if err == nil {
+			err = ErrFrameTooLarge
+		}
+		return err
+	} else if len(data) > 0 {
+		// Keeps the incomplete frame for the next read.
+		if len(c.pending) > 0 {
+			c.pending = c.pending[:copy(c.pending, data)]
+		} else {
+			c.pending = append(growBuffer(c.pending, len(data)), data...)
+		}
+	} else if c.pending != nil {
+		c.pending = c.pending[:0]
+		if !h.NoShared {
+			buffer.PutBuffer(c.pending)
+			c.pending = nil
+		}
+	}
+	if !h.NoShared {
+		c.pool.PutBuffer(buf)
+	}
+	if len(output) > 0 {
+		if c.upgrade {
+			c.writing.Lock()
+		}
+		_, err = conn.Write(output)
+		if c.upgrade {
+			c.writing.Unlock()
+		}
+	}
+	if h.NoShared {
+		c.output = output
+	} else if cap(output) == outputCap {
+		// Frees the output unless the Encode has grown it.
+		buffer.PutBuffer(output)
+	}
+	return err
+}
+
+func (h *FrameHandler) maxFrameLength() int {
+	if h.MaxFrameLength > 0 {
+		return h.MaxFrameLength
+	}
+	return DefaultMaxFrameLength
+}
+
+// free frees the read buffer buf and the pending bytes of the Context c.
+func (h *FrameHandler) free(c *frameContext, buf []byte) {
+	if !h.NoShared {
+		c.pool.PutBuffer(buf)
+	}
+	if c.pending != nil {
+		buffer.PutBuffer(c.pending)
+		c.pending = nil
+	}
+}
+
+// growBuffer grows the pooled buf to guarantee space for n more bytes.
+func growBuffer(buf []byte, n int) []byte {
+	if cap(buf)-len(buf) >= n {
+		return buf
+	}
+	size := 2*cap(buf) + n
+	b := buffer.GetBuffer(size)[:len(buf)]
+	copy(b, buf)
+	if buf != nil {
+		buffer.PutBuffer(buf)
+	}
+	return b
+}
@@ -3,7 +3,9 @@ package netpoll
 import (
 	"errors"
 	"github.com/php2go/netpollmux/internal/buffer"
+	"io"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -102,3 +104,318 @@ func TestDataHandler(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFrameHandler(t *testing.T) {
+	for _, noShared := range []bool{false, true} {
+		var handler = &FrameHandler{NoShared: noShared, BufferSize: 8}
+		if _, err := handler.Upgrade(&conn{}); err != ErrHandlerFunc {
+			t.Error(err)
+		}
+		handler.HandlerFunc = func(req []byte) (res []byte) {
+			return req
+		}
+		if _, err := handler.Upgrade(&conn{}); err != ErrCodec {
+			t.Error(err)
+		}
+		handler.Codec = &LengthCodec{Size: 2}
+		server, client := net.Pipe()
+		ctx, err := handler.Upgrade(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for handler.Serve(ctx) == nil {
+			}
+		}()
+		var data []byte
+		data = handler.Codec.Encode(data, []byte("hello"))
+		data = handler.Codec.Encode(data, []byte("hello world"))
+		data = handler.Codec.Encode(data, []byte("!"))
+		// Splits the frames across the reads.
+		go func() {
+			for i := 0; i < len(data); i += 3 {
+				end := i + 3
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := client.Write(data[i:end]); err != nil {
+					return
+				}
+			}
+		}()
+		buf := make([]byte, len(data))
+		for n := 0; n < len(buf); {
+			m, err := client.Read(buf[n:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += m
+		}
+		if string(buf) != string(data) {
+			t.Errorf("%q", buf)
+		}
+		client.Close()
+		<-done
+		server.Close()
+	}
+}
+
+func TestFrameHandlerError(t *testing.T) {
+	var handler = &FrameHandler{
+		Codec: &LengthCodec{Size: 1, MaxLength: 4},
+		HandlerFunc: func(req []byte) (res []byte) {
+			return req
+		},
+	}
+	server, client := net.Pipe()
+	ctx, err := handler.Upgrade(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write(handler.Codec.Encode(nil, []byte("hello")))
+	if err := handler.Serve(ctx); err != ErrFrameTooLarge {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestFrameHandlerLargeResponse(t *testing.T) {
+	var handler = &FrameHandler{
+		Codec: &LengthCodec{Size: 1},
+		HandlerFunc: func(req []byte) (res []byte) {
+			return make([]byte, 300)
+		},
+	}
+	server, client := net.Pipe()
+	ctx, err := handler.Upgrade(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write(handler.Codec.Encode(nil, []byte("hello")))
+	if err := handler.Serve(ctx); err != ErrFrameTooLarge {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestFrameHandlerCodec(t *testing.T) {
+	var codecs = []struct {
+		codec Codec
+		err   error
+	}{
+		{&LengthCodec{Size: 3}, ErrLengthSize},
+		{&DelimiterCodec{}, ErrDelimiter},
+		{&FixedCodec{}, ErrFixedSize},
+	}
+	for _, c := range codecs {
+		var handler = &FrameHandler{
+			Codec: c.codec,
+			HandlerFunc: func(req []byte) (res []byte) {
+				return req
+			},
+		}
+		if _, err := handler.Upgrade(&conn{}); err != c.err {
+			t.Errorf("%T %v", c.codec, err)
+		}
+	}
+}
+
+func TestFrameHandlerMaxFrameLength(t *testing.T) {
+	var handler = &FrameHandler{
+		Codec:          &DelimiterCodec{Delimiter: []byte("\n")},
+		MaxFrameLength: 4,
+		HandlerFunc: func(req []byte) (res []byte) {
+			return req
+		},
+	}
+	server, client := net.Pipe()
+	ctx, err := handler.Upgrade(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("hello"))
+	if err := handler.Serve(ctx); err != ErrFrameTooLarge {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestDataHandlerAsync(t *testing.T) {
+	for _, noCopy := range []bool{false, true} {
+		var handler = &DataHandler{
+			NoCopy:  noCopy,
+			Workers: 2,
+			AsyncHandlerFunc: func(req []byte, reply func(res []byte)) {
+				// Replies the slow request after the fast one.
+				if string(req) == "slow" {
+					time.Sleep(time.Millisecond * 100)
+				}
+				reply(req)
+				reply(req)
+			},
+		}
+		server, client := net.Pipe()
+		ctx, err := handler.Upgrade(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for handler.Serve(ctx) == nil {
+			}
+		}()
+		client.Write([]byte("slow"))
+		client.Write([]byte("fast"))
+		var res []string
+		for i := 0; i < 2; i++ {
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(client, buf); err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, string(buf))
+		}
+		if res[0] != "fast" || res[1] != "slow" {
+			t.Error(res)
+		}
+		client.Close()
+		<-done
+		server.Close()
+	}
+}
+
+func TestDataHandlerMaxInFlight(t *testing.T) {
+	var replies = make(chan func(res []byte), 2)
+	var handler = &DataHandler{
+		MaxInFlight: 1,
+		AsyncHandlerFunc: func(req []byte, reply func(res []byte)) {
+			replies <- reply
+		},
+	}
+	server, client := net.Pipe()
+	ctx, err := handler.Upgrade(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("first"))
+	if err := handler.Serve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- handler.Serve(ctx)
+	}()
+	go client.Write([]byte("second"))
+	reply := <-replies
+	select {
+	case <-served:
+		t.Error("not blocked by MaxInFlight")
+	case <-time.After(time.Millisecond * 50):
+	}
+	go reply(nil)
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+	(<-replies)(nil)
+	client.Close()
+	server.Close()
+}
+
+type heldConn struct {
+	net.Conn
+	held   chan bool
+	closed int32
+}
+
+func (c *heldConn) holdReads()     { c.held <- true }
+func (c *heldConn) releaseReads()  { c.held <- false }
+func (c *heldConn) isClosed() bool { return atomic.LoadInt32(&c.closed) != 0 }
+
+func TestDataHandlerMaxQueued(t *testing.T) {
+	var running = make(chan struct{})
+	var unblock = make(chan struct{})
+	var handler = &DataHandler{
+		Workers:   1,
+		MaxQueued: 1,
+		AsyncHandlerFunc: func(req []byte, reply func(res []byte)) {
+			if string(req) == "block" {
+				close(running)
+				<-unblock
+			}
+			reply(nil)
+		},
+	}
+	server, client := net.Pipe()
+	conn := &heldConn{Conn: server, held: make(chan bool, 4)}
+	ctx, err := handler.Upgrade(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("block"))
+	if err := handler.Serve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-running
+	go client.Write([]byte("queued"))
+	if err := handler.Serve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The queue is full, so the reads are held instead of blocking.
+	if err := handler.Serve(ctx); err != EAGAIN {
+		t.Error(err)
+	}
+	if held := <-conn.held; !held {
+		t.Error("not held")
+	}
+	close(unblock)
+	if held := <-conn.held; held {
+		t.Error("not released")
+	}
+	handler.Close()
+	if err := handler.Serve(ctx); err != ErrHandlerClosed {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestDataHandlerReplyClosed(t *testing.T) {
+	var replies = make(chan func(res []byte), 1)
+	var handler = &DataHandler{
+		AsyncHandlerFunc: func(req []byte, reply func(res []byte)) {
+			replies <- reply
+		},
+	}
+	defer handler.Close()
+	server, client := net.Pipe()
+	conn := &heldConn{Conn: server, held: make(chan bool, 4)}
+	ctx, err := handler.Upgrade(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("req"))
+	if err := handler.Serve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan int, 1)
+	go func() {
+		n, _ := client.Read(make([]byte, 64))
+		read <- n
+	}()
+	atomic.StoreInt32(&conn.closed, 1)
+	// The reply is not written after the conn is closed.
+	(<-replies)([]byte("res"))
+	if err := handler.Serve(ctx); err != ErrConnClosed {
+		t.Error(err)
+	}
+	client.Close()
+	if n := <-read; n != 0 {
+		t.Error(n)
+	}
+	server.Close()
+}
@@ -0,0 +1,148 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package netpoll
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// mmsg reads and writes the datagrams in batches by recvmmsg and sendmmsg.
+type mmsg struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+func newMmsg(n int) *mmsg {
+	return &mmsg{
+		hdrs:  make([]mmsghdr, n),
+		iovs:  make([]syscall.Iovec, n),
+		names: make([]syscall.RawSockaddrAny, n),
+	}
+}
+
+func (m *mmsg) prepare(i int, b []byte) {
+	m.iovs[i] = syscall.Iovec{}
+	if len(b) > 0 {
+		m.iovs[i].Base = &b[0]
+		m.iovs[i].SetLen(len(b))
+	}
+	m.hdrs[i] = mmsghdr{}
+	m.hdrs[i].hdr.Iov = &m.iovs[i]
+	m.hdrs[i].hdr.Iovlen = 1
+	m.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&m.names[i]))
+}
+
+func (m *mmsg) recv(fd int, msgs []packetMsg) (int, error) {
+	for i := range msgs {
+		m.prepare(i, msgs[i].buf)
+		m.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+	}
+	r, _, e := syscall.Syscall6(sysRecvmmsg, uintptr(fd), uintptr(unsafe.Pointer(&m.hdrs[0])), uintptr(len(msgs)), 0, 0, 0)
+	if e != 0 {
+		return 0, e
+	}
+	n := int(r)
+	for i := 0; i < n; i++ {
+		msgs[i].n = int(m.hdrs[i].len)
+		msgs[i].addr = rawToSockaddr(&m.names[i], m.hdrs[i].hdr.Namelen)
+	}
+	return n, nil
+}
+
+func (m *mmsg) send(fd int, msgs []packetMsg) (int, error) {
+	for i := range msgs {
+		m.prepare(i, msgs[i].buf[:msgs[i].n])
+		m.hdrs[i].hdr.Namelen = sockaddrToRaw(msgs[i].addr, &m.names[i])
+	}
+	r, _, e := syscall.Syscall6(sysSendmmsg, uintptr(fd), uintptr(unsafe.Pointer(&m.hdrs[0])), uintptr(len(msgs)), 0, 0, 0)
+	if e != 0 {
+		return 0, e
+	}
+	return int(r), nil
+}
+
+func rawToSockaddr(rsa *syscall.RawSockaddrAny, namelen uint32) syscall.Sockaddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &syscall.SockaddrInet4{Port: int(p[0])<<8 + int(p[1]), Addr: pp.Addr}
+	case syscall.AF_INET6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &syscall.SockaddrInet6{Port: int(p[0])<<8 + int(p[1]), ZoneId: pp.Scope_id, Addr: pp.Addr}
+	case syscall.AF_UNIX:
+		pp := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		n := int(namelen) - 2
+		if n > len(pp.Path) {
+			n = len(pp.Path)
+		}
+		if n <= 0 {
+			return &syscall.SockaddrUnix{}
+		}
+		path := make([]byte, 0, n)
+		for i := 0; i < n; i++ {
+			if pp.Path[i] == 0 && i > 0 {
+				break
+			}
+			path = append(path, byte(pp.Path[i]))
+		}
+		if path[0] == 0 {
+			// An abstract address.
+			path[0] = '@'
+		}
+		return &syscall.SockaddrUnix{Name: string(path)}
+	}
+	return nil
+}
+
+func sockaddrToRaw(sa syscall.Sockaddr, rsa *syscall.RawSockaddrAny) uint32 {
+	*rsa = syscall.RawSockaddrAny{}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		pp.Family = syscall.AF_INET
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		p[0], p[1] = byte(sa.Port>>8), byte(sa.Port)
+		pp.Addr = sa.Addr
+		return syscall.SizeofSockaddrInet4
+	case *syscall.SockaddrInet6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		pp.Family = syscall.AF_INET6
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		p[0], p[1] = byte(sa.Port>>8), byte(sa.Port)
+		pp.Scope_id = sa.ZoneId
+		pp.Addr = sa.Addr
+		return syscall.SizeofSockaddrInet6
+	case *syscall.SockaddrUnix:
+		pp := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		pp.Family = syscall.AF_UNIX
+		n := len(sa.Name)
+		if n >= len(pp.Path) {
+			n = len(pp.Path) - 1
+		}
+		for i := 0; i < n; i++ {
+			pp.Path[i] = int8(sa.Name[i])
+		}
+		sl := uint32(2)
+		if n > 0 {
+			sl += uint32(n) + 1
+		}
+		if pp.Path[0] == '@' {
+			pp.Path[0] = 0
+			sl--
+		}
+		return sl
+	}
+	return 0
+}
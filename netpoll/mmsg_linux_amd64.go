@@ -0,0 +1,6 @@
+package netpoll
+
+const (
+	sysRecvmmsg = 299
+	sysSendmmsg = 307
+)
@@ -0,0 +1,6 @@
+package netpoll
+
+const (
+	sysRecvmmsg = 243
+	sysSendmmsg = 269
+)
@@ -0,0 +1,44 @@
+//go:build (linux && !amd64 && !arm64) || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux,!amd64,!arm64 darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"syscall"
+)
+
+// mmsg reads and writes the datagrams one by one where recvmmsg
+// and sendmmsg are not supported.
+type mmsg struct{}
+
+func newMmsg(n int) *mmsg {
+	return &mmsg{}
+}
+
+func (m *mmsg) recv(fd int, msgs []packetMsg) (n int, err error) {
+	for n < len(msgs) {
+		var from syscall.Sockaddr
+		if msgs[n].n, from, err = syscall.Recvfrom(fd, msgs[n].buf, 0); err != nil {
+			break
+		}
+		msgs[n].addr = from
+		n++
+	}
+	if n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (m *mmsg) send(fd int, msgs []packetMsg) (n int, err error) {
+	for n < len(msgs) {
+		if err = syscall.Sendto(fd, msgs[n].buf[:msgs[n].n], 0, msgs[n].addr); err != nil {
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		err = nil
+	}
+	return
+}
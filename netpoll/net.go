@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"os"
 	"syscall"
 )
 
@@ -17,6 +18,37 @@ var EOF = io.EOF
 // EAGAIN is the error when resource temporarily unavailable
 var EAGAIN = syscall.EAGAIN
 
+// ErrDeadlineExceeded is returned by Read and Write when the deadline set by
+// SetDeadline, SetReadDeadline or SetWriteDeadline has passed.
+// It is os.ErrDeadlineExceeded and reports true from its Timeout method.
+var ErrDeadlineExceeded = os.ErrDeadlineExceeded
+
+// ErrIdleTimeout is the error passed to Server.OnEvict when a conn
+// has been idle longer than Server.IdleTimeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrReadHeaderTimeout is the error passed to Server.OnEvict when a conn
+// has not been served within Server.ReadHeaderTimeout.
+var ErrReadHeaderTimeout = errors.New("read header timeout")
+
+// ErrTooManyConns is the error passed to Server.ConnState when
+// a conn is rejected by Server.MaxConns.
+var ErrTooManyConns = errors.New("too many conns")
+
+// ErrTooManyConnsPerIP is the error passed to Server.ConnState when
+// a conn is rejected by Server.MaxConnsPerIP.
+var ErrTooManyConnsPerIP = errors.New("too many conns per IP")
+
+// ErrPollMode is the error returned by SetMode when the PollMode is unknown.
+var ErrPollMode = errors.New("unknown PollMode")
+
+// ErrPendingBytes is the error returned by Write when the pending bytes
+// of a conn exceed Server.MaxPendingBytes.
+var ErrPendingBytes = errors.New("pending bytes exceed MaxPendingBytes")
+
+// ErrConnClosed is the error when writing to a closed conn.
+var ErrConnClosed = errors.New("use of closed conn")
+
 // ErrServerClosed is returned by the Server's Serve and ListenAndServe
 // methods after a call to Close.
 var ErrServerClosed = errors.New("Server closed")
@@ -27,6 +59,13 @@ var ErrHandler = errors.New("Handler must be not nil")
 // ErrListener is the error when the Listener is nil
 var ErrListener = errors.New("Listener must be not nil")
 
+// ErrPanic is the error passed to Server.ConnState when a conn is closed
+// because its Handler panicked and Server.RecoverPanic recovered it.
+var ErrPanic = errors.New("Handler panicked")
+
+// ErrNotSupported is the error when the operation is not supported by the system.
+var ErrNotSupported = errors.New("not supported")
+
 // ListenAndServe listens on the network address and then calls
 // Serve with handler to handle requests on incoming connections.
 //
@@ -53,9 +92,11 @@ func Serve(lis net.Listener, handler Handler) error {
 type netServer struct {
 	listener net.Listener
 	Handler  Handler
+	handler  serverHandler
 }
 
 func (s *netServer) Serve(l net.Listener) (err error) {
+	s.handler = holdHandler(s.Handler)
 	s.listener = l
 	for {
 		var conn net.Conn
@@ -63,22 +104,38 @@ func (s *netServer) Serve(l net.Listener) (err error) {
 		if err != nil {
 			break
 		}
-		go func(c net.Conn) {
-			var err error
-			var context Context
-			if context, err = s.Handler.Upgrade(c); err != nil {
-				c.Close()
-				return
-			}
-			for err == nil {
-				err = s.Handler.Serve(context)
-			}
-			c.Close()
-		}(conn)
+		go serveConn(s.Handler, conn)
 	}
 	return
 }
 
+// serveConn upgrades the conn c by the handler and serves it until an error.
+func serveConn(handler Handler, c net.Conn) {
+	var err error
+	var context Context
+	if context, err = handler.Upgrade(c); err != nil {
+		c.Close()
+		return
+	}
+	for err == nil {
+		err = handler.Serve(context)
+	}
+	c.Close()
+}
+
 func (s *netServer) Close() error {
-	return s.listener.Close()
+	err := s.listener.Close()
+	if s.handler != nil {
+		s.handler.releaseServer()
+	}
+	return err
+}
+
+// holdHandler counts a server serving the Handler h if h is a serverHandler.
+func holdHandler(h Handler) serverHandler {
+	if handler, ok := h.(serverHandler); ok {
+		handler.holdServer()
+		return handler
+	}
+	return nil
 }
@@ -4,8 +4,11 @@
 package netpoll
 
 import (
+	"context"
 	"net"
+	"os"
 	"sync/atomic"
+	"time"
 )
 
 // Server defines parameters for running a server.
@@ -22,8 +25,64 @@ type Server struct {
 	SharedWorkers int
 	// TasksPerWorker do not work for consisted with other system.
 	TasksPerWorker int
-	netServer      *netServer
-	closed         int32
+	// IdleTimeout do not work for consisted with other system.
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout do not work for consisted with other system.
+	ReadHeaderTimeout time.Duration
+	// OnEvict do not work for consisted with other system.
+	OnEvict func(c net.Conn, err error)
+	// ConnState do not work for consisted with other system.
+	ConnState func(c net.Conn, state ConnState, err error)
+	// MaxConns do not work for consisted with other system.
+	MaxConns int
+	// MaxConnsPerIP do not work for consisted with other system.
+	MaxConnsPerIP int
+	// PauseOnLimit do not work for consisted with other system.
+	PauseOnLimit bool
+	// RejectPayload do not work for consisted with other system.
+	RejectPayload []byte
+	// ReusePort do not work for consisted with other system.
+	ReusePort int
+	// PinWorkers do not work for consisted with other system.
+	PinWorkers bool
+	// PollMode do not work for consisted with other system.
+	PollMode PollMode
+	// WriteHighWatermark do not work for consisted with other system.
+	WriteHighWatermark int
+	// WriteLowWatermark do not work for consisted with other system.
+	WriteLowWatermark int
+	// MaxPendingBytes do not work for consisted with other system.
+	MaxPendingBytes int
+	// Backend do not work for consisted with other system.
+	Backend Backend
+	// Balancer do not work for consisted with other system.
+	Balancer Balancer
+	// Rescheduler do not work for consisted with other system.
+	Rescheduler Rescheduler
+	// CPUAffinity do not work for consisted with other system.
+	CPUAffinity bool
+	// CPUs do not work for consisted with other system.
+	CPUs []int
+	// SteerIncomingCPU do not work for consisted with other system.
+	SteerIncomingCPU bool
+	// RestartSignal do not work for consisted with other system.
+	RestartSignal os.Signal
+	// RestartTimeout do not work for consisted with other system.
+	RestartTimeout time.Duration
+	// RecoverPanic do not work for consisted with other system.
+	RecoverPanic bool
+	// PanicHandler do not work for consisted with other system.
+	PanicHandler func(c net.Conn, v interface{}, stack []byte)
+	// StrictPanic do not work for consisted with other system.
+	StrictPanic bool
+	// SocketOptions do not work for consisted with other system.
+	SocketOptions *SocketOptions
+	// ProxyProtocol do not work for consisted with other system.
+	ProxyProtocol bool
+	// ProxyHeaderTimeout do not work for consisted with other system.
+	ProxyHeaderTimeout time.Duration
+	netServer          *netServer
+	closed             int32
 }
 
 // ListenAndServe listens on the network address and then calls
@@ -35,7 +94,7 @@ func (s *Server) ListenAndServe() error {
 	if atomic.LoadInt32(&s.closed) != 0 {
 		return ErrServerClosed
 	}
-	ln, err := net.Listen(s.Network, s.Address)
+	ln, err := Listen(s.Network, s.Address)
 	if err != nil {
 		return err
 	}
@@ -69,3 +128,76 @@ func (s *Server) Close() error {
 	}
 	return s.netServer.Close()
 }
+
+// Shutdown closes the listener. The conns are served by their own
+// goroutines and are not tracked, so Shutdown does not wait for them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.Close()
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.closed) != 0
+}
+
+// NumConns returns zero for consisted with other system.
+func (s *Server) NumConns() int {
+	return 0
+}
+
+// NumConnsPerIP returns zero for consisted with other system.
+func (s *Server) NumConnsPerIP(ip string) int {
+	return 0
+}
+
+// Stats returns the zero Stats for consisted with other system.
+func (s *Server) Stats() Stats {
+	return Stats{}
+}
+
+// Files returns ErrNotSupported for consisted with other system.
+func (s *Server) Files() ([]*os.File, error) {
+	return nil, ErrNotSupported
+}
+
+// StartProcess returns ErrNotSupported for consisted with other system.
+func (s *Server) StartProcess() (*os.Process, error) {
+	return nil, ErrNotSupported
+}
+
+// Restart returns ErrNotSupported for consisted with other system.
+func (s *Server) Restart(ctx context.Context) error {
+	return ErrNotSupported
+}
+
+// Conn returns false for consisted with other system.
+func (s *Server) Conn(id uint64) (net.Conn, bool) {
+	return nil, false
+}
+
+// RangeConns does nothing for consisted with other system.
+func (s *Server) RangeConns(f func(c net.Conn) bool) {
+}
+
+// Push returns ErrNotSupported for consisted with other system.
+func (s *Server) Push(id uint64, b []byte) error {
+	return ErrNotSupported
+}
+
+// Broadcast returns zero for consisted with other system.
+func (s *Server) Broadcast(b []byte) int {
+	return 0
+}
+
+// Subscribe returns ErrNotSupported for consisted with other system.
+func (s *Server) Subscribe(id uint64, topic string) error {
+	return ErrNotSupported
+}
+
+// Unsubscribe does nothing for consisted with other system.
+func (s *Server) Unsubscribe(id uint64, topic string) {
+}
+
+// Publish returns zero for consisted with other system.
+func (s *Server) Publish(topic string, b []byte) int {
+	return 0
+}
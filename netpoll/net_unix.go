@@ -4,27 +4,39 @@
 package netpoll
 
 import (
-	"errors"
+	"context"
 	"github.com/php2go/netpollmux/internal/buffer"
 	"io"
 	"net"
 	"os"
 	"runtime"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/php2go/netpollmux/internal/logger"
 	"github.com/php2go/netpollmux/internal/sendfile"
 	"github.com/php2go/netpollmux/internal/splice"
 )
 
 const (
-	idleTime = time.Second
+	idleTime             = time.Second
+	shutdownPollInterval = time.Millisecond * 50
+	proxyHeaderTimeout   = time.Second * 5
+	restartTimeout       = time.Second * 30
+	// acceptOps is the number of the accepts submitted at once by a
+	// listener polled by IOURingBackend.
+	acceptOps = 16
 )
 
 var numCPU = runtime.NumCPU()
 
+// connID is the ID of the last conn.
+var connID uint64
+
 // Server defines parameters for running a server.
 type Server struct {
 	Network string
@@ -36,15 +48,121 @@ type Server struct {
 	UnsharedWorkers int
 	SharedWorkers   int
 	TasksPerWorker  int
+	// IdleTimeout is the maximum amount of time a conn may be idle
+	// before it is closed. If zero, conns never time out.
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout is the amount of time allowed for a new conn to be
+	// upgraded and to be served its first request. If zero, there is no timeout.
+	ReadHeaderTimeout time.Duration
+	// OnEvict optionally specifies a function that is called when a conn is
+	// closed by IdleTimeout or ReadHeaderTimeout.
+	OnEvict func(c net.Conn, err error)
+	// ConnState optionally specifies a function that is called when
+	// a conn changes state. The err is the reason of StateClosed and
+	// StateRejected, and nil otherwise. It must not block.
+	ConnState func(c net.Conn, state ConnState, err error)
+	// MaxConns limits the number of conns. If zero, there is no limit.
+	MaxConns int
+	// MaxConnsPerIP limits the number of conns from a remote IP.
+	// If zero, there is no limit.
+	MaxConnsPerIP int
+	// PauseOnLimit pauses accepting until a conn is closed when MaxConns
+	// is reached, instead of closing the new conns. The conns exceeding
+	// MaxConnsPerIP are always closed.
+	PauseOnLimit bool
+	// RejectPayload optionally specifies the data written to a conn
+	// before it is closed by the limits.
+	RejectPayload []byte
+	// ReusePort is the number of SO_REUSEPORT listeners opened by
+	// ListenAndServe on a TCP address, each with its own accept poll.
+	// If less than 2, ListenAndServe opens a single listener.
+	ReusePort int
+	// PinWorkers assigns a subset of the workers to every listener,
+	// so that a conn is served by a worker of the listener accepting it.
+	PinWorkers bool
+	// PollMode is the trigger mode of the worker polls.
+	// OneShot makes sure that an event of a conn is not served
+	// by several async tasks at once.
+	PollMode PollMode
+	// WriteHighWatermark is the number of pending bytes of a conn at which
+	// its reads are paused until the pending bytes drop to WriteLowWatermark.
+	// The Handler is notified if it implements BackpressureHandler.
+	// If zero, the reads are never paused.
+	WriteHighWatermark int
+	// WriteLowWatermark is the number of pending bytes of a conn at which
+	// its paused reads are resumed. If zero, it is half of WriteHighWatermark.
+	WriteLowWatermark int
+	// MaxPendingBytes limits the pending bytes of a conn. The conn is closed
+	// when a Write exceeds it. If zero, there is no limit.
+	MaxPendingBytes int
+	// Backend is the kernel interface polling the readiness of the listener
+	// and worker fds. IOURingBackend falls back to DefaultBackend when the
+	// kernel lacks support for io_uring.
+	Backend Backend
+	// Balancer optionally assigns the new conns to the workers. If nil, a
+	// conn is assigned to the first idle unshared worker, or else to the
+	// least connected shared worker. The conns are balanced when accepted,
+	// before a PROXY protocol header is read. The built-in balancers assign
+	// the conns to the unshared workers as well as to the shared ones, and
+	// the conns are not rescheduled when a Balancer is set.
+	Balancer Balancer
+	// Rescheduler optionally specifies the policy to move the conns between
+	// the unshared and the shared workers. If nil, a DefaultRescheduler is used.
+	Rescheduler Rescheduler
+	// CPUAffinity runs the poll loop of every worker on a locked OS thread
+	// pinned to a CPU. The workers are distributed across the NUMA nodes
+	// in turn. It is only supported on Linux.
+	CPUAffinity bool
+	// CPUs optionally specifies the CPU set of CPUAffinity. If empty, the
+	// CPUs the process is allowed to run on are used.
+	CPUs []int
+	// SteerIncomingCPU assigns a new conn to the worker on the CPU that
+	// handled its packets, or else to a worker on the same NUMA node,
+	// by SO_INCOMING_CPU. It requires CPUAffinity.
+	SteerIncomingCPU bool
+	// RestartSignal optionally specifies a signal on which the server
+	// restarts by Restart, such as syscall.SIGUSR2.
+	RestartSignal os.Signal
+	// RestartTimeout is the amount of time allowed for the conns to drain
+	// when the server restarts on RestartSignal, after which it is closed.
+	// If zero, it is 30 seconds. If negative, there is no timeout.
+	RestartTimeout time.Duration
+	// RecoverPanic recovers the panics of the Handler, so that only the conn
+	// being served is closed with ErrPanic instead of the process crashing.
+	// The panic is logged with its stack and counted in Stats.
+	RecoverPanic bool
+	// PanicHandler optionally specifies a function that is called with the
+	// conn, the panic value and the stack when RecoverPanic recovers a panic.
+	PanicHandler func(c net.Conn, v interface{}, stack []byte)
+	// StrictPanic panics again after RecoverPanic has logged, counted and
+	// handled a panic, so that tests still crash on it.
+	StrictPanic bool
+	// SocketOptions optionally specifies the options set on the accepted
+	// sockets, and the listener options set on the TCP listeners.
+	// Serve returns ErrNotSupported if an option is not supported by
+	// the system. A conn is rejected if its options cannot be set.
+	SocketOptions *SocketOptions
+	// ProxyProtocol reads a PROXY protocol v1 or v2 header sent by a proxy
+	// or a load balancer before a conn is upgraded, and rewrites the
+	// addresses of the conn. A conn without a valid header is closed.
+	// The conn is assigned to a worker before its header is read, so the
+	// Balancer sees the address of the proxy.
+	ProxyProtocol bool
+	// ProxyHeaderTimeout is the amount of time allowed to read the PROXY
+	// protocol header. If zero, it is 5 seconds. If negative, there is
+	// no timeout.
+	ProxyHeaderTimeout time.Duration
 
-	addr            net.Addr
 	netServer       *netServer
-	file            *os.File
-	fd              int
-	poll            *Poll
+	listeners       []*listener
 	workers         []*worker
 	heap            []*worker
 	rescheduled     bool
+	rescheduler     Rescheduler
+	workersOnce     sync.Once
+	workersErr      error
+	dialer          *listener
+	cpuNodes        map[int]int
 	lock            sync.Mutex
 	wake            bool
 	rescheduling    int32
@@ -53,9 +171,39 @@ type Server struct {
 	unsharedWorkers uint
 	sharedWorkers   uint
 	tasksPerWorker  uint
+	reapInterval    time.Duration
 	wg              sync.WaitGroup
 	closed          int32
+	shutdown        int32
+	unlistened      int32
 	done            chan struct{}
+	numConns        int64
+	ipLock          sync.Mutex
+	ipConns         map[string]int
+	pauseLock       sync.Mutex
+	accepted        int64
+	moves           int64
+	started         time.Time
+	statsLock       sync.Mutex
+	panics          int64
+	registry        registry
+	restartOnce     sync.Once
+	handler         serverHandler
+}
+
+type listener struct {
+	server   *Server
+	file     *os.File
+	fd       int
+	addr     net.Addr
+	key      string
+	poll     *Poll
+	unshared []*worker
+	heap     []*worker
+	workers  []*worker
+	infos    []WorkerInfo
+	paused   bool
+	ops      []Op
 }
 
 // ListenAndServe listens on the network address and then calls
@@ -64,16 +212,57 @@ type Server struct {
 // ListenAndServe always returns a non-nil error.
 // After Close the returned error is ErrServerClosed.
 func (s *Server) ListenAndServe() error {
-	if atomic.LoadInt32(&s.closed) != 0 {
+	if s.shuttingDown() {
 		return ErrServerClosed
 	}
-	ln, err := net.Listen(s.Network, s.Address)
+	if s.ReusePort > 1 && strings.HasPrefix(s.Network, "tcp") {
+		lns, err := inheritedListeners(s.Network, s.Address, -1)
+		if err != nil {
+			return err
+		}
+		if len(lns) == 0 {
+			if lns, err = listenReusePort(s.Network, s.Address, s.ReusePort); err != nil {
+				return err
+			}
+		}
+		for _, ln := range lns {
+			setListenKey(ln, listenKey(s.Network, s.Address))
+		}
+		return s.serve(lns)
+	}
+	ln, err := Listen(s.Network, s.Address)
 	if err != nil {
 		return err
 	}
 	return s.Serve(ln)
 }
 
+// listenReusePort opens n listeners on the same address with SO_REUSEPORT,
+// so that the kernel distributes the incoming conns among them.
+func listenReusePort(network, address string, n int) ([]net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) (err error) {
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		return
+	}}
+	var lns []net.Listener
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			address = ln.Addr().String()
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
 // Serve accepts incoming connections on the listener l,
 // and registers the conn fd to poll. The poll will trigger the fd to
 // read requests and then call handler to reply to them.
@@ -83,9 +272,106 @@ func (s *Server) ListenAndServe() error {
 // Serve always returns a non-nil error.
 // After Close the returned error is ErrServerClosed.
 func (s *Server) Serve(l net.Listener) (err error) {
-	if atomic.LoadInt32(&s.closed) != 0 {
+	return s.serve([]net.Listener{l})
+}
+
+func (s *Server) serve(lns []net.Listener) (err error) {
+	if s.shuttingDown() {
+		for _, l := range lns {
+			if l != nil {
+				l.Close()
+			}
+		}
+		return ErrServerClosed
+	}
+	if s.SharedWorkers < 0 {
+		panic("SharedWorkers < 0")
+	}
+	for _, l := range lns {
+		if l == nil {
+			return ErrListener
+		}
+	}
+	if s.Handler == nil {
+		return ErrHandler
+	}
+	if len(lns) == 1 {
+		switch lns[0].(type) {
+		case *net.TCPListener, *net.UnixListener:
+		default:
+			s.netServer = &netServer{Handler: s.Handler}
+			return s.netServer.Serve(lns[0])
+		}
+	}
+	for i, l := range lns {
+		var ln *listener
+		if ln, err = s.listen(l); err != nil {
+			for _, l := range lns[i+1:] {
+				l.Close()
+			}
+			s.closeListener()
+			return err
+		}
+		s.lock.Lock()
+		if atomic.LoadInt32(&s.unlistened) != 0 {
+			// Close or Shutdown has closed the listeners appended before.
+			s.lock.Unlock()
+			ln.close()
+			for _, l := range lns[i+1:] {
+				l.Close()
+			}
+			return ErrServerClosed
+		}
+		s.listeners = append(s.listeners, ln)
+		s.lock.Unlock()
+	}
+	if err = s.startWorkers(); err != nil {
+		s.closeListener()
+		return err
+	}
+	s.pin()
+	if atomic.LoadInt32(&s.unlistened) != 0 {
+		// Close or Shutdown has run during the setup.
+		if atomic.LoadInt32(&s.closed) != 0 {
+			s.lock.Lock()
+			workers := s.workers
+			s.lock.Unlock()
+			for _, w := range workers {
+				w.Close()
+			}
+		}
+		return ErrServerClosed
+	}
+	if s.RestartSignal != nil {
+		s.restartOnce.Do(func() { go s.handleRestart() })
+	}
+	errs := make(chan error, len(s.listeners))
+	for _, ln := range s.listeners[1:] {
+		go func(ln *listener) {
+			errs <- ln.serve()
+		}(ln)
+	}
+	err = s.listeners[0].serve()
+	s.closeListener()
+	for range s.listeners[1:] {
+		<-errs
+	}
+	s.wg.Wait()
+	if s.shuttingDown() {
 		return ErrServerClosed
 	}
+	return err
+}
+
+// startWorkers creates the workers once for the listeners and the Dialers.
+func (s *Server) startWorkers() error {
+	s.workersOnce.Do(func() {
+		s.workersErr = s.createWorkers()
+	})
+	return s.workersErr
+}
+
+func (s *Server) createWorkers() error {
 	if s.UnsharedWorkers == 0 {
 		s.unsharedWorkers = 16
 	} else if s.UnsharedWorkers > 0 {
@@ -103,44 +389,32 @@ func (s *Server) Serve(l net.Listener) (err error) {
 	} else if s.TasksPerWorker > 0 {
 		s.tasksPerWorker = uint(s.TasksPerWorker)
 	}
-	if l == nil {
-		return ErrListener
-	} else if s.Handler == nil {
-		return ErrHandler
-	}
-	switch netListener := l.(type) {
-	case *net.TCPListener:
-		if s.file, err = netListener.File(); err != nil {
-			l.Close()
-			return err
-		}
-	case *net.UnixListener:
-		if s.file, err = netListener.File(); err != nil {
-			l.Close()
-			return err
-		}
-	default:
-		s.netServer = &netServer{Handler: s.Handler}
-		return s.netServer.Serve(l)
-	}
-	s.fd = int(s.file.Fd())
-	s.addr = l.Addr()
-	l.Close()
-	if err := syscall.SetNonblock(s.fd, true); err != nil {
-		return err
+	// The conns assigned by a Balancer stay on their workers.
+	if !s.NoAsync && s.unsharedWorkers > 0 && s.Balancer == nil {
+		s.rescheduled = true
 	}
-	if s.poll, err = Create(); err != nil {
-		return err
+	s.rescheduler = s.Rescheduler
+	if s.rescheduler == nil {
+		s.rescheduler = &DefaultRescheduler{}
 	}
-	s.poll.Register(s.fd)
-	if !s.NoAsync && s.unsharedWorkers > 0 {
-		s.rescheduled = true
+	s.reapInterval = idleTime
+	for _, d := range []time.Duration{s.IdleTimeout, s.ReadHeaderTimeout} {
+		if d > 0 && d/2 < s.reapInterval {
+			s.reapInterval = d / 2
+		}
 	}
 	for i := 0; i < int(s.unsharedWorkers+s.sharedWorkers); i++ {
-		p, err := Create()
+		p, err := CreateBackend(s.Backend)
 		if err != nil {
 			return err
 		}
+		if err = p.SetMode(s.PollMode); err != nil {
+			p.Close()
+			return err
+		}
+		if s.reapInterval < idleTime {
+			p.SetTimeout(s.reapInterval)
+		}
 		var async bool
 		if i >= int(s.unsharedWorkers) && !s.NoAsync {
 			async = true
@@ -148,6 +422,7 @@ func (s *Server) Serve(l net.Listener) (err error) {
 		w := &worker{
 			index:  i,
 			server: s,
+			cpu:    -1,
 			conns:  make(map[int]*conn),
 			poll:   p,
 			events: make([]Event, 0x400),
@@ -156,38 +431,195 @@ func (s *Server) Serve(l net.Listener) (err error) {
 			jobs:   make(chan func()),
 			tasks:  make(chan struct{}, s.tasksPerWorker),
 		}
+		s.lock.Lock()
 		s.workers = append(s.workers, w)
 		if i >= int(s.unsharedWorkers) {
 			s.heap = append(s.heap, w)
 		}
+		s.lock.Unlock()
+	}
+	s.statsLock.Lock()
+	s.started = time.Now()
+	s.statsLock.Unlock()
+	if s.CPUAffinity {
+		s.pinCPUs()
 	}
+	s.dialer = &listener{
+		server:   s,
+		unshared: s.workers[:s.unsharedWorkers],
+		heap:     append([]*worker{}, s.heap...),
+		workers:  s.workers,
+	}
+	s.lock.Lock()
 	s.done = make(chan struct{}, 1)
+	if atomic.LoadInt32(&s.closed) == 0 {
+		s.handler = holdHandler(s.Handler)
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// listen takes over the fd of the net.Listener l and closes l.
+func (s *Server) listen(l net.Listener) (ln *listener, err error) {
+	key := takeListenKey(l)
+	var file *os.File
+	switch netListener := l.(type) {
+	case *net.TCPListener:
+		file, err = netListener.File()
+	case *net.UnixListener:
+		file, err = netListener.File()
+	default:
+		err = ErrListener
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	ln = &listener{server: s, file: file, fd: int(file.Fd()), addr: l.Addr(), key: key}
+	l.Close()
+	if err = syscall.SetNonblock(ln.fd, true); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, tcp := l.(*net.TCPListener); tcp && s.SocketOptions != nil {
+		if err = s.SocketOptions.validate(); err == nil {
+			err = s.SocketOptions.applyListener(ln.fd)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if ln.poll, err = CreateBackend(s.Backend); err != nil {
+		file.Close()
+		return nil, err
+	}
+	ln.poll.Register(ln.fd)
+	return ln, nil
+}
+
+// pinCPUs assigns a CPU to every worker.
+func (s *Server) pinCPUs() {
+	set := s.CPUs
+	if len(set) == 0 {
+		set, _ = getAffinity()
+	}
+	if len(set) == 0 {
+		return
+	}
+	cpus, nodes := distributeCPUs(set, numaNodes(), len(s.workers))
+	s.cpuNodes = make(map[int]int)
+	for i, w := range s.workers {
+		w.cpu, w.node = cpus[i], nodes[i]
+		s.cpuNodes[w.cpu] = w.node
+	}
+}
+
+// pin assigns the workers to the listeners. Every listener shares all the
+// workers unless PinWorkers is set.
+func (s *Server) pin() {
+	n := len(s.listeners)
+	for i, ln := range s.listeners {
+		for j, w := range s.workers[:s.unsharedWorkers] {
+			if !s.PinWorkers || j%n == i {
+				ln.unshared = append(ln.unshared, w)
+			}
+		}
+		for j, w := range s.heap {
+			if !s.PinWorkers || j%n == i {
+				ln.heap = append(ln.heap, w)
+			}
+		}
+		if len(ln.heap) == 0 {
+			ln.heap = s.heap
+		}
+		ln.workers = append(append(ln.workers, ln.unshared...), ln.heap...)
+	}
+}
+
+// close closes the listen fd and its poll.
+func (l *listener) close() error {
+	err := l.poll.Close()
+	if e := l.file.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (l *listener) serve() (err error) {
 	var n int
 	var events = make([]Event, 1)
 	for err == nil {
-		if n, err = s.poll.Wait(events); n > 0 {
-			if events[0].Fd == s.fd {
-				err = s.accept()
+		if n, err = l.poll.Wait(events); n > 0 {
+			if events[0].Fd == l.fd {
+				err = l.accept()
 			}
-			s.wakeReschedule()
+			l.server.wakeReschedule()
 		}
 		runtime.Gosched()
 	}
-	s.wg.Wait()
 	return err
 }
 
-func (s *Server) accept() (err error) {
-	nfd, sa, err := syscall.Accept(s.fd)
+func (l *listener) accept() (err error) {
+	s := l.server
+	if s.PauseOnLimit && s.full() {
+		l.pause()
+		return nil
+	}
+	if l.poll.Backend() == IOURingBackend {
+		return l.acceptOps()
+	}
+	nfd, sa, err := syscall.Accept(l.fd)
 	if err != nil {
 		if err == syscall.EAGAIN {
 			return nil
 		}
 		return err
 	}
+	c := l.newConn(nfd, sa)
 	if err := syscall.SetNonblock(nfd, true); err != nil {
+		c.Close()
+		s.connState(c, StateRejected, err)
+		return nil
+	}
+	l.admit(c)
+	return nil
+}
+
+// acceptOps accepts the pending conns by a batch of accept operations.
+// The accepted fds are already non-blocking.
+func (l *listener) acceptOps() (err error) {
+	s := l.server
+	n := acceptOps
+	if s.PauseOnLimit && s.MaxConns > 0 {
+		if free := s.MaxConns - int(atomic.LoadInt64(&s.numConns)); free < n {
+			n = free
+		}
+	}
+	if cap(l.ops) < n {
+		l.ops = make([]Op, n)
+	}
+	ops := l.ops[:n]
+	for i := range ops {
+		ops[i] = Op{Kind: OpAccept, Fd: l.fd}
+	}
+	if err = l.poll.Submit(ops); err != nil {
 		return err
 	}
+	for i := range ops {
+		if ops[i].Err == nil {
+			l.admit(l.newConn(ops[i].N, ops[i].Addr))
+		} else if ops[i].Err != syscall.EAGAIN && err == nil {
+			err = ops[i].Err
+		}
+		ops[i].Addr = nil
+	}
+	return err
+}
+
+// newConn returns the conn of the accepted fd nfd from the address sa.
+func (l *listener) newConn(nfd int, sa syscall.Sockaddr) *conn {
 	var rAddr net.Addr
 	switch sockAddr := sa.(type) {
 	case *syscall.SockaddrUnix:
@@ -208,34 +640,208 @@ func (s *Server) accept() (err error) {
 			Zone: zone,
 		}
 	}
+	now := time.Now().UnixNano()
+	return &conn{id: atomic.AddUint64(&connID, 1), fd: nfd, rAddr: rAddr, lAddr: l.addr, readable: make(chan struct{}, 1), created: now, active: now}
+}
+
+// admit counts the accepted conn c against the limits, and assigns it to
+// a worker, or else rejects it.
+func (l *listener) admit(c *conn) {
+	s := l.server
+	nfd, rAddr := c.fd, c.rAddr
+	if s.SocketOptions != nil {
+		_, tcp := rAddr.(*net.TCPAddr)
+		if err := s.SocketOptions.apply(nfd, tcp); err != nil {
+			c.Close()
+			s.connState(c, StateRejected, err)
+			return
+		}
+	}
+	if err := s.acquire(c); err != nil {
+		if len(s.RejectPayload) > 0 {
+			syscall.Write(nfd, s.RejectPayload)
+		}
+		c.Close()
+		s.connState(c, StateRejected, err)
+		return
+	}
+	atomic.AddInt64(&s.accepted, 1)
+	s.connState(c, StateNew, nil)
 	s.lock.Lock()
-	w := s.assignWorker()
-	err = w.register(&conn{w: w, fd: nfd, rAddr: rAddr, lAddr: s.addr})
+	w := l.assignWorker(c)
+	c.w = w
+	w.register(c)
 	s.lock.Unlock()
-	return
 }
 
-func (s *Server) assignWorker() (w *worker) {
-	if w := s.idleUnsharedWorkers(); w != nil {
+// NumConns returns the number of conns.
+func (s *Server) NumConns() int {
+	return int(atomic.LoadInt64(&s.numConns))
+}
+
+// NumConnsPerIP returns the number of conns from the remote ip.
+// It is only tracked when MaxConnsPerIP is set.
+func (s *Server) NumConnsPerIP(ip string) int {
+	s.ipLock.Lock()
+	defer s.ipLock.Unlock()
+	return s.ipConns[ip]
+}
+
+func (s *Server) full() bool {
+	return s.MaxConns > 0 && atomic.LoadInt64(&s.numConns) >= int64(s.MaxConns)
+}
+
+// acquire counts the conn c against the limits.
+func (s *Server) acquire(c *conn) error {
+	if atomic.AddInt64(&s.numConns, 1) > int64(s.MaxConns) && s.MaxConns > 0 {
+		atomic.AddInt64(&s.numConns, -1)
+		return ErrTooManyConns
+	}
+	if s.MaxConnsPerIP > 0 {
+		if addr, ok := c.rAddr.(*net.TCPAddr); ok {
+			ip := addr.IP.String()
+			s.ipLock.Lock()
+			if s.ipConns == nil {
+				s.ipConns = make(map[string]int)
+			}
+			if s.ipConns[ip] >= s.MaxConnsPerIP {
+				s.ipLock.Unlock()
+				atomic.AddInt64(&s.numConns, -1)
+				return ErrTooManyConnsPerIP
+			}
+			s.ipConns[ip]++
+			s.ipLock.Unlock()
+			c.ip = ip
+		}
+	}
+	c.acquired = true
+	return nil
+}
+
+// release uncounts the conn c and resumes accepting if paused.
+func (s *Server) release(c *conn) {
+	if !c.acquired {
+		return
+	}
+	if c.ip != "" {
+		s.ipLock.Lock()
+		if s.ipConns[c.ip] <= 1 {
+			delete(s.ipConns, c.ip)
+		} else {
+			s.ipConns[c.ip]--
+		}
+		s.ipLock.Unlock()
+	}
+	atomic.AddInt64(&s.numConns, -1)
+	if s.PauseOnLimit {
+		s.resume()
+	}
+}
+
+func (l *listener) pause() {
+	s := l.server
+	s.pauseLock.Lock()
+	if !l.paused && s.full() {
+		l.poll.Unregister(l.fd)
+		l.paused = true
+	}
+	s.pauseLock.Unlock()
+}
+
+func (s *Server) resume() {
+	s.pauseLock.Lock()
+	for _, l := range s.listeners {
+		if l.paused && !s.full() {
+			l.poll.Register(l.fd)
+			l.paused = false
+		}
+	}
+	s.pauseLock.Unlock()
+}
+
+func (s *Server) connState(c *conn, state ConnState, err error) {
+	if s.ConnState != nil {
+		s.ConnState(c, state, err)
+	}
+}
+
+func (l *listener) assignWorker(c *conn) (w *worker) {
+	if w := l.steer(c); w != nil {
+		return w
+	}
+	if w := l.balance(c); w != nil {
+		return w
+	}
+	if w := l.idleUnsharedWorkers(); w != nil {
 		return w
 	}
-	return s.leastConnectedSharedWorkers()
+	return l.leastConnectedSharedWorkers()
 }
 
-func (s *Server) idleUnsharedWorkers() (w *worker) {
-	if s.unsharedWorkers > 0 {
-		for i := 0; i < int(s.unsharedWorkers); i++ {
-			if s.workers[i].count < 1 {
-				return s.workers[i]
+// steer assigns the conn c to the least connected worker on the CPU
+// that handled its packets, or else on the same NUMA node.
+func (l *listener) steer(c *conn) (w *worker) {
+	s := l.server
+	if !s.SteerIncomingCPU || s.cpuNodes == nil {
+		return nil
+	}
+	cpu := incomingCPU(c.fd)
+	node, ok := s.cpuNodes[cpu]
+	if !ok {
+		return nil
+	}
+	var local *worker
+	for _, candidate := range l.workers {
+		switch {
+		case candidate.cpu == cpu:
+			if w == nil || atomic.LoadInt64(&candidate.count) < atomic.LoadInt64(&w.count) {
+				w = candidate
 			}
+		case candidate.node == node:
+			if local == nil || atomic.LoadInt64(&candidate.count) < atomic.LoadInt64(&local.count) {
+				local = candidate
+			}
+		}
+	}
+	if w == nil {
+		return local
+	}
+	return w
+}
+
+// balance assigns the conn c by the Balancer of the server.
+func (l *listener) balance(c *conn) (w *worker) {
+	b := l.server.Balancer
+	if b == nil {
+		return nil
+	}
+	l.infos = l.infos[:0]
+	for _, w := range l.workers {
+		l.infos = append(l.infos, WorkerInfo{
+			Index:  w.index,
+			Shared: w.async,
+			Conns:  int(atomic.LoadInt64(&w.count)),
+			Load:   atomic.LoadInt64(&w.load),
+		})
+	}
+	if i := b.Balance(c, l.infos); i >= 0 && i < len(l.workers) {
+		return l.workers[i]
+	}
+	return nil
+}
+
+func (l *listener) idleUnsharedWorkers() (w *worker) {
+	for _, w := range l.unshared {
+		if atomic.LoadInt64(&w.count) < 1 {
+			return w
 		}
 	}
 	return nil
 }
 
-func (s *Server) leastConnectedSharedWorkers() (w *worker) {
-	minHeap(s.heap)
-	return s.heap[0]
+func (l *listener) leastConnectedSharedWorkers() (w *worker) {
+	minHeap(l.heap)
+	return l.heap[0]
 }
 
 func (s *Server) wakeReschedule() {
@@ -247,7 +853,7 @@ func (s *Server) wakeReschedule() {
 		s.wake = true
 		s.lock.Unlock()
 		go func() {
-			ticker := time.NewTicker(time.Millisecond * 100)
+			ticker := time.NewTicker(s.rescheduleInterval())
 			for {
 				select {
 				case <-ticker.C:
@@ -272,6 +878,14 @@ func (s *Server) wakeReschedule() {
 	}
 }
 
+// rescheduleInterval returns the interval between two reschedulings.
+func (s *Server) rescheduleInterval() time.Duration {
+	if interval := s.rescheduler.Interval(); interval > 0 {
+		return interval
+	}
+	return DefaultRescheduleInterval
+}
+
 func (s *Server) reschedule() (stop bool) {
 	if !s.rescheduled {
 		return
@@ -286,18 +900,30 @@ func (s *Server) reschedule() (stop bool) {
 	for idx, w := range s.workers {
 		w.lock.Lock()
 		if !w.running {
+			atomic.StoreInt64(&w.load, 0)
 			w.lock.Unlock()
 			continue
 		}
+		load := int64(0)
 		for _, conn := range w.conns {
 			if uint(idx) < s.unsharedWorkers {
 				s.adjust = append(s.adjust, conn)
 			}
-			conn.score = atomic.LoadInt64(&conn.count)
-			atomic.StoreInt64(&conn.count, 0)
-			sum += conn.score
+			conn.activity = Activity{
+				Reads:   atomic.SwapInt64(&conn.count, 0),
+				Bytes:   atomic.SwapInt64(&conn.bytes, 0),
+				Latency: time.Duration(atomic.SwapInt64(&conn.latency, 0)),
+			}
+			if moved := atomic.LoadInt64(&conn.moved); moved > 0 {
+				conn.activity.Moved = time.Unix(0, moved)
+			}
+			conn.activity.Score = s.rescheduler.Score(&conn.activity)
+			atomic.StoreInt64(&conn.score, conn.activity.Score)
+			load += conn.score
 			s.list = append(s.list, conn)
 		}
+		atomic.StoreInt64(&w.load, load)
+		sum += load
 		w.lock.Unlock()
 	}
 	if len(s.list) == 0 || sum == 0 {
@@ -334,10 +960,18 @@ func (s *Server) reschedule() (stop bool) {
 	if len(reschedules) == 0 || len(reschedules) != len(s.adjust) {
 		return false
 	}
+	// Pairs the hottest conns on the shared workers with the coldest
+	// conns on the unshared workers.
+	insertionSort(reschedules, true)
+	insertionSort(s.adjust, false)
+	now := time.Now().UnixNano()
 	for i := 0; i < len(reschedules); i++ {
 		if atomic.LoadInt32(&s.adjust[i].ready) == 0 || atomic.LoadInt32(&reschedules[i].ready) == 0 {
 			continue
 		}
+		if !s.rescheduler.Swap(&reschedules[i].activity, &s.adjust[i].activity) {
+			continue
+		}
 		s.adjust[i].lock.Lock()
 		reschedules[i].lock.Lock()
 		unsharedWorker := s.adjust[i].w
@@ -354,10 +988,50 @@ func (s *Server) reschedule() (stop bool) {
 		unsharedWorker.lock.Unlock()
 		s.adjust[i].lock.Unlock()
 		reschedules[i].lock.Unlock()
+		atomic.StoreInt64(&s.adjust[i].moved, now)
+		atomic.StoreInt64(&reschedules[i].moved, now)
+		atomic.AddInt64(&s.moves, 2)
+		s.connState(s.adjust[i], StateRescheduled, nil)
+		s.connState(reschedules[i], StateRescheduled, nil)
 	}
 	return false
 }
 
+// Stats returns a snapshot of the runtime statistics of the server.
+func (s *Server) Stats() Stats {
+	var stats Stats
+	s.lock.Lock()
+	workers := s.workers
+	s.lock.Unlock()
+	for _, w := range workers {
+		w.lock.Lock()
+		running := w.running
+		w.lock.Unlock()
+		ws := WorkerStats{
+			Index:        w.index,
+			Shared:       w.async,
+			Running:      running,
+			Conns:        int(atomic.LoadInt64(&w.count)),
+			Events:       atomic.LoadInt64(&w.numEvents),
+			Busy:         time.Duration(atomic.LoadInt64(&w.busy)),
+			Sleeps:       atomic.LoadInt64(&w.sleeps),
+			Wakes:        atomic.LoadInt64(&w.wakes),
+			Tasks:        len(w.tasks),
+			TasksSpawned: atomic.LoadInt64(&w.spawned),
+		}
+		stats.Conns += ws.Conns
+		stats.Workers = append(stats.Workers, ws)
+	}
+	stats.Accepted = atomic.LoadInt64(&s.accepted)
+	stats.Rescheduled = atomic.LoadInt64(&s.moves)
+	stats.Panics = atomic.LoadInt64(&s.panics)
+	s.statsLock.Lock()
+	stats.Started = s.started
+	s.statsLock.Unlock()
+	stats.Time = time.Now()
+	return stats
+}
+
 // Close closes the server.
 func (s *Server) Close() error {
 	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
@@ -366,27 +1040,113 @@ func (s *Server) Close() error {
 	if s.netServer != nil {
 		return s.netServer.Close()
 	}
-	for i := 0; i < len(s.workers); i++ {
-		s.workers[i].Close()
+	s.lock.Lock()
+	workers, done, handler := s.workers, s.done, s.handler
+	s.handler = nil
+	s.lock.Unlock()
+	for _, w := range workers {
+		w.Close()
+	}
+	if done != nil {
+		close(done)
+	}
+	err := s.closeListener()
+	if handler != nil {
+		handler.releaseServer()
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active conns. Shutdown works by first closing the listener, then
+// closing all idle conns, and then waiting for the busy conns to become
+// idle before closing them. If the provided context expires before
+// the shutdown is complete, Shutdown closes the server and returns
+// the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.shutdown, 0, 1) || atomic.LoadInt32(&s.closed) != 0 {
+		return nil
+	}
+	if s.netServer != nil {
+		return s.Close()
 	}
-	if err := s.file.Close(); err != nil {
+	if err := s.closeListener(); err != nil {
+		s.Close()
 		return err
 	}
-	if s.done != nil {
-		close(s.done)
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return s.Close()
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.closed) != 0 || atomic.LoadInt32(&s.shutdown) != 0
+}
+
+// closeListener stops accepting by closing the listen fd and its poll.
+func (s *Server) closeListener() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !atomic.CompareAndSwapInt32(&s.unlistened, 0, 1) {
+		return nil
+	}
+	var err error
+	for _, l := range s.listeners {
+		if e := l.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// closeIdleConns closes the conns that are not being upgraded or served,
+// and reports whether all conns have been closed.
+func (s *Server) closeIdleConns() bool {
+	quiescent := true
+	for _, w := range s.workers {
+		var idle []*conn
+		w.lock.Lock()
+		for _, c := range w.conns {
+			if atomic.LoadInt32(&c.ready) == 0 || atomic.LoadInt32(&c.serving) > 0 || c.buffered() > 0 {
+				quiescent = false
+				continue
+			}
+			idle = append(idle, c)
+		}
+		w.lock.Unlock()
+		for _, c := range idle {
+			w.closeConn(c, ErrServerClosed)
+		}
 	}
-	return s.poll.Close()
+	return quiescent
 }
 
 type worker struct {
 	index    int
 	server   *Server
+	cpu      int
+	node     int
 	count    int64
+	load     int64
 	lock     sync.Mutex
 	conns    map[int]*conn
 	lastIdle time.Time
+	lastReap time.Time
 	poll     *Poll
 	events   []Event
+	ops      []Op
+	opConns  []*conn
+	batched  map[*conn]OpKind
 	async    bool
 	jobs     chan func()
 	tasks    chan struct{}
@@ -394,6 +1154,21 @@ type worker struct {
 	running  bool
 	slept    int32
 	closed   int32
+
+	timerLock sync.Mutex
+	timers    timers
+	timer     *time.Timer
+
+	numEvents int64
+	busy      int64
+	sleeps    int64
+	wakes     int64
+	spawned   int64
+	// reads is the number of the reads of the conns, which is lastReads
+	// at lastLoad when the load is measured.
+	reads     int64
+	lastReads int64
+	lastLoad  time.Time
 }
 
 func (w *worker) task(job func()) {
@@ -415,36 +1190,51 @@ func (w *worker) task(job func()) {
 
 func (w *worker) run(wg *sync.WaitGroup) {
 	defer wg.Done()
+	if w.cpu >= 0 {
+		// The thread exits with the goroutine since it is never unlocked,
+		// so that its affinity does not leak to other goroutines.
+		runtime.LockOSThread()
+		setAffinity([]int{w.cpu})
+	}
 	var n int
 	var err error
 	for err == nil {
 		n, err = w.poll.Wait(w.events)
 		if n > 0 {
+			atomic.AddInt64(&w.numEvents, int64(n))
+			if w.poll.Backend() == IOURingBackend {
+				w.submitOps(w.events[:n])
+			}
 			for i := range w.events[:n] {
 				ev := w.events[i]
 				if w.async {
 					wg.Add(1)
 					job := func() {
-						w.serve(ev)
+						w.serveEvent(ev)
 						wg.Done()
 					}
 					select {
 					case w.jobs <- job:
 					case w.tasks <- struct{}{}:
+						atomic.AddInt64(&w.spawned, 1)
 						go w.task(job)
 					default:
 						go job()
 					}
 				} else {
-					w.serve(ev)
+					w.serveEvent(ev)
 				}
 			}
 		}
+		w.reap()
+		w.measure()
 		if atomic.LoadInt64(&w.count) < 1 {
 			w.lock.Lock()
 			if len(w.conns) == 0 && w.lastIdle.Add(idleTime).Before(time.Now()) {
+				atomic.StoreInt64(&w.load, 0)
 				w.sleep()
 				w.running = false
+				atomic.AddInt64(&w.sleeps, 1)
 				w.lock.Unlock()
 				return
 			}
@@ -454,8 +1244,94 @@ func (w *worker) run(wg *sync.WaitGroup) {
 	}
 }
 
-func (w *worker) serve(ev Event) error {
-	fd := ev.Fd
+// submitOps writes the pending bytes of the conns of the events, and reads
+// the conns ahead of their Handlers, by a batch of operations submitted to
+// the poll at once. The rLocks of the conns are locked before their wLocks
+// as in Close, and the fds are not closed until the batch is done.
+func (w *worker) submitOps(events []Event) {
+	if w.batched == nil {
+		w.batched = make(map[*conn]OpKind)
+	}
+	w.ops, w.opConns = w.ops[:0], w.opConns[:0]
+	w.lock.Lock()
+	for _, kind := range []OpKind{OpRead, OpWrite} {
+		mode := READ
+		if kind == OpWrite {
+			mode = WRITE
+		}
+		for _, ev := range events {
+			c, ok := w.conns[ev.Fd]
+			if !ok || ev.Mode&mode == 0 || w.batched[c] >= kind || atomic.LoadInt32(&c.connecting) != 0 {
+				continue
+			}
+			// The reads are collected first, so a conn is batched at most
+			// once for each kind.
+			w.batched[c] = kind
+			w.ops = append(w.ops, Op{Kind: kind, Fd: c.fd})
+			w.opConns = append(w.opConns, c)
+		}
+	}
+	w.lock.Unlock()
+	for c := range w.batched {
+		delete(w.batched, c)
+	}
+	n := 0
+	for i, op := range w.ops {
+		c := w.opConns[i]
+		if op.Kind == OpRead {
+			c.rLock.Lock()
+			if !c.readsAhead() {
+				c.rLock.Unlock()
+				continue
+			}
+			op.Buf = buffer.GetBuffer(bufferSize)
+		} else {
+			c.wLock.Lock()
+			if len(c.pending) == 0 || atomic.LoadInt32(&c.closed) != 0 {
+				c.wLock.Unlock()
+				continue
+			}
+			op.Buf = c.pending
+		}
+		w.ops[n], w.opConns[n] = op, c
+		n++
+	}
+	ops := w.ops[:n]
+	if err := w.poll.Submit(ops); err != nil {
+		// The events are served by the syscalls instead.
+		for i := range ops {
+			ops[i].N, ops[i].Err = 0, syscall.EAGAIN
+		}
+	}
+	for i := range ops {
+		op, c := &ops[i], w.opConns[i]
+		if op.Kind == OpRead {
+			c.readAheadDone(op.Buf, op.N, op.Err)
+			c.rLock.Unlock()
+			continue
+		}
+		// The flush of the event handles the errors and arms the conn.
+		if op.N > 0 {
+			c.pending = c.pending[op.N:]
+			atomic.StoreInt64(&c.active, time.Now().UnixNano())
+			atomic.AddInt64(&c.bytesOut, int64(op.N))
+		}
+		c.wLock.Unlock()
+	}
+	for i := range w.ops {
+		w.ops[i], w.opConns[i] = Op{}, nil
+	}
+}
+
+// serveEvent serves the event ev and accounts the time spent.
+func (w *worker) serveEvent(ev Event) {
+	start := time.Now()
+	w.serve(ev)
+	atomic.AddInt64(&w.busy, int64(time.Since(start)))
+}
+
+func (w *worker) serve(ev Event) error {
+	fd := ev.Fd
 	if fd == 0 {
 		return nil
 	}
@@ -466,57 +1342,240 @@ func (w *worker) serve(ev Event) error {
 		return nil
 	}
 	w.lock.Unlock()
+	if atomic.LoadInt32(&c.connecting) != 0 {
+		// Any event completes the connect of a dialed conn.
+		if atomic.CompareAndSwapInt32(&c.connecting, 1, 0) {
+			c.wLock.Lock()
+			c.arm()
+			c.wLock.Unlock()
+			close(c.connected)
+		}
+		return nil
+	}
+	if ev.Mode&WRITE != 0 {
+		if err := c.flush(); err != nil {
+			w.closeConn(c, err)
+			return nil
+		}
+	}
 	if atomic.LoadInt32(&c.ready) == 0 {
+		// Wakes the Read of the upgrading conn, and disarms its reads
+		// until it waits again, so that the worker does not spin on them.
+		atomic.StoreInt32(&c.waiting, 0)
+		c.notify()
+		c.wLock.Lock()
+		c.arm()
+		c.wLock.Unlock()
+		return nil
+	}
+	switch {
+	case ev.Mode&READ != 0:
+		if atomic.LoadInt32(&c.paused) == 0 && atomic.LoadInt32(&c.readClosed) == 0 {
+			w.serveConn(c)
+		}
+	case ev.Mode&(HUP|ERROR) != 0:
+		w.closeConn(c, c.sockError())
 		return nil
+	case ev.Mode&WRITE != 0:
+		if c.expired(&c.rDeadline) || atomic.LoadInt32(&c.unread) != 0 {
+			w.serveConn(c)
+		}
 	}
-	switch ev.Mode {
-	case WRITE:
-	case READ:
-		w.serveConn(c)
+	if atomic.LoadInt32(&c.unread) != 0 && atomic.LoadInt32(&c.closing) == 0 {
+		c.wLock.Lock()
+		c.arm()
+		c.wLock.Unlock()
+		return nil
 	}
+	w.rearm(c)
 	return nil
 }
 
+// rearm enables the conn c again after its event has been served in OneShot mode.
+func (w *worker) rearm(c *conn) {
+	if w.server.PollMode != OneShot || atomic.LoadInt32(&c.closing) != 0 {
+		return
+	}
+	c.wLock.Lock()
+	c.arm()
+	c.wLock.Unlock()
+}
+
 func (w *worker) serveConn(c *conn) error {
+	atomic.AddInt32(&c.serving, 1)
+	defer atomic.AddInt32(&c.serving, -1)
+	w.server.connState(c, StateActive, nil)
 	for {
-		err := w.server.Handler.Serve(c.context)
+		var start time.Time
+		if w.server.rescheduled {
+			start = time.Now()
+		}
+		err := w.serveHandler(c)
+		if w.server.rescheduled {
+			atomic.AddInt64(&c.latency, int64(time.Since(start)))
+		}
 		if err != nil {
-			if err == syscall.EAGAIN {
-				return nil
-			}
-			if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+			// The EOF after CloseRead leaves the writing side open.
+			if err == syscall.EAGAIN || err == EOF && atomic.LoadInt32(&c.readClosed) != 0 {
+				if atomic.LoadInt32(&w.server.shutdown) != 0 {
+					w.closeConn(c, ErrServerClosed)
+				} else {
+					w.server.connState(c, StateIdle, nil)
+				}
 				return nil
 			}
-			w.Decrease(c)
-			c.Close()
+			w.closeConn(c, err)
 			return nil
 		}
+		atomic.StoreInt32(&c.served, 1)
 	}
 }
 
-func (w *worker) register(c *conn) error {
-	w.Increase(c)
-	go func(w *worker, c *conn) {
-		var err error
-		defer func() {
-			if err != nil {
-				w.Decrease(c)
-				c.Close()
-			}
-		}()
-		if err = syscall.SetNonblock(c.fd, false); err != nil {
-			return
+// closeConn removes the conn c from the worker and closes it because of err.
+// It reports whether the conn was closed by this call.
+func (w *worker) closeConn(c *conn, err error) bool {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		return false
+	}
+	w.Decrease(c)
+	w.server.registry.remove(c.id)
+	c.Close()
+	w.server.release(c)
+	w.server.connState(c, StateClosed, err)
+	return true
+}
+
+// measure sets the load of the worker to the number of the reads of its
+// conns in the last rescheduling interval, unless the conns are rescheduled
+// which scores the load instead.
+func (w *worker) measure() {
+	s := w.server
+	if s.rescheduled {
+		return
+	}
+	now := time.Now()
+	if now.Sub(w.lastLoad) < s.rescheduleInterval() {
+		return
+	}
+	w.lastLoad = now
+	reads := atomic.LoadInt64(&w.reads)
+	atomic.StoreInt64(&w.load, reads-w.lastReads)
+	w.lastReads = reads
+}
+
+// reap evicts the conns that have been idle longer than IdleTimeout or
+// have not been served within ReadHeaderTimeout.
+func (w *worker) reap() {
+	s := w.server
+	if s.IdleTimeout <= 0 && s.ReadHeaderTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(w.lastReap) < s.reapInterval {
+		return
+	}
+	w.lastReap = now
+	type eviction struct {
+		c   *conn
+		err error
+	}
+	var evictions []eviction
+	w.lock.Lock()
+	for _, c := range w.conns {
+		if atomic.LoadInt32(&c.serving) > 0 {
+			continue
 		}
-		if c.context, err = w.server.Handler.Upgrade(c); err != nil {
-			return
+		if s.ReadHeaderTimeout > 0 && atomic.LoadInt32(&c.served) == 0 &&
+			now.UnixNano()-c.created > int64(s.ReadHeaderTimeout) {
+			evictions = append(evictions, eviction{c, ErrReadHeaderTimeout})
+		} else if s.IdleTimeout > 0 && now.UnixNano()-atomic.LoadInt64(&c.active) > int64(s.IdleTimeout) {
+			evictions = append(evictions, eviction{c, ErrIdleTimeout})
+		}
+	}
+	w.lock.Unlock()
+	for _, e := range evictions {
+		if w.closeConn(e.c, e.err) && s.OnEvict != nil {
+			s.OnEvict(e.c, e.err)
+		}
+	}
+}
+
+func (w *worker) register(c *conn) {
+	c.handler = w.server.Handler
+	w.Increase(c)
+	go w.upgrade(c)
+}
+
+// upgradeHandler calls the Upgrade method of the Handler of the conn c.
+func (w *worker) upgradeHandler(c *conn) (ctx Context, err error) {
+	if w.server.RecoverPanic {
+		defer w.server.recoverPanic(c, &err)
+	}
+	return c.handler.Upgrade(c)
+}
+
+// serveHandler calls the Serve method of the Handler of the conn c.
+func (w *worker) serveHandler(c *conn) (err error) {
+	if w.server.RecoverPanic {
+		defer w.server.recoverPanic(c, &err)
+	}
+	return c.handler.Serve(c.context)
+}
+
+// recoverPanic recovers a panic of the Handler of the conn c, and sets err
+// to ErrPanic so that the conn is closed. It must be deferred directly.
+func (s *Server) recoverPanic(c *conn, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	atomic.AddInt64(&s.panics, 1)
+	logger.Errorf("netpoll: panic serving conn %d %v: %v\n%s", c.id, c.RemoteAddr(), v, stack)
+	if s.PanicHandler != nil {
+		s.PanicHandler(c, v, stack)
+	}
+	if s.StrictPanic {
+		panic(v)
+	}
+	*err = ErrPanic
+}
+
+// proxyHeaderTimeout returns the timeout of reading a PROXY protocol header.
+func (s *Server) proxyHeaderTimeout() time.Duration {
+	if s.ProxyHeaderTimeout == 0 {
+		return proxyHeaderTimeout
+	}
+	return s.ProxyHeaderTimeout
+}
+
+// upgrade upgrades the conn c by its Handler and then serves it.
+func (w *worker) upgrade(c *conn) {
+	var err error
+	defer func() {
+		if err != nil {
+			w.closeConn(c, err)
 		}
-		if err = syscall.SetNonblock(c.fd, true); err != nil {
+	}()
+	if w.server.ProxyProtocol && !c.dialed {
+		if err = c.readProxyHeader(w.server.proxyHeaderTimeout()); err != nil {
 			return
 		}
-		atomic.StoreInt32(&c.ready, 1)
-		w.serveConn(c)
-	}(w, c)
-	return nil
+	}
+	if c.context, err = w.upgradeHandler(c); err != nil {
+		return
+	}
+	atomic.StoreInt32(&c.ready, 1)
+	c.wLock.Lock()
+	c.arm()
+	c.wLock.Unlock()
+	// The conn is not written by Push and Broadcast before it is upgraded.
+	w.server.registry.add(c.id, c)
+	if atomic.LoadInt32(&c.closing) != 0 {
+		w.server.registry.remove(c.id)
+	}
+	w.server.connState(c, StateUpgraded, nil)
+	w.serveConn(c)
 }
 
 func (w *worker) Increase(c *conn) {
@@ -529,6 +1588,14 @@ func (w *worker) increase(c *conn) {
 	w.conns[c.fd] = c
 	atomic.AddInt64(&w.count, 1)
 	w.poll.Register(c.fd)
+	c.wLock.Lock()
+	c.interest = interestRead
+	if atomic.LoadInt32(&c.connecting) != 0 {
+		c.armWrite(w.poll)
+	} else {
+		c.armOn(w.poll)
+	}
+	c.wLock.Unlock()
 	w.wake()
 }
 
@@ -549,6 +1616,7 @@ func (w *worker) decrease(c *conn) {
 func (w *worker) wake() {
 	if !w.running {
 		w.running = true
+		atomic.AddInt64(&w.wakes, 1)
 		w.done = make(chan struct{}, 1)
 		atomic.StoreInt32(&w.slept, 0)
 		w.server.wg.Add(1)
@@ -563,58 +1631,321 @@ func (w *worker) sleep() {
 	close(w.done)
 }
 
+// addTimer schedules the conn c to expire at when in unix nanoseconds.
+func (w *worker) addTimer(c *conn, when int64) {
+	w.timerLock.Lock()
+	t := &timer{conn: c, when: when}
+	w.timers = append(w.timers, t)
+	heapUp(w.timers, len(w.timers)-1)
+	if w.timers[0] == t {
+		w.resetTimer(when)
+	}
+	w.timerLock.Unlock()
+}
+
+func (w *worker) resetTimer(when int64) {
+	d := time.Duration(when - time.Now().UnixNano())
+	if w.timer == nil {
+		w.timer = time.AfterFunc(d, w.expire)
+	} else {
+		w.timer.Reset(d)
+	}
+}
+
+// expire pops the timers that are due and wakes their conns.
+func (w *worker) expire() {
+	now := time.Now().UnixNano()
+	var expired timers
+	w.timerLock.Lock()
+	for len(w.timers) > 0 && w.timers[0].when <= now {
+		n := len(w.timers) - 1
+		w.timers.Swap(0, n)
+		expired = append(expired, w.timers[n])
+		w.timers[n] = nil
+		w.timers = w.timers[:n]
+		heapDown(w.timers, 0, n)
+	}
+	if len(w.timers) > 0 {
+		w.resetTimer(w.timers[0].when)
+	}
+	w.timerLock.Unlock()
+	for _, t := range expired {
+		t.conn.expire(t.when)
+	}
+}
+
 func (w *worker) Close() {
 	if !atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
 		return
 	}
+	w.timerLock.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timers = nil
+	w.timerLock.Unlock()
+	var closed []*conn
 	w.lock.Lock()
 	for _, c := range w.conns {
+		if atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+			w.server.registry.remove(c.id)
+			closed = append(closed, c)
+		}
 		c.Close()
 		delete(w.conns, c.fd)
 	}
 	w.sleep()
 	w.poll.Close()
 	w.lock.Unlock()
+	for _, c := range closed {
+		w.server.release(c)
+		w.server.connState(c, StateClosed, ErrServerClosed)
+	}
 }
 
 type conn struct {
-	lock    sync.Mutex
-	w       *worker
-	rLock   sync.Mutex
-	wLock   sync.Mutex
-	fd      int
-	lAddr   net.Addr
-	rAddr   net.Addr
-	context Context
-	ready   int32
-	count   int64
-	score   int64
-	closing int32
-	closed  int32
+	lock       sync.Mutex
+	w          *worker
+	id         uint64
+	rLock      sync.Mutex
+	wLock      sync.Mutex
+	fd         int
+	lAddr      net.Addr
+	rAddr      net.Addr
+	handler    Handler
+	context    Context
+	dialed     bool
+	connecting int32
+	connected  chan struct{}
+	ready      int32
+	count      int64
+	bytes      int64
+	latency    int64
+	moved      int64
+	score      int64
+	activity   Activity
+	closing    int32
+	closed     int32
+	rDeadline  int64
+	wDeadline  int64
+	timer      int64
+	readable   chan struct{}
+	waiting    int32
+	held       int32
+	created    int64
+	active     int64
+	serving    int32
+	served     int32
+	ip         string
+	acquired   bool
+	pending    []byte
+	paused     int32
+	bytesIn    int64
+	bytesOut   int64
+	reads      int64
+	value      interface{}
+	// writeClosed is set by CloseWrite to shut down the writing side
+	// once the pending bytes are written.
+	writeClosed bool
+	// readClosed is set by CloseRead, which disarms the read events.
+	readClosed int32
+	proxy      *ProxyHeader
+	// interest is the events of the conn armed on its poll, guarded by wLock.
+	interest uint8
+	// ahead is the bytes in aheadBuf read ahead of the Handler by a batch of
+	// the worker, and aheadErr is the error of the last read ahead, guarded
+	// by rLock. unread is set until the Handler reads them.
+	ahead    []byte
+	aheadBuf []byte
+	aheadErr error
+	unread   int32
+	// direct is set once the fd is read directly, which stops the reads ahead.
+	direct int32
 }
 
+// The events of a conn armed on its poll.
+const (
+	interestRead  = iota // read events
+	interestWrite        // read and write events
+	interestPause        // write events only, the reads are paused
+	interestNone         // no events, the reads are disarmed
+)
+
 // Read reads data from the connection.
+//
+// Read blocks until data is available while the conn is being upgraded,
+// and returns EAGAIN once the conn is served by the poll.
 func (c *conn) Read(b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
+	rescheduled, err := c.startRead()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		c.rLock.Lock()
+		if atomic.LoadInt32(&c.unread) != 0 {
+			bufs := [1][]byte{b}
+			n, err = c.readAhead(bufs[:])
+			c.rLock.Unlock()
+			break
+		}
+		n, err = syscall.Read(c.fd, b)
+		c.rLock.Unlock()
+		if retry, err := c.retry(err); err != nil {
+			return 0, err
+		} else if !retry {
+			break
+		}
+	}
+	return c.endRead(n, err, rescheduled)
+}
+
+// ReadBuffers implements the BuffersReader ReadBuffers method by readv.
+// It blocks like Read while the conn is being upgraded.
+func (c *conn) ReadBuffers(bufs [][]byte) (int64, error) {
+	var total int64
+	for _, b := range bufs {
+		total += int64(len(b))
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	rescheduled, err := c.startRead()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for {
+		c.rLock.Lock()
+		if atomic.LoadInt32(&c.unread) != 0 {
+			n, err = c.readAhead(bufs)
+			c.rLock.Unlock()
+			break
+		}
+		n, err = readv(c.fd, bufs)
+		c.rLock.Unlock()
+		if retry, err := c.retry(err); err != nil {
+			return 0, err
+		} else if !retry {
+			break
+		}
+	}
+	n, err = c.endRead(n, err, rescheduled)
+	return int64(n), err
+}
+
+// readsAhead reports whether the worker may read the conn ahead of its
+// Handler. It must be called with rLock held.
+func (c *conn) readsAhead() bool {
+	return atomic.LoadInt32(&c.unread) == 0 && atomic.LoadInt32(&c.direct) == 0 &&
+		atomic.LoadInt32(&c.closing) == 0 && atomic.LoadInt32(&c.closed) == 0 && c.reading()
+}
+
+// readAheadDone keeps the n bytes read ahead into the buffer buf by a read
+// returning err, until the Handler reads them. It must be called with rLock
+// held.
+func (c *conn) readAheadDone(buf []byte, n int, err error) {
+	switch {
+	case n > 0:
+		c.ahead, c.aheadBuf = buf[:n], buf
+		atomic.StoreInt32(&c.unread, 1)
+		return
+	case err == nil:
+		c.aheadErr = EOF
+		atomic.StoreInt32(&c.unread, 1)
+	case err != syscall.EAGAIN:
+		c.aheadErr = err
+		atomic.StoreInt32(&c.unread, 1)
+	}
+	buffer.PutBuffer(buf)
+}
+
+// readAhead reads the bytes read ahead by the worker into the bufs, or
+// returns the error of the read ahead once they are all read. It must be
+// called with rLock held.
+func (c *conn) readAhead(bufs [][]byte) (n int, err error) {
+	for _, b := range bufs {
+		if len(c.ahead) == 0 {
+			break
+		}
+		m := copy(b, c.ahead)
+		c.ahead = c.ahead[m:]
+		n += m
+	}
+	if len(c.ahead) > 0 {
+		return n, nil
+	}
+	if c.aheadBuf != nil {
+		buffer.PutBuffer(c.aheadBuf)
+		c.ahead, c.aheadBuf = nil, nil
+	}
+	if c.aheadErr == nil {
+		atomic.StoreInt32(&c.unread, 0)
+	} else if n == 0 {
+		// The error stays for the later reads.
+		return 0, c.aheadErr
+	}
+	return n, nil
+}
+
+// readDirect stops the reads ahead of the conn, whose fd is read directly,
+// and reports whether all the bytes read ahead have been read.
+func (c *conn) readDirect() bool {
+	atomic.StoreInt32(&c.direct, 1)
+	c.rLock.Lock()
+	defer c.rLock.Unlock()
+	return atomic.LoadInt32(&c.unread) == 0
+}
+
+// startRead counts a read of the conn unless its read deadline has passed,
+// and reports whether the conn is rescheduled by its reads.
+func (c *conn) startRead() (rescheduled bool, err error) {
+	if c.expired(&c.rDeadline) {
+		return false, ErrDeadlineExceeded
+	}
 	c.lock.Lock()
-	if c.w.server.rescheduled {
-		c.lock.Unlock()
+	w := c.w
+	c.lock.Unlock()
+	rescheduled = w.server.rescheduled
+	atomic.AddInt64(&c.reads, 1)
+	atomic.AddInt64(&w.reads, 1)
+	if rescheduled {
 		atomic.AddInt64(&c.count, 1)
-	} else {
-		c.lock.Unlock()
 	}
-	c.rLock.Lock()
-	n, err = syscall.Read(c.fd, b)
-	c.rLock.Unlock()
+	return rescheduled, nil
+}
+
+// retry reports whether to read again after a read syscall failing with
+// err, by waiting until the conn is readable while it is being upgraded.
+// It returns the error of the wait if it fails.
+func (c *conn) retry(err error) (bool, error) {
+	if err != syscall.EAGAIN || !c.blocking() {
+		return false, nil
+	}
+	if err = c.waitReadable(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// endRead accounts the n bytes read by a read syscall returning err, and
+// returns the result of the read.
+func (c *conn) endRead(n int, err error, rescheduled bool) (int, error) {
 	if err != nil && err != syscall.EAGAIN || err == nil && n == 0 {
 		err = EOF
 	}
 	if n < 0 {
 		n = 0
+	} else if n > 0 {
+		atomic.StoreInt64(&c.active, time.Now().UnixNano())
+		atomic.AddInt64(&c.bytesIn, int64(n))
+		if rescheduled {
+			atomic.AddInt64(&c.bytes, int64(n))
+		}
 	}
-	return
+	return n, err
 }
 
 // Write writes data to the connection.
@@ -622,21 +1953,275 @@ func (c *conn) Write(b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
-	var remain = len(b)
+	if err = c.startWrite(); err != nil {
+		return 0, err
+	}
+	for n < len(b) && len(c.pending) == 0 {
+		m, e := syscall.Write(c.fd, b[n:])
+		if err = c.wrote(m, e); err != nil {
+			c.wLock.Unlock()
+			return n, err
+		} else if m <= 0 {
+			break
+		}
+		n += m
+	}
+	if n == len(b) {
+		c.wLock.Unlock()
+		return n, nil
+	}
+	bufs := [1][]byte{b[n:]}
+	if err = c.queue(bufs[:], 0, len(b)-n); err != nil {
+		return n, err
+	}
+	return len(b), nil
+}
+
+// WriteBuffers implements the BuffersWriter WriteBuffers method by writev.
+// Like Write, the bytes which cannot be written at once are kept pending.
+func (c *conn) WriteBuffers(bufs [][]byte) (n int64, err error) {
+	var total int64
+	for _, b := range bufs {
+		total += int64(len(b))
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	if err = c.startWrite(); err != nil {
+		return 0, err
+	}
+	var off int
+	for n < total && len(c.pending) == 0 {
+		m, e := writev(c.fd, bufs, off)
+		if err = c.wrote(m, e); err != nil {
+			c.wLock.Unlock()
+			return n, err
+		} else if m <= 0 {
+			break
+		}
+		n += int64(m)
+		bufs, off = advance(bufs, off, m)
+	}
+	if n == total {
+		c.wLock.Unlock()
+		return n, nil
+	}
+	if err = c.queue(bufs, off, int(total-n)); err != nil {
+		return n, err
+	}
+	return total, nil
+}
+
+// startWrite locks wLock for a write of the conn, unless its write deadline
+// has passed or the conn or its writing side is closed.
+func (c *conn) startWrite() error {
+	if c.expired(&c.wDeadline) {
+		return ErrDeadlineExceeded
+	}
 	c.wLock.Lock()
-	for remain > 0 {
-		n, err = syscall.Write(c.fd, b[len(b)-remain:])
+	// The fd is closed with wLock held, so it is not reused by another conn.
+	if atomic.LoadInt32(&c.closed) != 0 {
+		c.wLock.Unlock()
+		return ErrConnClosed
+	}
+	if c.writeClosed {
+		c.wLock.Unlock()
+		return syscall.EPIPE
+	}
+	return nil
+}
+
+// wrote accounts the n bytes written by a write syscall returning err.
+// It returns EOF if the write failed, and nil if it wrote some bytes or
+// the rest must be queued until the conn is writable.
+func (c *conn) wrote(n int, err error) error {
+	if n > 0 {
+		atomic.StoreInt64(&c.active, time.Now().UnixNano())
+		atomic.AddInt64(&c.bytesOut, int64(n))
+		return nil
+	}
+	if err != syscall.EAGAIN || c.w == nil {
+		return EOF
+	}
+	return nil
+}
+
+// queue keeps the remain bytes of the bufs, past the first off bytes of
+// bufs[0], pending until the conn is writable, and pauses the reads of the
+// conn at the high watermark. It must be called with wLock held, which it
+// unlocks. The conn is closed if the pending bytes exceed MaxPendingBytes.
+func (c *conn) queue(bufs [][]byte, off int, remain int) error {
+	s := c.w.server
+	if s.MaxPendingBytes > 0 && len(c.pending)+remain > s.MaxPendingBytes {
+		c.wLock.Unlock()
+		c.lock.Lock()
+		w := c.w
+		c.lock.Unlock()
+		w.closeConn(c, ErrPendingBytes)
+		return ErrPendingBytes
+	}
+	for i, b := range bufs {
+		if i == 0 {
+			b = b[off:]
+		}
+		c.pending = append(c.pending, b...)
+	}
+	pause := s.WriteHighWatermark > 0 && len(c.pending) >= s.WriteHighWatermark &&
+		atomic.CompareAndSwapInt32(&c.paused, 0, 1)
+	c.arm()
+	c.wLock.Unlock()
+	if pause {
+		c.backpressure(true)
+	}
+	return nil
+}
+
+// flush writes the pending bytes queued by Write, and resumes the paused
+// reads once the pending bytes drop to the low watermark.
+func (c *conn) flush() error {
+	c.wLock.Lock()
+	for len(c.pending) > 0 {
+		n, err := syscall.Write(c.fd, c.pending)
 		if n > 0 {
-			remain -= n
+			c.pending = c.pending[n:]
+			atomic.StoreInt64(&c.active, time.Now().UnixNano())
+			atomic.AddInt64(&c.bytesOut, int64(n))
 			continue
 		}
 		if err != syscall.EAGAIN {
 			c.wLock.Unlock()
-			return len(b) - remain, EOF
+			return EOF
+		}
+		break
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+		if c.writeClosed {
+			syscall.Shutdown(c.fd, syscall.SHUT_WR)
 		}
 	}
+	s := c.w.server
+	low := s.WriteLowWatermark
+	if low <= 0 {
+		low = s.WriteHighWatermark / 2
+	}
+	resume := atomic.LoadInt32(&c.paused) == 1 && len(c.pending) <= low &&
+		atomic.CompareAndSwapInt32(&c.paused, 1, 0)
+	c.arm()
 	c.wLock.Unlock()
-	return len(b), nil
+	if resume {
+		c.backpressure(false)
+	}
+	return nil
+}
+
+// arm sets the events of the conn to poll according to its pending bytes.
+// It must be called with wLock held.
+func (c *conn) arm() {
+	c.armOn(c.poll())
+}
+
+// armOn sets the events of the conn to the poll p from its pending bytes,
+// its paused reads and its bytes read ahead. The poll only rewrites the events of a conn here,
+// so that they always follow the state of the conn.
+func (c *conn) armOn(p *Poll) {
+	reading := c.reading()
+	switch {
+	case len(c.pending) > 0 && !reading:
+		c.interest = interestPause
+		p.Pause(c.fd)
+	case len(c.pending) > 0 || reading && atomic.LoadInt32(&c.unread) != 0:
+		// The write events also serve the bytes read ahead.
+		if c.interest == interestPause || c.interest == interestNone {
+			p.Resume(c.fd)
+		}
+		c.interest = interestWrite
+		p.Write(c.fd)
+	case !reading:
+		if c.interest != interestNone {
+			c.interest = interestNone
+			p.Suspend(c.fd)
+		}
+	case c.interest != interestRead:
+		c.interest = interestRead
+		p.Resume(c.fd)
+	default:
+		p.Rearm(c.fd)
+	}
+}
+
+// armWrite adds a write event of the conn to the poll p, keeping its
+// reads paused if they are. It must be called with wLock held.
+func (c *conn) armWrite(p *Poll) {
+	if !c.reading() {
+		c.interest = interestPause
+		p.Pause(c.fd)
+		return
+	}
+	c.interest = interestWrite
+	p.Write(c.fd)
+}
+
+// reading reports whether the read events of the conn should be armed.
+// They are disarmed while its reads are paused or held, after CloseRead,
+// and while it is upgrading until its Read waits for them.
+func (c *conn) reading() bool {
+	if atomic.LoadInt32(&c.paused) != 0 || atomic.LoadInt32(&c.held) != 0 ||
+		atomic.LoadInt32(&c.readClosed) != 0 {
+		return false
+	}
+	return atomic.LoadInt32(&c.ready) != 0 || atomic.LoadInt32(&c.waiting) != 0
+}
+
+// holdReads disarms the read events of the conn until releaseReads, for a
+// handler that cannot take more requests yet.
+func (c *conn) holdReads() {
+	if atomic.CompareAndSwapInt32(&c.held, 0, 1) {
+		c.rearmReads()
+	}
+}
+
+// releaseReads arms the read events of the conn held by holdReads again.
+func (c *conn) releaseReads() {
+	if atomic.CompareAndSwapInt32(&c.held, 1, 0) {
+		c.rearmReads()
+	}
+}
+
+// isClosed reports whether the conn is closing or closed, so that the
+// replies of a handler are not written to it anymore.
+func (c *conn) isClosed() bool {
+	return atomic.LoadInt32(&c.closing) != 0 || atomic.LoadInt32(&c.closed) != 0
+}
+
+// rearmReads arms the events of the conn after its reads are held,
+// released or closed.
+func (c *conn) rearmReads() {
+	c.wLock.Lock()
+	// The fd is not closed while wLock is held.
+	if atomic.LoadInt32(&c.closed) == 0 {
+		c.arm()
+	}
+	c.wLock.Unlock()
+}
+
+// buffered returns the number of pending bytes.
+func (c *conn) buffered() int {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	return len(c.pending)
+}
+
+func (c *conn) poll() *Poll {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.w.poll
+}
+
+func (c *conn) backpressure(paused bool) {
+	if h, ok := c.handler.(BackpressureHandler); ok && c.context != nil {
+		h.Backpressure(c.context, paused)
+	}
 }
 
 // Close closes the connection.
@@ -644,29 +2229,269 @@ func (c *conn) Close() (err error) {
 	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		return
 	}
-	return syscall.Close(c.fd)
+	c.notify()
+	if atomic.CompareAndSwapInt32(&c.connecting, 1, 0) {
+		// Wakes the Dial waiting for the connect.
+		close(c.connected)
+	}
+	// The fd is not closed while a batch of the worker reads or writes it.
+	c.rLock.Lock()
+	c.wLock.Lock()
+	if len(c.pending) > 0 {
+		syscall.Write(c.fd, c.pending)
+		c.pending = nil
+	}
+	err = syscall.Close(c.fd)
+	c.wLock.Unlock()
+	c.rLock.Unlock()
+	return
+}
+
+// CloseRead shuts down the reading side of the conn, which is not served
+// anymore, while its writing side stays open.
+// Most callers should just use Close.
+func (c *conn) CloseRead() error {
+	if !c.ok() {
+		return syscall.EINVAL
+	}
+	// The EOF of the shut down reading side does not close the conn.
+	atomic.StoreInt32(&c.readClosed, 1)
+	c.lock.Lock()
+	w := c.w
+	c.lock.Unlock()
+	if w != nil {
+		c.rearmReads()
+	}
+	return os.NewSyscallError("shutdown", syscall.Shutdown(c.fd, syscall.SHUT_RD))
+}
+
+// CloseWrite shuts down the writing side of the conn once the pending
+// bytes are written. Write returns syscall.EPIPE after CloseWrite.
+// Most callers should just use Close.
+func (c *conn) CloseWrite() error {
+	if !c.ok() {
+		return syscall.EINVAL
+	}
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	if len(c.pending) > 0 {
+		return nil
+	}
+	return os.NewSyscallError("shutdown", syscall.Shutdown(c.fd, syscall.SHUT_WR))
+}
+
+// ID implements the ConnInfo ID method.
+func (c *conn) ID() uint64 {
+	return c.id
+}
+
+// Created implements the ConnInfo Created method.
+func (c *conn) Created() time.Time {
+	return time.Unix(0, c.created)
+}
+
+// BytesRead implements the ConnInfo BytesRead method.
+func (c *conn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.bytesIn)
+}
+
+// BytesWritten implements the ConnInfo BytesWritten method.
+func (c *conn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.bytesOut)
+}
+
+// Reads implements the ConnInfo Reads method.
+func (c *conn) Reads() int64 {
+	return atomic.LoadInt64(&c.reads)
+}
+
+// Worker implements the ConnInfo Worker method.
+func (c *conn) Worker() (index int, shared bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.w == nil {
+		return -1, false
+	}
+	return c.w.index, c.w.async
+}
+
+// Value implements the ConnInfo Value method.
+func (c *conn) Value() interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.value
+}
+
+// SetValue implements the ConnInfo SetValue method.
+func (c *conn) SetValue(v interface{}) {
+	c.lock.Lock()
+	c.value = v
+	c.lock.Unlock()
+}
+
+// ProxyHeader implements the ConnInfo ProxyHeader method.
+func (c *conn) ProxyHeader() *ProxyHeader {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.proxy
 }
 
 // LocalAddr returns the local network address.
 func (c *conn) LocalAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.lAddr
 }
 
 // RemoteAddr returns the remote network address.
 func (c *conn) RemoteAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.rAddr
 }
 
+// SetDeadline sets the read and write deadlines associated
+// with the connection.
 func (c *conn) SetDeadline(t time.Time) error {
-	return errors.New("not supported")
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
 }
 
+// SetReadDeadline sets the deadline for future Read calls
+// and any currently-blocked Read call.
+// A zero value for t means Read will not time out.
 func (c *conn) SetReadDeadline(t time.Time) error {
-	return errors.New("not supported")
+	return c.setDeadline(&c.rDeadline, t)
 }
 
+// SetWriteDeadline sets the deadline for future Write calls
+// and any currently-blocked Write call.
+// A zero value for t means Write will not time out.
 func (c *conn) SetWriteDeadline(t time.Time) error {
-	return errors.New("not supported")
+	return c.setDeadline(&c.wDeadline, t)
+}
+
+func (c *conn) setDeadline(deadline *int64, t time.Time) error {
+	if !c.ok() {
+		return syscall.EINVAL
+	}
+	var when int64
+	if !t.IsZero() {
+		when = t.UnixNano()
+	}
+	atomic.StoreInt64(deadline, when)
+	if when > 0 && c.w != nil {
+		c.schedule(when)
+	}
+	return nil
+}
+
+func (c *conn) expired(deadline *int64) bool {
+	when := atomic.LoadInt64(deadline)
+	return when > 0 && when <= time.Now().UnixNano()
+}
+
+// schedule adds a worker timer unless an earlier one is pending.
+func (c *conn) schedule(when int64) {
+	for {
+		pending := atomic.LoadInt64(&c.timer)
+		if pending > 0 && pending <= when {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&c.timer, pending, when) {
+			break
+		}
+	}
+	c.lock.Lock()
+	w := c.w
+	c.lock.Unlock()
+	w.addTimer(c, when)
+}
+
+// expire is called by the worker timer at when. It wakes a blocked Read,
+// and makes the worker serve the conn if its read deadline has passed
+// so that Handler.Serve gets the timeout error.
+func (c *conn) expire(when int64) {
+	atomic.CompareAndSwapInt64(&c.timer, when, 0)
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, deadline := range []int64{atomic.LoadInt64(&c.rDeadline), atomic.LoadInt64(&c.wDeadline)} {
+		if deadline > now {
+			c.schedule(deadline)
+		}
+	}
+	c.notify()
+	if atomic.LoadInt32(&c.ready) == 0 || !c.expired(&c.rDeadline) {
+		return
+	}
+	c.lock.Lock()
+	w := c.w
+	c.lock.Unlock()
+	c.wLock.Lock()
+	c.armWrite(w.poll)
+	c.wLock.Unlock()
+}
+
+// sockError returns the pending error of the socket, or EOF if there is none.
+func (c *conn) sockError() error {
+	if errno, err := syscall.GetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_ERROR); err == nil && errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return EOF
+}
+
+// blocking reports whether Read should wait for the fd to become readable.
+// The registered conn is looked up since Upgrade may wrap a copy of c.
+func (c *conn) blocking() bool {
+	if c.w == nil || c.readable == nil {
+		return false
+	}
+	c.w.lock.Lock()
+	registered, ok := c.w.conns[c.fd]
+	c.w.lock.Unlock()
+	return ok && atomic.LoadInt32(&registered.ready) == 0
+}
+
+func (c *conn) notify() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *conn) waitReadable() error {
+	c.armRead()
+	<-c.readable
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return EOF
+	}
+	if c.expired(&c.rDeadline) {
+		return ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// armRead arms the read events of the registered conn, which are disarmed
+// while it is upgrading until its Read waits for them.
+func (c *conn) armRead() {
+	c.w.lock.Lock()
+	registered, ok := c.w.conns[c.fd]
+	c.w.lock.Unlock()
+	if !ok {
+		return
+	}
+	registered.wLock.Lock()
+	atomic.StoreInt32(&registered.waiting, 1)
+	registered.arm()
+	registered.wLock.Unlock()
 }
 
 func (c *conn) ok() bool { return c != nil && c.fd > 0 && atomic.LoadInt32(&c.closed) == 0 }
@@ -674,11 +2499,22 @@ func (c *conn) ok() bool { return c != nil && c.fd > 0 && atomic.LoadInt32(&c.cl
 // SyscallConn returns a raw network connection.
 // This implements the syscall.Conn interface.
 func (c *conn) SyscallConn() (syscall.RawConn, error) {
+	c.readDirect()
 	return &rawConn{uintptr(c.fd), c}, nil
 }
 
 // ReadFrom implements the io.ReaderFrom ReadFrom method.
+// A *net.Buffers r is written by writev.
 func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	if bufs, ok := r.(*net.Buffers); ok {
+		n, err := c.WriteBuffers(*bufs)
+		rest, off := advance(*bufs, 0, int(n))
+		if len(rest) > 0 {
+			rest[0] = rest[0][off:]
+		}
+		*bufs = rest
+		return n, err
+	}
 	var remain int64
 	if lr, ok := r.(*io.LimitedReader); ok {
 		remain, r = lr.N, lr.R
@@ -686,7 +2522,10 @@ func (c *conn) ReadFrom(r io.Reader) (int64, error) {
 			return 0, nil
 		}
 	}
-	if syscallConn, ok := r.(syscall.Conn); ok {
+	if src, ok := r.(*conn); ok && !src.readDirect() {
+		return genericReadFrom(c, r, remain)
+	}
+	if syscallConn, ok := r.(syscall.Conn); ok && c.buffered() == 0 {
 		if src, ok := r.(net.Conn); ok {
 			if remain <= 0 {
 				remain = bufferSize
@@ -786,7 +2625,7 @@ type workers []*worker
 
 func (l workers) Len() int { return len(l) }
 func (l workers) Less(i, j int) bool {
-	return l[i].count < l[j].count
+	return atomic.LoadInt64(&l[i].count) < atomic.LoadInt64(&l[j].count)
 }
 func (l workers) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
 
@@ -797,6 +2636,19 @@ func minHeap(h workers) {
 	}
 }
 
+type timer struct {
+	conn *conn
+	when int64
+}
+
+type timers []*timer
+
+func (l timers) Len() int { return len(l) }
+func (l timers) Less(i, j int) bool {
+	return l[i].when < l[j].when
+}
+func (l timers) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
 type list []*conn
 
 func (l list) Len() int { return len(l) }
@@ -823,6 +2675,18 @@ func topK(h list, k int) {
 	}
 }
 
+// insertionSort sorts the short list l by score.
+func insertionSort(l list, descending bool) {
+	for i := 1; i < len(l); i++ {
+		for j := i; j > 0; j-- {
+			if descending && !l.Less(j-1, j) || !descending && !l.Less(j, j-1) {
+				break
+			}
+			l.Swap(j, j-1)
+		}
+	}
+}
+
 type sort interface {
 	// Len is the number of elements in the collection.
 	Len() int
@@ -833,6 +2697,17 @@ type sort interface {
 	Swap(i, j int)
 }
 
+func heapUp(h sort, j int) {
+	for {
+		i := (j - 1) / 2 // parent
+		if i == j || !h.Less(j, i) {
+			break
+		}
+		h.Swap(i, j)
+		j = i
+	}
+}
+
 func heapDown(h sort, i, n int) bool {
 	parent := i
 	for {
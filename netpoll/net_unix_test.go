@@ -1,11 +1,16 @@
 package netpoll
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -74,11 +79,11 @@ func TestServerPoll(t *testing.T) {
 		server.Serve(l)
 	}()
 	time.Sleep(time.Millisecond * 10)
-	server.accept()
+	server.listeners[0].accept()
 	time.Sleep(time.Millisecond * 10)
 	server.Close()
 	time.Sleep(time.Millisecond * 10)
-	server.accept()
+	server.listeners[0].accept()
 	time.Sleep(time.Millisecond * 10)
 	wg.Wait()
 }
@@ -453,6 +458,61 @@ func TestServerUpgrade(t *testing.T) {
 	wg.Wait()
 }
 
+func TestServerSlowUpgrade(t *testing.T) {
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+		handler := NewConHandler()
+		handler.SetUpgrade(func(c net.Conn) (Context, error) {
+			// Lets the request wait in the socket while upgrading.
+			time.Sleep(time.Millisecond * 200)
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			_, err = c.Write(buf[:n])
+			return c, err
+		}).SetServe(func(context Context) error {
+			_, err := context.(net.Conn).Read(make([]byte, 64))
+			return err
+		})
+		server := &Server{
+			Handler:  handler,
+			PollMode: mode,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := "Hello World"
+		conn.Write([]byte(msg))
+		buf := make([]byte, 64)
+		if n, err := conn.Read(buf); err != nil {
+			t.Error(mode, err)
+		} else if string(buf[:n]) != msg {
+			t.Error(mode, string(buf[:n]))
+		}
+		var events int64
+		for _, ws := range server.Stats().Workers {
+			events += ws.Events
+		}
+		if events > 10 {
+			t.Error(mode, events)
+		}
+		conn.Close()
+		server.Close()
+		wg.Wait()
+	}
+}
+
 func TestWorker(t *testing.T) {
 	var handler = &ConnHandler{}
 	server := &Server{
@@ -1077,3 +1137,2069 @@ func TestMinHeap(t *testing.T) {
 		}
 	}
 }
+
+func TestConnDeadline(t *testing.T) {
+	upgraded := make(chan error, 1)
+	var handler = NewHandler(func(c net.Conn) (Context, error) {
+		c.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+		_, err := c.Read(make([]byte, 64))
+		upgraded <- err
+		c.SetReadDeadline(time.Time{})
+		return c, nil
+	}, func(context Context) error {
+		_, err := context.(net.Conn).Read(make([]byte, 64))
+		return err
+	})
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	select {
+	case err := <-upgraded:
+		if err != ErrDeadlineExceeded {
+			t.Error(err)
+		} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout")
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestConnServeDeadline(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	handler.SetUpgrade(func(c net.Conn) (net.Conn, error) {
+		c.SetDeadline(time.Now().Add(time.Millisecond * 50))
+		return c, nil
+	})
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 64)); err != io.EOF {
+		t.Error(err)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestTimers(t *testing.T) {
+	var h timers
+	for _, when := range []int64{5, 3, 8, 1, 9, 2} {
+		h = append(h, &timer{when: when})
+		heapUp(h, len(h)-1)
+	}
+	var last int64
+	for len(h) > 0 {
+		if h[0].when < last {
+			t.Error(h[0].when, last)
+		}
+		last = h[0].when
+		n := len(h) - 1
+		h.Swap(0, n)
+		h = h[:n]
+		heapDown(h, 0, n)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	evicted := make(chan error, 1)
+	server := &Server{
+		Handler:     handler,
+		IdleTimeout: time.Millisecond * 50,
+		OnEvict: func(c net.Conn, err error) {
+			evicted <- err
+		},
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	msg := "Hello World"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Error(err)
+	}
+	buf := make([]byte, len(msg))
+	if n, err := conn.Read(buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != msg {
+		t.Error(string(buf[:n]))
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Error(err)
+	}
+	if err := <-evicted; err != ErrIdleTimeout {
+		t.Error(err)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	evicted := make(chan error, 1)
+	server := &Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Millisecond * 50,
+		OnEvict: func(c net.Conn, err error) {
+			evicted <- err
+		},
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(make([]byte, 64)); err != io.EOF {
+		t.Error(err)
+	}
+	if err := <-evicted; err != ErrReadHeaderTimeout {
+		t.Error(err)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestServerShutdown(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			time.Sleep(time.Millisecond * 100)
+			res = req
+			return
+		},
+	}
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := server.Serve(l); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	conn, _ := net.Dial(network, addr)
+	msg := "Hello World"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	buf := make([]byte, len(msg))
+	if n, err := conn.Read(buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != msg {
+		t.Error(string(buf[:n]))
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Error(err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+	if _, err := net.Dial(network, addr); err == nil {
+		t.Error("Unexpected")
+	}
+	conn.Close()
+	wg.Wait()
+}
+
+func TestServerCloseBeforeServe(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		server := &Server{Handler: &ConnHandler{}}
+		network := "tcp"
+		addr := ":9999"
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error, 1)
+		go func() {
+			served <- server.Serve(l)
+		}()
+		server.Close()
+		select {
+		case err := <-served:
+			if err != ErrServerClosed {
+				t.Error(err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("Serve did not return")
+		}
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			time.Sleep(time.Millisecond * 500)
+			res = req
+			return
+		},
+	}
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	conn.Write([]byte("Hello World"))
+	time.Sleep(time.Millisecond * 20)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	conn.Close()
+	wg.Wait()
+}
+
+func TestConnState(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	var lock sync.Mutex
+	var states []ConnState
+	closed := make(chan error, 1)
+	server := &Server{
+		Handler: handler,
+		ConnState: func(c net.Conn, state ConnState, err error) {
+			if c.RemoteAddr() == nil {
+				t.Error("nil RemoteAddr")
+			}
+			lock.Lock()
+			states = append(states, state)
+			lock.Unlock()
+			if state == StateClosed {
+				closed <- err
+			}
+		},
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	conn.Read(make([]byte, len(msg)))
+	conn.Close()
+	if err := <-closed; err != io.EOF {
+		t.Error(err)
+	}
+	lock.Lock()
+	if len(states) < 4 || states[0] != StateNew || states[1] != StateUpgraded ||
+		states[2] != StateActive || states[len(states)-1] != StateClosed {
+		t.Error(states)
+	}
+	lock.Unlock()
+	server.Close()
+	wg.Wait()
+	if StateRescheduled.String() != "rescheduled" {
+		t.Error(StateRescheduled.String())
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	rejected := make(chan error, 1)
+	server := &Server{
+		Handler:       handler,
+		MaxConns:      1,
+		MaxConnsPerIP: 1,
+		RejectPayload: []byte("busy"),
+		ConnState: func(c net.Conn, state ConnState, err error) {
+			if state == StateRejected {
+				rejected <- err
+			}
+		},
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	conn.Read(make([]byte, len(msg)))
+	if server.NumConns() != 1 {
+		t.Error(server.NumConns())
+	}
+	if server.NumConnsPerIP("127.0.0.1") != 1 {
+		t.Error(server.NumConnsPerIP("127.0.0.1"))
+	}
+	other, _ := net.Dial(network, addr)
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := ioutil.ReadAll(other); err != nil {
+		t.Error(err)
+	} else if string(b) != "busy" {
+		t.Error(string(b))
+	}
+	if err := <-rejected; err != ErrTooManyConns {
+		t.Error(err)
+	}
+	other.Close()
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestPauseOnLimit(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	server := &Server{
+		Handler:      handler,
+		MaxConns:     1,
+		PauseOnLimit: true,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	conn.Read(make([]byte, len(msg)))
+	other, _ := net.Dial(network, addr)
+	other.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	other.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, err := other.Read(buf); err == nil {
+		t.Error("Unexpected")
+	}
+	conn.Close()
+	other.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if n, err := other.Read(buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != msg {
+		t.Error(string(buf[:n]))
+	}
+	other.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestReusePort(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	network := "tcp"
+	addr := "127.0.0.1:9999"
+	server := &Server{
+		Network:         network,
+		Address:         addr,
+		Handler:         handler,
+		UnsharedWorkers: 2,
+		SharedWorkers:   2,
+		ReusePort:       2,
+		PinWorkers:      true,
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := server.ListenAndServe(); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := "Hello World"
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if n, err := conn.Read(buf); err != nil {
+			t.Error(err)
+		} else if string(buf[:n]) != msg {
+			t.Error(string(buf[:n]))
+		}
+		conn.Close()
+	}
+	if len(server.listeners) != 2 {
+		t.Error(len(server.listeners))
+	}
+	for _, ln := range server.listeners {
+		if len(ln.unshared) != 1 || len(ln.heap) != 1 {
+			t.Error(len(ln.unshared), len(ln.heap))
+		}
+	}
+	server.Close()
+	wg.Wait()
+}
+
+func TestServerPollMode(t *testing.T) {
+	for _, mode := range []PollMode{EdgeTriggered, OneShot} {
+		var handler = &DataHandler{
+			HandlerFunc: func(req []byte) (res []byte) {
+				res = req
+				return
+			},
+		}
+		server := &Server{
+			Handler:  handler,
+			PollMode: mode,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		conn, _ := net.Dial(network, addr)
+		for i := 0; i < 3; i++ {
+			msg := "Hello World"
+			conn.Write([]byte(msg))
+			buf := make([]byte, len(msg))
+			if n, err := conn.Read(buf); err != nil {
+				t.Error(err)
+			} else if string(buf[:n]) != msg {
+				t.Error(string(buf[:n]))
+			}
+		}
+		conn.Close()
+		server.Close()
+		wg.Wait()
+	}
+}
+
+type backpressureHandler struct {
+	*ConnHandler
+	paused chan bool
+}
+
+func (h *backpressureHandler) Backpressure(ctx Context, paused bool) {
+	h.paused <- paused
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	size := 32 << 20
+	written := make(chan error, 1)
+	handler := &backpressureHandler{ConnHandler: NewConHandler(), paused: make(chan bool, 2)}
+	handler.SetUpgrade(func(c net.Conn) (Context, error) {
+		return c, nil
+	}).SetServe(func(context Context) error {
+		c := context.(net.Conn)
+		buf := make([]byte, 64)
+		if _, err := c.Read(buf); err != nil {
+			return err
+		}
+		_, err := c.Write(make([]byte, size))
+		written <- err
+		return err
+	})
+	server := &Server{
+		Handler:            handler,
+		WriteHighWatermark: 1 << 20,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	conn.Write([]byte("Hello World"))
+	if err := <-written; err != nil {
+		t.Error(err)
+	}
+	if paused := <-handler.paused; !paused {
+		t.Error(paused)
+	}
+	n, err := io.ReadFull(conn, make([]byte, size))
+	if err != nil {
+		t.Error(err)
+	} else if n != size {
+		t.Error(n)
+	}
+	if paused := <-handler.paused; paused {
+		t.Error(paused)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestServerReadWriteEvent(t *testing.T) {
+	size := 8 << 20
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered} {
+		var started int32
+		handler := NewConHandler()
+		handler.SetUpgrade(func(c net.Conn) (Context, error) {
+			return c, nil
+		}).SetServe(func(context Context) error {
+			c := context.(net.Conn)
+			if _, err := c.Read(make([]byte, 64)); err != nil {
+				return err
+			}
+			if atomic.CompareAndSwapInt32(&started, 0, 1) {
+				_, err := c.Write(make([]byte, size))
+				return err
+			}
+			// Lets the client read and write before the next wait.
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+		server := &Server{
+			Handler:  handler,
+			PollMode: mode,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		conn, _ := net.Dial(network, addr)
+		conn.(*net.TCPConn).SetReadBuffer(64 << 10)
+		conn.Write([]byte("Hello World"))
+		// Sends a byte on every read, so that the read and write events
+		// of the server conn are reported together.
+		buf := make([]byte, 64<<10)
+		total := 0
+		for total < size {
+			conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Error(mode, total, err)
+				break
+			}
+			total += n
+			conn.Write([]byte{0})
+		}
+		conn.Close()
+		server.Close()
+		wg.Wait()
+	}
+}
+
+func TestMaxPendingBytes(t *testing.T) {
+	written := make(chan error, 1)
+	handler := NewConHandler()
+	handler.SetUpgrade(func(c net.Conn) (Context, error) {
+		return c, nil
+	}).SetServe(func(context Context) error {
+		c := context.(net.Conn)
+		if _, err := c.Read(make([]byte, 64)); err != nil {
+			return err
+		}
+		_, err := c.Write(make([]byte, 32<<20))
+		written <- err
+		return err
+	})
+	server := &Server{
+		Handler:         handler,
+		MaxPendingBytes: 1 << 20,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, _ := net.Dial(network, addr)
+	conn.Write([]byte("Hello World"))
+	if err := <-written; err != ErrPendingBytes {
+		t.Error(err)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestServerBackend(t *testing.T) {
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+		var handler = &DataHandler{
+			HandlerFunc: func(req []byte) (res []byte) {
+				res = req
+				return
+			},
+		}
+		server := &Server{
+			Handler:  handler,
+			PollMode: mode,
+			Backend:  IOURingBackend,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		for j := 0; j < 4; j++ {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				msg := "Hello World"
+				conn.Write([]byte(msg))
+				buf := make([]byte, len(msg))
+				if n, err := conn.Read(buf); err != nil {
+					t.Error(err)
+				} else if string(buf[:n]) != msg {
+					t.Error(string(buf[:n]))
+				}
+			}
+			conn.Close()
+		}
+		server.Close()
+		wg.Wait()
+	}
+}
+
+func TestServerBackendOps(t *testing.T) {
+	var registered atomic.Value
+	var ahead int32
+	var handler = &DataHandler{
+		NoShared:   true,
+		BufferSize: 4,
+		HandlerFunc: func(req []byte) (res []byte) {
+			if c, ok := registered.Load().(*conn); ok && atomic.LoadInt32(&c.unread) != 0 {
+				atomic.StoreInt32(&ahead, 1)
+			}
+			return req
+		},
+	}
+	handler.SetUpgrade(func(c net.Conn) (net.Conn, error) {
+		registered.Store(c)
+		return c, nil
+	})
+	server := &Server{
+		Handler: handler,
+		Backend: IOURingBackend,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "Hello World"
+	for i := 0; i < 8; i++ {
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Error(err)
+		} else if string(buf) != msg {
+			t.Error(string(buf))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if atomic.LoadInt32(&ahead) == 0 && server.workers[0].poll.Backend() == IOURingBackend {
+		t.Error("no bytes were read ahead")
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+type indexBalancer struct {
+	index int
+	calls int32
+}
+
+func (b *indexBalancer) Balance(c net.Conn, workers []WorkerInfo) int {
+	atomic.AddInt32(&b.calls, 1)
+	return b.index
+}
+
+func TestServerBalancer(t *testing.T) {
+	for _, b := range []*indexBalancer{{index: 1}, {index: -1}} {
+		var handler = &DataHandler{
+			HandlerFunc: func(req []byte) (res []byte) {
+				res = req
+				return
+			},
+		}
+		server := &Server{
+			Handler:         handler,
+			UnsharedWorkers: 2,
+			SharedWorkers:   2,
+			Balancer:        b,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		var conns []net.Conn
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := "Hello World"
+			conn.Write([]byte(msg))
+			buf := make([]byte, len(msg))
+			if n, err := conn.Read(buf); err != nil {
+				t.Error(err)
+			} else if string(buf[:n]) != msg {
+				t.Error(string(buf[:n]))
+			}
+			conns = append(conns, conn)
+		}
+		if atomic.LoadInt32(&b.calls) != 4 {
+			t.Error(b.calls)
+		}
+		if b.index == 1 && atomic.LoadInt64(&server.workers[1].count) != 4 {
+			t.Error(server.workers[1].count)
+		}
+		if b.index == -1 && atomic.LoadInt64(&server.workers[1].count) > 1 {
+			t.Error(server.workers[1].count)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		server.Close()
+		wg.Wait()
+	}
+}
+
+func TestServerBuiltinBalancers(t *testing.T) {
+	for _, b := range []Balancer{&RoundRobinBalancer{}, LeastConnectionsBalancer{}, SourceIPHashBalancer{}, LeastLoadBalancer{}} {
+		var handler = &DataHandler{
+			HandlerFunc: func(req []byte) (res []byte) {
+				res = req
+				return
+			},
+		}
+		server := &Server{
+			Handler:         handler,
+			UnsharedWorkers: 2,
+			SharedWorkers:   2,
+			Balancer:        b,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		var conns []net.Conn
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := "Hello World"
+			conn.Write([]byte(msg))
+			buf := make([]byte, len(msg))
+			if n, err := conn.Read(buf); err != nil {
+				t.Error(err)
+			} else if string(buf[:n]) != msg {
+				t.Error(string(buf[:n]))
+			}
+			conns = append(conns, conn)
+		}
+		if server.rescheduled {
+			t.Errorf("%T rescheduled", b)
+		}
+		switch b.(type) {
+		case *RoundRobinBalancer, LeastConnectionsBalancer:
+			for _, w := range server.workers {
+				if count := atomic.LoadInt64(&w.count); count != 1 {
+					t.Errorf("%T %d %d", b, w.index, count)
+				}
+			}
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		server.Close()
+		wg.Wait()
+	}
+}
+
+func TestWorkerMeasure(t *testing.T) {
+	w := &worker{server: &Server{rescheduler: &DefaultRescheduler{}}}
+	w.reads = 5
+	w.measure()
+	if w.load != 5 {
+		t.Error(w.load)
+	}
+	w.reads = 8
+	w.measure()
+	if w.load != 5 {
+		t.Error(w.load)
+	}
+	w.lastLoad = w.lastLoad.Add(-DefaultRescheduleInterval)
+	w.measure()
+	if w.load != 3 {
+		t.Error(w.load)
+	}
+	w.server.rescheduled = true
+	w.lastLoad = time.Time{}
+	w.measure()
+	if w.load != 3 {
+		t.Error(w.load)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	server := &Server{
+		Handler:         handler,
+		UnsharedWorkers: 1,
+		SharedWorkers:   1,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 3; j++ {
+			msg := "Hello World"
+			conn.Write([]byte(msg))
+			buf := make([]byte, len(msg))
+			if n, err := conn.Read(buf); err != nil {
+				t.Error(err)
+			} else if string(buf[:n]) != msg {
+				t.Error(string(buf[:n]))
+			}
+		}
+		conns = append(conns, conn)
+	}
+	stats := server.Stats()
+	if stats.Accepted != 2 || stats.Conns != 2 || stats.AcceptRate(nil) <= 0 {
+		t.Error(stats)
+	}
+	if len(stats.Workers) != 2 || stats.Workers[0].Shared || !stats.Workers[1].Shared {
+		t.Fatal(stats.Workers)
+	}
+	var events int64
+	for _, ws := range stats.Workers {
+		events += ws.Events
+		if ws.Conns > 0 && (!ws.Running || ws.Wakes < 1) {
+			t.Error(ws)
+		}
+	}
+	if events < 4 {
+		t.Error(events)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	time.Sleep(idleTime * 2)
+	prev := stats
+	stats = server.Stats()
+	if stats.Conns != 0 || stats.AcceptRate(&prev) != 0 || stats.AcceptRate(nil) <= 0 {
+		t.Error(stats)
+	}
+	for _, ws := range stats.Workers {
+		if ws.Running || ws.Wakes > 0 && ws.Sleeps < 1 {
+			t.Error(ws)
+		}
+	}
+	server.Close()
+	wg.Wait()
+}
+
+type countRescheduler struct {
+	DefaultRescheduler
+	scores int64
+}
+
+func (r *countRescheduler) Score(a *Activity) int64 {
+	atomic.AddInt64(&r.scores, 1)
+	return r.DefaultRescheduler.Score(a)
+}
+
+func TestRescheduler(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	rescheduler := &countRescheduler{DefaultRescheduler: DefaultRescheduler{
+		Period:     time.Millisecond * 10,
+		ByteWeight: 1,
+		MinGain:    1 << 40,
+	}}
+	server := &Server{
+		Handler:     handler,
+		Rescheduler: rescheduler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	connWG := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		connWG.Add(1)
+		go func(i int) {
+			defer connWG.Done()
+			conn, _ := net.Dial(network, addr)
+			msg := strings.Repeat("Hello World", 10*(i+1))
+			when := time.Now().Add(time.Millisecond * 300)
+			for time.Now().Before(when) {
+				conn.Write([]byte(msg))
+				buf := make([]byte, len(msg))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					t.Error(err)
+				} else if string(buf) != msg {
+					t.Error(string(buf))
+				}
+			}
+			conn.Close()
+		}(i)
+	}
+	connWG.Wait()
+	if atomic.LoadInt64(&rescheduler.scores) == 0 {
+		t.Error("no scores")
+	}
+	if n := server.Stats().Rescheduled; n != 0 {
+		t.Error(n)
+	}
+	server.Close()
+	wg.Wait()
+}
+
+func TestCPUAffinity(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	server := &Server{
+		Handler:          handler,
+		UnsharedWorkers:  2,
+		SharedWorkers:    2,
+		CPUAffinity:      true,
+		SteerIncomingCPU: true,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := "Hello World"
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if n, err := conn.Read(buf); err != nil {
+			t.Error(err)
+		} else if string(buf[:n]) != msg {
+			t.Error(string(buf[:n]))
+		}
+		conn.Close()
+	}
+	if description == "epoll" {
+		for _, w := range server.workers {
+			if w.cpu < 0 {
+				t.Error(w.index, w.cpu)
+			}
+		}
+	}
+	server.Close()
+	wg.Wait()
+}
+
+func TestDialer(t *testing.T) {
+	network := "tcp"
+	addr := ":9999"
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	data := make(chan []byte, 1)
+	server := &Server{}
+	dialer := &Dialer{Server: server, Timeout: time.Second}
+	if _, err := dialer.Dial(network, addr); err != ErrHandler {
+		t.Error(err)
+	}
+	dialer.Handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			data <- req
+			return
+		},
+	}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.LocalAddr() == nil || conn.RemoteAddr().String() != "127.0.0.1:9999" {
+		t.Error(conn.LocalAddr(), conn.RemoteAddr())
+	}
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	select {
+	case req := <-data:
+		if string(req) != msg {
+			t.Error(string(req))
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout")
+	}
+	if server.NumConns() != 0 {
+		t.Error(server.NumConns())
+	}
+	l.Close()
+	if _, err := dialer.Dial(network, addr); err == nil {
+		t.Error("expect an error")
+	} else if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "dial" {
+		t.Error(err)
+	}
+	server.Close()
+	if _, err := dialer.Dial(network, addr); err != ErrServerClosed {
+		t.Error(err)
+	}
+}
+
+func TestRestartContext(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Second, -1} {
+		server := &Server{RestartTimeout: timeout}
+		ctx, cancel := server.restartContext()
+		deadline, ok := ctx.Deadline()
+		switch {
+		case timeout < 0:
+			if ok {
+				t.Error(timeout, deadline)
+			}
+		case timeout == 0:
+			timeout = restartTimeout
+			fallthrough
+		default:
+			if d := time.Until(deadline); !ok || d > timeout || d < timeout-time.Second {
+				t.Error(timeout, d)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestDialerClose(t *testing.T) {
+	// The connects to a listener with a full backlog stay pending.
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := syscall.Getsockname(fd)
+	addr := (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*syscall.SockaddrInet4).Port}).String()
+	for i := 0; i < 2; i++ {
+		if conn, err := net.DialTimeout("tcp", addr, time.Millisecond*100); err == nil {
+			defer conn.Close()
+		}
+	}
+	server := &Server{}
+	dialer := &Dialer{Server: server, Handler: &DataHandler{}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := dialer.Dial("tcp", addr)
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	server.Close()
+	select {
+	case err := <-done:
+		if opErr, ok := err.(*net.OpError); !ok || opErr.Err != ErrServerClosed {
+			t.Error(err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("Dial blocked after Close")
+	}
+}
+
+func TestConnInfo(t *testing.T) {
+	infos := make(chan ConnInfo, 1)
+	handler := &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			res = req
+			return
+		},
+	}
+	handler.SetUpgrade(func(conn net.Conn) (net.Conn, error) {
+		info := conn.(ConnInfo)
+		info.SetValue("value")
+		infos <- info
+		return conn, nil
+	})
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	start := time.Now()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if n, err := conn.Read(buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != msg {
+		t.Error(string(buf[:n]))
+	}
+	info := <-infos
+	if info.ID() == 0 || info.Value() != "value" {
+		t.Error(info.ID(), info.Value())
+	}
+	if info.Created().Before(start.Add(-time.Second)) || info.Created().After(time.Now()) {
+		t.Error(info.Created())
+	}
+	if info.BytesRead() != int64(len(msg)) || info.BytesWritten() != int64(len(msg)) || info.Reads() < 1 {
+		t.Error(info.BytesRead(), info.BytesWritten(), info.Reads())
+	}
+	if index, _ := info.Worker(); index < 0 {
+		t.Error(index)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			if string(req) == "panic" {
+				panic("panic")
+			}
+			res = req
+			return
+		},
+	}
+	var panics int64
+	closed := make(chan error, 1)
+	server := &Server{
+		Handler:      handler,
+		RecoverPanic: true,
+		PanicHandler: func(c net.Conn, v interface{}, stack []byte) {
+			if v != "panic" || len(stack) == 0 {
+				t.Error(v, string(stack))
+			}
+			atomic.AddInt64(&panics, 1)
+		},
+		ConnState: func(c net.Conn, state ConnState, err error) {
+			if state == StateClosed {
+				closed <- err
+			}
+		},
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("panic"))
+	if _, err := conn.Read(make([]byte, 8)); err == nil {
+		t.Error("expect an error")
+	}
+	if err := <-closed; err != ErrPanic {
+		t.Error(err)
+	}
+	conn.Close()
+	if atomic.LoadInt64(&panics) != 1 || server.Stats().Panics != 1 {
+		t.Error(atomic.LoadInt64(&panics), server.Stats().Panics)
+	}
+	conn, err = net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if n, err := conn.Read(buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != msg {
+		t.Error(string(buf[:n]))
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestStrictPanic(t *testing.T) {
+	server := &Server{RecoverPanic: true, StrictPanic: true}
+	defer func() {
+		if p := recover(); p != "panic" {
+			t.Error(p)
+		}
+		if server.Stats().Panics != 1 {
+			t.Error(server.Stats().Panics)
+		}
+	}()
+	func() (err error) {
+		defer server.recoverPanic(&conn{}, &err)
+		panic("panic")
+	}()
+}
+
+func TestConnBuffers(t *testing.T) {
+	handler := NewHandler(func(conn net.Conn) (Context, error) {
+		return conn, nil
+	}, func(context Context) error {
+		conn := context.(net.Conn)
+		header, body := make([]byte, 2), make([]byte, 16)
+		n, err := conn.(BuffersReader).ReadBuffers([][]byte{header, body})
+		if err != nil {
+			return err
+		}
+		if n < 2 {
+			return EOF
+		}
+		bufs := net.Buffers{[]byte("<"), header, body[:n-2], []byte(">")}
+		_, err = conn.(io.ReaderFrom).ReadFrom(&bufs)
+		if len(bufs) != 0 {
+			t.Error(bufs)
+		}
+		return err
+	})
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	buf := make([]byte, len(msg)+2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+	} else if string(buf) != "<"+msg+">" {
+		t.Error(string(buf))
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestServerFrameHandler(t *testing.T) {
+	var handler = &FrameHandler{
+		Codec:      &VarintCodec{},
+		BufferSize: 16,
+		HandlerFunc: func(req []byte) (res []byte) {
+			return append([]byte("re:"), req...)
+		},
+	}
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := strings.Repeat("Hello World", 10)
+	var req, res []byte
+	for i := 0; i < 3; i++ {
+		req = handler.Codec.Encode(req, []byte(msg))
+		res = handler.Codec.Encode(res, []byte("re:"+msg))
+	}
+	conn.Write(req[:len(req)/2])
+	time.Sleep(time.Millisecond * 10)
+	conn.Write(req[len(req)/2:])
+	buf := make([]byte, len(res))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+	} else if string(buf) != string(res) {
+		t.Error(string(buf))
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestServerPush(t *testing.T) {
+	var ids = make(chan uint64, 2)
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			return req
+		},
+	}
+	server := &Server{
+		Handler: handler,
+		ConnState: func(c net.Conn, state ConnState, err error) {
+			if state == StateUpgraded {
+				ids <- c.(ConnInfo).ID()
+			}
+		},
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	var conns []net.Conn
+	var connIDs []uint64
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		connIDs = append(connIDs, <-ids)
+	}
+	read := func(conn net.Conn, msg string) {
+		buf := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Error(err)
+		} else if string(buf) != msg {
+			t.Error(string(buf))
+		}
+	}
+	var n int
+	server.RangeConns(func(c net.Conn) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Error(n)
+	}
+	if c, ok := server.Conn(connIDs[0]); !ok || c.(ConnInfo).ID() != connIDs[0] {
+		t.Error(c, ok)
+	}
+	if err := server.Push(connIDs[1], []byte("push")); err != nil {
+		t.Error(err)
+	}
+	read(conns[1], "push")
+	if n := server.Broadcast([]byte("broadcast")); n != 2 {
+		t.Error(n)
+	}
+	read(conns[0], "broadcast")
+	read(conns[1], "broadcast")
+	if err := server.Subscribe(connIDs[0], "topic"); err != nil {
+		t.Error(err)
+	}
+	if err := server.Subscribe(connIDs[1], "topic"); err != nil {
+		t.Error(err)
+	}
+	server.Unsubscribe(connIDs[1], "topic")
+	if n := server.Publish("topic", []byte("publish")); n != 1 {
+		t.Error(n)
+	}
+	read(conns[0], "publish")
+	conns[0].Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := server.Conn(connIDs[0]); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, ok := server.Conn(connIDs[0]); ok {
+		t.Error("the closed conn is not removed")
+	}
+	if n := server.Publish("topic", []byte("publish")); n != 0 {
+		t.Error(n)
+	}
+	if err := server.Push(connIDs[0], []byte("push")); err != ErrConnNotFound {
+		t.Error(err)
+	}
+	if err := server.Subscribe(connIDs[0], "topic"); err != ErrConnNotFound {
+		t.Error(err)
+	}
+	conns[1].Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestServerPushUpgrading(t *testing.T) {
+	var upgrading = make(chan net.Conn, 1)
+	var upgraded = make(chan struct{})
+	var handler = &ConnHandler{}
+	handler.SetUpgrade(func(conn net.Conn) (Context, error) {
+		upgrading <- conn
+		<-upgraded
+		return conn, nil
+	})
+	handler.SetServe(func(context Context) error {
+		conn := context.(net.Conn)
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(buf[:n])
+		return err
+	})
+	server := &Server{Handler: handler}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-upgrading
+	// The conn is not live until it is upgraded.
+	if n := server.Broadcast([]byte("broadcast")); n != 0 {
+		t.Error(n)
+	}
+	close(upgraded)
+	id := c.(ConnInfo).ID()
+	for i := 0; i < 100; i++ {
+		if _, ok := server.Conn(id); ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := server.Push(id, []byte("push")); err != nil {
+		t.Error(err)
+	}
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+	} else if string(buf) != "push" {
+		t.Error(string(buf))
+	}
+	c.Close()
+	if _, err := c.Write([]byte("closed")); err != ErrConnClosed {
+		t.Error(err)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestSocketOptions(t *testing.T) {
+	var conns = make(chan net.Conn, 1)
+	var handler = &DataHandler{
+		HandlerFunc: func(req []byte) (res []byte) {
+			return req
+		},
+	}
+	server := &Server{
+		Handler: handler,
+		SocketOptions: &SocketOptions{
+			NoDelay:           true,
+			KeepAlive:         time.Second * 30,
+			KeepAliveInterval: time.Second * 5,
+			KeepAliveCount:    3,
+			Linger:            time.Second,
+			ReadBuffer:        65536,
+			WriteBuffer:       65536,
+		},
+		ConnState: func(c net.Conn, state ConnState, err error) {
+			if state == StateNew {
+				conns <- c
+			}
+		},
+	}
+	if runtime.GOOS == "linux" {
+		server.SocketOptions.UserTimeout = time.Second * 10
+		server.SocketOptions.FastOpen = 16
+		server.SocketOptions.DeferAccept = time.Second
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	c := <-conns
+	rawConn, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConn.Control(func(fd uintptr) {
+		if v, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); err != nil || v == 0 {
+			t.Error(v, err)
+		}
+		if v, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); err != nil || v == 0 {
+			t.Error(v, err)
+		}
+		if v, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpKeepIdle); err != nil || v != 30 {
+			t.Error(v, err)
+		}
+		if v, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpKeepCnt); err != nil || v != 3 {
+			t.Error(v, err)
+		}
+		if runtime.GOOS == "linux" {
+			if v, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout); err != nil || v != 10000 {
+				t.Error(v, err)
+			}
+		}
+	})
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+	} else if string(buf) != msg {
+		t.Error(string(buf))
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	var handler = NewHandler(func(conn net.Conn) (Context, error) {
+		return conn, nil
+	}, func(context Context) error {
+		conn := context.(net.Conn)
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		conn.Write(buf[:n])
+		if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+			t.Error(err)
+		}
+		if _, err := conn.Write(buf[:n]); err != syscall.EPIPE {
+			t.Error(err)
+		}
+		return nil
+	})
+	server := &Server{
+		Handler: handler,
+	}
+	network := "tcp"
+	addr := ":9999"
+	l, _ := net.Listen(network, addr)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(l)
+	}()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "Hello World"
+	conn.Write([]byte(msg))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if data, err := ioutil.ReadAll(conn); err != nil {
+		t.Error(err)
+	} else if string(data) != msg {
+		t.Error(string(data))
+	}
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Error(err)
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestConnCloseRead(t *testing.T) {
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+		var handler = NewHandler(func(conn net.Conn) (Context, error) {
+			return conn, nil
+		}, func(context Context) error {
+			conn := context.(net.Conn)
+			buf := make([]byte, 1024)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			if err := conn.(interface{ CloseRead() error }).CloseRead(); err != nil {
+				t.Error(err)
+			}
+			go func() {
+				// The conn is still writable after the EOF of its reading side.
+				time.Sleep(time.Millisecond * 50)
+				if _, err := conn.Write(buf[:n]); err != nil {
+					t.Error(err)
+				}
+				conn.Close()
+			}()
+			return nil
+		})
+		server := &Server{
+			Handler:  handler,
+			PollMode: mode,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := "Hello World"
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if data, err := ioutil.ReadAll(conn); err != nil {
+			t.Error(mode, err)
+		} else if string(data) != msg {
+			t.Error(mode, string(data))
+		}
+		conn.Close()
+		server.Close()
+		wg.Wait()
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+		var handler = NewHandler(func(conn net.Conn) (Context, error) {
+			return conn, nil
+		}, func(context Context) error {
+			conn := context.(net.Conn)
+			buf := make([]byte, 1024)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			h := conn.(ConnInfo).ProxyHeader()
+			_, err = conn.Write([]byte(conn.RemoteAddr().String() + " " + h.ALPN() + " " + string(buf[:n])))
+			return err
+		})
+		server := &Server{
+			Handler:            handler,
+			ProxyProtocol:      true,
+			ProxyHeaderTimeout: time.Second,
+			PollMode:           mode,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		src := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+		dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+		header := proxyV2Header(src, dst, ProxyTLV{Type: ProxyTypeALPN, Value: []byte("h2")})
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Splits the header to be peeked more than once, while the worker
+		// does not spin on the incomplete header.
+		conn.Write(header[:10])
+		time.Sleep(time.Millisecond * 100)
+		conn.Write(append(header[10:], "Hello"...))
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := conn.Read(buf); err != nil {
+			t.Error(err)
+		} else if string(buf[:n]) != "10.0.0.1:1234 h2 Hello" {
+			t.Error(string(buf[:n]))
+		}
+		var events int64
+		for _, ws := range server.Stats().Workers {
+			events += ws.Events
+		}
+		if events > 10 {
+			t.Error(mode, events)
+		}
+		conn.Close()
+		conn, err = net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("Hello World"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(buf); err == nil {
+			t.Error("the conn without a header is not closed")
+		}
+		conn.Close()
+		server.Close()
+		wg.Wait()
+	}
+}
+
+func TestConnReadFromBuffers(t *testing.T) {
+	// Every write to a datagram socket sends a datagram, so that
+	// the buffers are received at once only if written by writev.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	c := &conn{fd: fds[0]}
+	defer c.Close()
+	bufs := net.Buffers{[]byte("<"), []byte("Hello"), []byte(" World"), []byte(">")}
+	if n, err := c.ReadFrom(&bufs); err != nil || n != 13 || len(bufs) != 0 {
+		t.Error(n, err, bufs)
+	}
+	buf := make([]byte, 64)
+	if n, err := syscall.Read(fds[1], buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != "<Hello World>" {
+		t.Error(string(buf[:n]))
+	}
+	if n, err := c.WriteBuffers([][]byte{[]byte("ab"), nil, []byte("c")}); err != nil || n != 3 {
+		t.Error(n, err)
+	}
+	if n, err := syscall.Read(fds[1], buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != "abc" {
+		t.Error(string(buf[:n]))
+	}
+}
+
+func TestServerDataHandlerMaxInFlight(t *testing.T) {
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+		var replies = make(chan func(res []byte), 1)
+		var handler = &DataHandler{
+			MaxInFlight: 1,
+			AsyncHandlerFunc: func(req []byte, reply func(res []byte)) {
+				if string(req) == "hold" {
+					replies <- reply
+					return
+				}
+				reply(req)
+			},
+		}
+		server := &Server{
+			Handler:         handler,
+			NoAsync:         true,
+			UnsharedWorkers: -1,
+			SharedWorkers:   1,
+			PollMode:        mode,
+		}
+		network := "tcp"
+		addr := ":9999"
+		l, _ := net.Listen(network, addr)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		var conns []net.Conn
+		buf := make([]byte, 8)
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first request is served by the upgrading goroutine.
+			conn.Write([]byte("ping"))
+			if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		time.Sleep(time.Millisecond * 10)
+		conn, other := conns[0], conns[1]
+		conn.Write([]byte("hold"))
+		reply := <-replies
+		// The second request waits for the first one to be replied.
+		conn.Write([]byte("next"))
+		time.Sleep(time.Millisecond * 10)
+		// The worker still serves another conn.
+		other.SetReadDeadline(time.Now().Add(time.Second))
+		other.Write([]byte("pong"))
+		if n, err := other.Read(buf); err != nil {
+			t.Error(err)
+		} else if string(buf[:n]) != "pong" {
+			t.Error(string(buf[:n]))
+		}
+		reply([]byte("hold"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Error(err)
+		} else if string(buf) != "holdnext" {
+			t.Error(string(buf))
+		}
+		conn.Close()
+		other.Close()
+		server.Close()
+		wg.Wait()
+		if !handler.closed {
+			t.Error("the handler is not closed")
+		}
+	}
+}
+
+type closerHandler struct {
+	ConnHandler
+	closed int32
+}
+
+func (h *closerHandler) Close() error {
+	atomic.StoreInt32(&h.closed, 1)
+	return nil
+}
+
+func TestServerCloseHandler(t *testing.T) {
+	var closer = &closerHandler{}
+	var handler = &DataHandler{
+		AsyncHandlerFunc: func(req []byte, reply func(res []byte)) {
+			reply(req)
+		},
+	}
+	var servers []*Server
+	wg := sync.WaitGroup{}
+	for _, h := range []Handler{closer, handler, handler} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{Handler: h}
+		servers = append(servers, server)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(l)
+		}()
+		if h == handler {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			conn.Write([]byte("ping"))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Error(err)
+			}
+			conn.Close()
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	servers[0].Close()
+	if atomic.LoadInt32(&closer.closed) != 0 {
+		t.Error("the Closer of the user is closed")
+	}
+	// The DataHandler is still served by the other Server.
+	servers[1].Close()
+	handler.lock.Lock()
+	closed := handler.closed
+	handler.lock.Unlock()
+	if closed {
+		t.Error("the shared handler is closed")
+	}
+	servers[2].Close()
+	handler.lock.Lock()
+	closed = handler.closed
+	handler.lock.Unlock()
+	if !closed {
+		t.Error("the handler is not closed")
+	}
+	wg.Wait()
+}
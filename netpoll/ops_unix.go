@@ -0,0 +1,40 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"syscall"
+)
+
+// performOps performs the operations one by one with the syscalls.
+func performOps(ops []Op) {
+	for i := range ops {
+		op := &ops[i]
+		op.N, op.Addr, op.Err = 0, nil, nil
+		switch op.Kind {
+		case OpAccept:
+			nfd, sa, err := syscall.Accept(op.Fd)
+			if err != nil {
+				op.Err = err
+				break
+			}
+			syscall.CloseOnExec(nfd)
+			if err = syscall.SetNonblock(nfd, true); err != nil {
+				syscall.Close(nfd)
+				op.Err = err
+				break
+			}
+			op.N, op.Addr = nfd, sa
+		case OpRead:
+			op.N, op.Err = syscall.Read(op.Fd, op.Buf)
+		case OpWrite:
+			op.N, op.Err = syscall.Write(op.Fd, op.Buf)
+		default:
+			op.Err = syscall.EINVAL
+		}
+		if op.N < 0 {
+			op.N = 0
+		}
+	}
+}
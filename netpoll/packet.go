@@ -0,0 +1,46 @@
+package netpoll
+
+import (
+	"net"
+
+	"github.com/php2go/netpollmux/internal/buffer"
+)
+
+// defaultBatchSize is the default number of datagrams read or written
+// by a single system call.
+const defaultBatchSize = 64
+
+// PacketWriter writes the replies of a PacketHandler.
+type PacketWriter interface {
+	// WriteTo writes the datagram b to the addr.
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+// PacketHandler responds to a single datagram.
+type PacketHandler interface {
+	// ServePacket serves the payload p received from the addr. The payload
+	// is only valid until ServePacket returns.
+	ServePacket(w PacketWriter, p []byte, addr net.Addr)
+}
+
+// PacketHandlerFunc is an adapter to allow the use of ordinary functions as PacketHandler.
+type PacketHandlerFunc func(w PacketWriter, p []byte, addr net.Addr)
+
+// ServePacket calls f(w, p, addr).
+func (f PacketHandlerFunc) ServePacket(w PacketWriter, p []byte, addr net.Addr) {
+	f(w, p, addr)
+}
+
+// servePacketConn serves the datagrams of c by the handler until an error.
+func servePacketConn(handler PacketHandler, c net.PacketConn, bufferSize int) error {
+	pool := buffer.AssignPool(bufferSize)
+	buf := pool.GetBufferSize(bufferSize)
+	defer pool.PutBuffer(buf)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		handler.ServePacket(c, buf[:n], addr)
+	}
+}
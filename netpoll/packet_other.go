@@ -0,0 +1,78 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package netpoll
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// PacketServer defines parameters for serving datagrams.
+type PacketServer struct {
+	Network string
+	Address string
+	// Handler responds to a single datagram.
+	Handler PacketHandler
+	// ReusePort do not work for consisted with other system.
+	ReusePort int
+	// BatchSize do not work for consisted with other system.
+	BatchSize int
+	// BufferSize is the size of the buffer receiving the datagrams.
+	// If zero, 64KB is used.
+	BufferSize int
+	// Backend do not work for consisted with other system.
+	Backend Backend
+	conn    net.PacketConn
+	closed  int32
+}
+
+// ListenAndServe listens on the network address and then calls
+// Serve to handle the incoming datagrams.
+//
+// ListenAndServe always returns a non-nil error.
+// After Close the returned error is ErrServerClosed.
+func (s *PacketServer) ListenAndServe() error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return ErrServerClosed
+	}
+	c, err := net.ListenPacket(s.Network, s.Address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(c)
+}
+
+// Serve reads the datagrams of the conn c by a goroutine,
+// and calls the Handler to reply to them.
+//
+// Serve always returns a non-nil error.
+// After Close the returned error is ErrServerClosed.
+func (s *PacketServer) Serve(c net.PacketConn) error {
+	if c == nil {
+		return ErrListener
+	}
+	if s.Handler == nil {
+		return ErrHandler
+	}
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return ErrServerClosed
+	}
+	if s.BufferSize < 1 {
+		s.BufferSize = bufferSize
+	}
+	s.conn = c
+	err := servePacketConn(s.Handler, c, s.BufferSize)
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Close closes the conn of the server.
+func (s *PacketServer) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) || s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,116 @@
+package netpoll
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testPacketServer(t *testing.T, server *PacketServer, dial func() (net.Conn, error)) {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := server.ListenAndServe(); err != ErrServerClosed {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(time.Millisecond * 10)
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 128; i++ {
+		msg := "Hello World"
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		if n, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != msg {
+			t.Error(string(buf[:n]))
+		}
+	}
+	conn.Close()
+	server.Close()
+	wg.Wait()
+	if err := server.ListenAndServe(); err != ErrServerClosed {
+		t.Error(err)
+	}
+}
+
+func echoPacketHandler() PacketHandler {
+	return PacketHandlerFunc(func(w PacketWriter, p []byte, addr net.Addr) {
+		w.WriteTo(p, addr)
+	})
+}
+
+func TestPacketServerUDP(t *testing.T) {
+	server := &PacketServer{
+		Network:   "udp",
+		Address:   "127.0.0.1:9999",
+		Handler:   echoPacketHandler(),
+		ReusePort: 2,
+		BatchSize: 8,
+	}
+	testPacketServer(t, server, func() (net.Conn, error) {
+		return net.Dial("udp", "127.0.0.1:9999")
+	})
+}
+
+func TestPacketServerUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "server.sock")
+	server := &PacketServer{
+		Network: "unixgram",
+		Address: addr,
+		Handler: echoPacketHandler(),
+	}
+	testPacketServer(t, server, func() (net.Conn, error) {
+		return net.DialUnix("unixgram",
+			&net.UnixAddr{Net: "unixgram", Name: filepath.Join(dir, "client.sock")},
+			&net.UnixAddr{Net: "unixgram", Name: addr})
+	})
+}
+
+func TestPacketServerAsyncReply(t *testing.T) {
+	server := &PacketServer{
+		Network: "udp",
+		Address: "127.0.0.1:9999",
+		Handler: PacketHandlerFunc(func(w PacketWriter, p []byte, addr net.Addr) {
+			reply := append([]byte{}, p...)
+			go func() {
+				time.Sleep(time.Millisecond)
+				w.WriteTo(reply, addr)
+			}()
+		}),
+	}
+	testPacketServer(t, server, func() (net.Conn, error) {
+		return net.Dial("udp", "127.0.0.1:9999")
+	})
+}
+
+func TestPacketServerNil(t *testing.T) {
+	server := &PacketServer{}
+	if err := server.Serve(nil); err != ErrListener {
+		t.Error(err)
+	}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := server.Serve(c); err != ErrHandler {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,433 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/php2go/netpollmux/internal/buffer"
+)
+
+// PacketServer defines parameters for serving datagrams.
+type PacketServer struct {
+	Network string
+	Address string
+	// Handler responds to a single datagram.
+	Handler PacketHandler
+	// ReusePort is the number of SO_REUSEPORT sockets opened by
+	// ListenAndServe on a UDP address, each served by its own worker.
+	// If less than 2, ListenAndServe opens a single socket.
+	ReusePort int
+	// BatchSize is the maximum number of datagrams read or written by
+	// a single system call. If zero, 64 is used.
+	BatchSize int
+	// BufferSize is the size of the buffers receiving the datagrams.
+	// The longer datagrams are truncated. If zero, 64KB is used.
+	BufferSize int
+	// Backend is the kernel interface of the worker polls.
+	Backend Backend
+
+	conn    net.PacketConn
+	lock    sync.Mutex
+	workers []*packetWorker
+	wg      sync.WaitGroup
+	closed  int32
+}
+
+type packetMsg struct {
+	buf  []byte
+	n    int
+	addr syscall.Sockaddr
+}
+
+type packetWorker struct {
+	server  *PacketServer
+	file    *os.File
+	fd      int
+	family  int
+	network string
+	poll    *Poll
+	mmsg    *mmsg
+	// out sends the pending datagrams apart from mmsg, as they may be
+	// flushed outside the read loop.
+	out     *mmsg
+	pool    *buffer.Pool
+	msgs    []packetMsg
+	lock    sync.Mutex
+	pending []packetMsg
+	writing bool
+	// reading is set while the read loop serves the received datagrams.
+	reading bool
+}
+
+// ListenAndServe listens on the network address and then calls
+// Serve to handle the incoming datagrams.
+//
+// ListenAndServe always returns a non-nil error.
+// After Close the returned error is ErrServerClosed.
+func (s *PacketServer) ListenAndServe() error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return ErrServerClosed
+	}
+	n := 1
+	if s.ReusePort > 1 && strings.HasPrefix(s.Network, "udp") {
+		n = s.ReusePort
+	}
+	cs, err := listenPacket(s.Network, s.Address, n)
+	if err != nil {
+		return err
+	}
+	return s.serve(cs)
+}
+
+// listenPacket opens n sockets on the same address, with SO_REUSEPORT
+// if n is greater than 1.
+func listenPacket(network, address string, n int) ([]net.PacketConn, error) {
+	var lc net.ListenConfig
+	if n > 1 {
+		lc.Control = func(network, address string, c syscall.RawConn) (err error) {
+			c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			return
+		}
+	}
+	var cs []net.PacketConn
+	for i := 0; i < n; i++ {
+		c, err := lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			for _, c := range cs {
+				c.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			address = c.LocalAddr().String()
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// Serve reads the datagrams of the conn c in batches by a worker,
+// and calls the Handler to reply to them. The conn c should be a
+// *net.UDPConn or a *net.UnixConn, otherwise it is served by a goroutine.
+//
+// Serve always returns a non-nil error.
+// After Close the returned error is ErrServerClosed.
+func (s *PacketServer) Serve(c net.PacketConn) error {
+	return s.serve([]net.PacketConn{c})
+}
+
+func (s *PacketServer) serve(cs []net.PacketConn) (err error) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return ErrServerClosed
+	}
+	for _, c := range cs {
+		if c == nil {
+			return ErrListener
+		}
+	}
+	if s.Handler == nil {
+		return ErrHandler
+	}
+	if s.BufferSize < 1 {
+		s.BufferSize = bufferSize
+	}
+	if s.BatchSize < 1 {
+		s.BatchSize = defaultBatchSize
+	}
+	if len(cs) == 1 {
+		switch cs[0].(type) {
+		case *net.UDPConn, *net.UnixConn:
+		default:
+			s.lock.Lock()
+			s.conn = cs[0]
+			s.lock.Unlock()
+			err = servePacketConn(s.Handler, cs[0], s.BufferSize)
+			if atomic.LoadInt32(&s.closed) != 0 {
+				return ErrServerClosed
+			}
+			return err
+		}
+	}
+	var workers []*packetWorker
+	for i, c := range cs {
+		var w *packetWorker
+		if w, err = s.newWorker(c); err != nil {
+			for _, c := range cs[i+1:] {
+				c.Close()
+			}
+			for _, w := range workers {
+				w.close()
+			}
+			return err
+		}
+		workers = append(workers, w)
+	}
+	s.lock.Lock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		s.lock.Unlock()
+		for _, w := range workers {
+			w.close()
+		}
+		return ErrServerClosed
+	}
+	s.workers = append(s.workers, workers...)
+	s.lock.Unlock()
+	errs := make(chan error, len(workers))
+	for _, w := range workers {
+		s.wg.Add(1)
+		go func(w *packetWorker) {
+			defer s.wg.Done()
+			errs <- w.run()
+		}(w)
+	}
+	s.wg.Wait()
+	err = <-errs
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return ErrServerClosed
+	}
+	return err
+}
+
+func (s *PacketServer) newWorker(c net.PacketConn) (w *packetWorker, err error) {
+	var file *os.File
+	switch packetConn := c.(type) {
+	case *net.UDPConn:
+		file, err = packetConn.File()
+	case *net.UnixConn:
+		file, err = packetConn.File()
+	default:
+		err = ErrListener
+	}
+	network := c.LocalAddr().Network()
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+	w = &packetWorker{
+		server:  s,
+		file:    file,
+		fd:      int(file.Fd()),
+		network: network,
+		mmsg:    newMmsg(s.BatchSize),
+		out:     newMmsg(s.BatchSize),
+		pool:    buffer.AssignPool(s.BufferSize),
+		msgs:    make([]packetMsg, s.BatchSize),
+	}
+	if sa, err := syscall.Getsockname(w.fd); err == nil {
+		switch sa.(type) {
+		case *syscall.SockaddrInet4:
+			w.family = syscall.AF_INET
+		case *syscall.SockaddrInet6:
+			w.family = syscall.AF_INET6
+		case *syscall.SockaddrUnix:
+			w.family = syscall.AF_UNIX
+		}
+	}
+	if err = syscall.SetNonblock(w.fd, true); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if w.poll, err = CreateBackend(s.Backend); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.poll.Register(w.fd)
+	return w, nil
+}
+
+// Close closes the sockets of the server.
+func (s *PacketServer) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	for _, w := range s.workers {
+		if e := w.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (w *packetWorker) close() error {
+	err := w.poll.Close()
+	if e := w.file.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (w *packetWorker) run() (err error) {
+	var n int
+	var events = make([]Event, 1)
+	for err == nil {
+		if n, err = w.poll.Wait(events); n > 0 {
+			if events[0].Mode&WRITE != 0 {
+				w.flush()
+			}
+			if events[0].Mode&^WRITE != 0 {
+				w.read()
+			}
+		}
+	}
+	w.lock.Lock()
+	w.free(w.pending)
+	w.pending = nil
+	w.lock.Unlock()
+	return err
+}
+
+// read serves the received datagrams in batches until there are none.
+func (w *packetWorker) read() {
+	for i := range w.msgs {
+		w.msgs[i].buf = w.pool.GetBufferSize(w.server.BufferSize)
+	}
+	w.lock.Lock()
+	w.reading = true
+	w.lock.Unlock()
+	defer func() {
+		w.lock.Lock()
+		w.reading = false
+		w.lock.Unlock()
+		// Sends the datagrams written outside the loop after its last flush.
+		w.flush()
+		for i := range w.msgs {
+			w.pool.PutBuffer(w.msgs[i].buf)
+			w.msgs[i] = packetMsg{}
+		}
+	}()
+	for {
+		n, err := w.mmsg.recv(w.fd, w.msgs)
+		for i := 0; i < n; i++ {
+			m := &w.msgs[i]
+			w.server.Handler.ServePacket(w, m.buf[:m.n], packetAddr(w.network, m.addr))
+			m.addr = nil
+		}
+		w.flush()
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+// WriteTo implements the PacketWriter WriteTo method. The datagram is
+// copied and sent in a batch after the received datagrams are served,
+// or at once if it is written outside the read loop.
+func (w *packetWorker) WriteTo(b []byte, addr net.Addr) (int, error) {
+	sa, err := packetSockaddr(addr, w.family)
+	if err != nil {
+		return 0, err
+	}
+	buf := buffer.GetBuffer(len(b))
+	copy(buf, b)
+	w.lock.Lock()
+	w.pending = append(w.pending, packetMsg{buf: buf, n: len(b), addr: sa})
+	flush := (len(w.pending) >= w.server.BatchSize || !w.reading) && !w.writing
+	w.lock.Unlock()
+	if flush {
+		w.flush()
+	}
+	return len(b), nil
+}
+
+// flush sends the pending datagrams. The datagrams failing to be sent
+// are dropped, and the rest is sent when the socket is writable again.
+func (w *packetWorker) flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for len(w.pending) > 0 {
+		msgs := w.pending
+		if len(msgs) > w.server.BatchSize {
+			msgs = msgs[:w.server.BatchSize]
+		}
+		n, err := w.out.send(w.fd, msgs)
+		if n <= 0 {
+			if err == syscall.EAGAIN {
+				// Arms the write event on every EAGAIN, as the previous one
+				// may have been reported without the pending being drained.
+				w.writing = true
+				w.poll.Write(w.fd)
+				return
+			}
+			n = 1
+		}
+		w.free(w.pending[:n])
+		w.pending = w.pending[n:]
+	}
+	w.pending = nil
+	if w.writing {
+		// Stops the write events, as the pending has been drained.
+		w.writing = false
+		w.poll.Resume(w.fd)
+	}
+}
+
+func (w *packetWorker) free(msgs []packetMsg) {
+	for i := range msgs {
+		buffer.PutBuffer(msgs[i].buf)
+		msgs[i] = packetMsg{}
+	}
+}
+
+// packetAddr returns the net.Addr of the socket address sa.
+func packetAddr(network string, sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{IP: append([]byte{}, sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		var zone string
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				zone = ifi.Name
+			}
+		}
+		return &net.UDPAddr{IP: append([]byte{}, sa.Addr[:]...), Port: sa.Port, Zone: zone}
+	case *syscall.SockaddrUnix:
+		if sa.Name != "" {
+			return &net.UnixAddr{Net: network, Name: sa.Name}
+		}
+	}
+	return nil
+}
+
+// packetSockaddr returns the socket address of addr for a socket of the family.
+func packetSockaddr(addr net.Addr, family int) (syscall.Sockaddr, error) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		if ip4 := addr.IP.To4(); ip4 != nil && family == syscall.AF_INET {
+			sa := &syscall.SockaddrInet4{Port: addr.Port}
+			copy(sa.Addr[:], ip4)
+			return sa, nil
+		}
+		if family == syscall.AF_INET6 {
+			sa := &syscall.SockaddrInet6{Port: addr.Port}
+			copy(sa.Addr[:], addr.IP.To16())
+			if addr.Zone != "" {
+				if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+					sa.ZoneId = uint32(ifi.Index)
+				}
+			}
+			return sa, nil
+		}
+	case *net.UnixAddr:
+		if family == syscall.AF_UNIX {
+			return &syscall.SockaddrUnix{Name: addr.Name}, nil
+		}
+	}
+	return nil, syscall.EAFNOSUPPORT
+}
@@ -1,5 +1,9 @@
 package netpoll
 
+import (
+	"syscall"
+)
+
 // Mode represents the read/write mode.
 type Mode int
 
@@ -8,6 +12,24 @@ const (
 	READ Mode = 1 << iota
 	// WRITE is the write mode.
 	WRITE
+	// HUP is set when the peer has closed the connection or shut down its
+	// writing half. It may be set along with READ if there is data left.
+	HUP
+	// ERROR is set when an error has occurred on the file descriptor.
+	ERROR
+)
+
+// PollMode represents the trigger mode of the poll.
+type PollMode int
+
+const (
+	// LevelTriggered reports an event as long as the file descriptor is ready.
+	LevelTriggered PollMode = iota
+	// EdgeTriggered reports an event only when the file descriptor becomes ready.
+	EdgeTriggered
+	// OneShot reports an event once and then disables the file descriptor
+	// until it is rearmed by Rearm.
+	OneShot
 )
 
 // Event represents the poll event for the poller.
@@ -17,3 +39,47 @@ type Event struct {
 	// Mode represents the event mode.
 	Mode Mode
 }
+
+// Backend represents the kernel interface used by the poll.
+type Backend int
+
+const (
+	// DefaultBackend is epoll on Linux and kqueue on BSD.
+	DefaultBackend Backend = iota
+	// IOURingBackend is io_uring on Linux. The readiness of the file
+	// descriptors is polled by IORING_OP_POLL_ADD requests, which are
+	// submitted in batches by Wait, and the operations of Submit are
+	// submitted in batches of accept, read and write requests. CreateBackend
+	// falls back to DefaultBackend when the kernel lacks support or on
+	// other systems.
+	IOURingBackend
+)
+
+// OpKind represents the kind of an I/O operation.
+type OpKind int
+
+const (
+	// OpAccept accepts a conn on the listening socket Fd. The accepted fd
+	// is non-blocking and close-on-exec.
+	OpAccept OpKind = iota + 1
+	// OpRead reads from Fd into Buf.
+	OpRead
+	// OpWrite writes Buf to Fd.
+	OpWrite
+)
+
+// Op represents an I/O operation performed by Submit.
+type Op struct {
+	// Kind is the kind of the operation.
+	Kind OpKind
+	// Fd is the file descriptor of the operation.
+	Fd int
+	// Buf is the buffer read into or written.
+	Buf []byte
+	// N is the number of the bytes read or written, or the accepted fd.
+	N int
+	// Addr is the remote address of the accepted fd.
+	Addr syscall.Sockaddr
+	// Err is the error of the operation, as EAGAIN if Fd is not ready.
+	Err error
+}
@@ -22,6 +22,7 @@ type Poll struct {
 	events  []syscall.Kevent_t
 	pool    *sync.Pool
 	timeout *syscall.Timespec
+	mode    PollMode
 }
 
 // Create creates a new poll.
@@ -40,6 +41,17 @@ func Create() (*Poll, error) {
 	}, nil
 }
 
+// CreateBackend creates a new poll. The backend falls back to DefaultBackend
+// for consisted with other system.
+func CreateBackend(backend Backend) (*Poll, error) {
+	return Create()
+}
+
+// Backend returns the backend of the poll.
+func (p *Poll) Backend() Backend {
+	return DefaultBackend
+}
+
 // SetTimeout sets the wait timeout.
 func (p *Poll) SetTimeout(d time.Duration) (err error) {
 	if d < time.Millisecond {
@@ -50,10 +62,26 @@ func (p *Poll) SetTimeout(d time.Duration) (err error) {
 	return nil
 }
 
+// SetMode sets the trigger mode of the file descriptors registered later.
+func (p *Poll) SetMode(mode PollMode) error {
+	switch mode {
+	case LevelTriggered, EdgeTriggered, OneShot:
+		p.mode = mode
+		return nil
+	}
+	return ErrPollMode
+}
+
 // Register registers a file descriptor.
 func (p *Poll) Register(fd int) (err error) {
 	changes := p.pool.Get().([]syscall.Kevent_t)
 	changes[0].Ident, changes[0].Flags = uint64(fd), syscall.EV_ADD
+	switch p.mode {
+	case EdgeTriggered:
+		changes[0].Flags |= syscall.EV_CLEAR
+	case OneShot:
+		changes[0].Flags |= syscall.EV_ONESHOT
+	}
 	_, err = syscall.Kevent(p.fd, changes[:1], nil, nil)
 	p.pool.Put(changes)
 	return
@@ -62,22 +90,80 @@ func (p *Poll) Register(fd int) (err error) {
 // Write adds a write event.
 func (p *Poll) Write(fd int) (err error) {
 	changes := p.pool.Get().([]syscall.Kevent_t)
-	changes[1].Ident, changes[1].Flags = uint64(fd), syscall.EV_ADD
+	changes[1].Ident, changes[1].Flags = uint64(fd), syscall.EV_ADD|syscall.EV_ONESHOT
 	_, err = syscall.Kevent(p.fd, changes[1:], nil, nil)
 	p.pool.Put(changes)
 	return
 }
 
+// Pause stops reporting the read events of a file descriptor
+// and adds a write event.
+func (p *Poll) Pause(fd int) (err error) {
+	changes := p.pool.Get().([]syscall.Kevent_t)
+	changes[0].Ident, changes[0].Flags = uint64(fd), syscall.EV_DELETE
+	changes[1].Ident, changes[1].Flags = uint64(fd), syscall.EV_ADD|syscall.EV_ONESHOT
+	err = p.control(changes)
+	p.pool.Put(changes)
+	return
+}
+
+// Suspend stops reporting the read events of a file descriptor
+// without adding a write event.
+func (p *Poll) Suspend(fd int) (err error) {
+	changes := p.pool.Get().([]syscall.Kevent_t)
+	changes[0].Ident, changes[0].Flags = uint64(fd), syscall.EV_DELETE
+	err = p.control(changes[:1])
+	p.pool.Put(changes)
+	return
+}
+
+// Resume reports the read events of a paused file descriptor again.
+func (p *Poll) Resume(fd int) (err error) {
+	return p.Register(fd)
+}
+
+// Rearm enables a file descriptor again after its event has been reported
+// in OneShot mode.
+func (p *Poll) Rearm(fd int) (err error) {
+	if p.mode != OneShot {
+		return nil
+	}
+	return p.Register(fd)
+}
+
 // Unregister unregisters a file descriptor.
 func (p *Poll) Unregister(fd int) (err error) {
 	changes := p.pool.Get().([]syscall.Kevent_t)
 	changes[0].Ident, changes[0].Flags = uint64(fd), syscall.EV_DELETE
 	changes[1].Ident, changes[1].Flags = uint64(fd), syscall.EV_DELETE
-	_, err = syscall.Kevent(p.fd, changes, nil, nil)
+	err = p.control(changes)
 	p.pool.Put(changes)
 	return
 }
 
+// control applies the changes one by one, so that a failing change does not
+// drop the others. Deleting a filter that is already gone, as a paused read
+// or a reported oneshot filter, is not an error.
+func (p *Poll) control(changes []syscall.Kevent_t) (err error) {
+	for i := range changes {
+		_, e := syscall.Kevent(p.fd, changes[i:i+1], nil, nil)
+		if e == syscall.ENOENT && changes[i].Flags&syscall.EV_DELETE != 0 {
+			continue
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Submit performs the operations one by one, and sets their results.
+// It returns an error only if they cannot be submitted.
+func (p *Poll) Submit(ops []Op) error {
+	performOps(ops)
+	return nil
+}
+
 // Wait waits events.
 func (p *Poll) Wait(events []Event) (n int, err error) {
 	if cap(p.events) >= len(events) {
@@ -95,15 +181,20 @@ func (p *Poll) Wait(events []Event) (n int, err error) {
 	for i := 0; i < n; i++ {
 		ev := p.events[i]
 		events[i].Fd = int(ev.Ident)
+		events[i].Mode = 0
 		switch ev.Filter {
 		case syscall.EVFILT_READ:
-			events[i].Mode = READ
+			if ev.Data > 0 || ev.Flags&syscall.EV_EOF == 0 {
+				events[i].Mode = READ
+			}
 		case syscall.EVFILT_WRITE:
 			events[i].Mode = WRITE
-			changes := p.pool.Get().([]syscall.Kevent_t)
-			changes[1].Ident, changes[1].Flags = ev.Ident, syscall.EV_DELETE
-			syscall.Kevent(p.fd, changes[1:], nil, nil)
-			p.pool.Put(changes)
+		}
+		if ev.Flags&syscall.EV_EOF != 0 {
+			events[i].Mode |= HUP
+		}
+		if ev.Flags&syscall.EV_ERROR != 0 {
+			events[i].Mode |= ERROR
 		}
 	}
 	return
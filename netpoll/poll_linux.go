@@ -13,6 +13,12 @@ import (
 // description is the poll type.
 const description = "epoll"
 
+const (
+	epollIN  = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	epollOUT = syscall.EPOLLOUT
+	epollET  = 1 << 31
+)
+
 // ErrTimeout is the error returned by SetTimeout when time.Duration d < time.Millisecond.
 var ErrTimeout = errors.New("non-positive interval for SetTimeout")
 
@@ -22,6 +28,9 @@ type Poll struct {
 	events  []syscall.EpollEvent
 	pool    *sync.Pool
 	timeout int
+	mode    PollMode
+	flags   uint32
+	uring   *uring
 }
 
 // Create creates a new poll.
@@ -40,6 +49,25 @@ func Create() (*Poll, error) {
 	}, nil
 }
 
+// CreateBackend creates a new poll with the backend. It falls back to
+// DefaultBackend when the kernel does not support io_uring.
+func CreateBackend(backend Backend) (*Poll, error) {
+	if backend == IOURingBackend {
+		if r, err := newURing(); err == nil {
+			return &Poll{fd: -1, timeout: 1000, uring: r}, nil
+		}
+	}
+	return Create()
+}
+
+// Backend returns the backend of the poll.
+func (p *Poll) Backend() Backend {
+	if p.uring != nil {
+		return IOURingBackend
+	}
+	return DefaultBackend
+}
+
 // SetTimeout sets the wait timeout.
 func (p *Poll) SetTimeout(d time.Duration) (err error) {
 	if d < time.Millisecond {
@@ -49,26 +77,92 @@ func (p *Poll) SetTimeout(d time.Duration) (err error) {
 	return nil
 }
 
+// SetMode sets the trigger mode of the file descriptors registered later.
+func (p *Poll) SetMode(mode PollMode) error {
+	switch mode {
+	case LevelTriggered:
+		p.flags = 0
+	case EdgeTriggered:
+		p.flags = epollET
+	case OneShot:
+		p.flags = syscall.EPOLLONESHOT
+	default:
+		return ErrPollMode
+	}
+	p.mode = mode
+	if p.uring != nil {
+		p.uring.mode = mode
+	}
+	return nil
+}
+
 // Register registers a file descriptor.
 func (p *Poll) Register(fd int) (err error) {
-	event := p.pool.Get().(syscall.EpollEvent)
-	event.Fd, event.Events = int32(fd), syscall.EPOLLIN
-	err = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &event)
-	p.pool.Put(event)
-	return
+	if p.uring != nil {
+		return p.uring.register(fd)
+	}
+	return p.control(syscall.EPOLL_CTL_ADD, fd, epollIN)
 }
 
 // Write adds a write event.
 func (p *Poll) Write(fd int) (err error) {
+	if p.uring != nil {
+		return p.uring.addWrite(fd)
+	}
+	return p.control(syscall.EPOLL_CTL_MOD, fd, epollIN|epollOUT)
+}
+
+// Pause stops reporting the read events of a file descriptor
+// and adds a write event.
+func (p *Poll) Pause(fd int) (err error) {
+	if p.uring != nil {
+		return p.uring.pause(fd)
+	}
+	return p.control(syscall.EPOLL_CTL_MOD, fd, epollOUT)
+}
+
+// Suspend stops reporting the read events of a file descriptor
+// without adding a write event.
+func (p *Poll) Suspend(fd int) (err error) {
+	if p.uring != nil {
+		return p.uring.suspend(fd)
+	}
+	return p.control(syscall.EPOLL_CTL_MOD, fd, 0)
+}
+
+// Resume reports the read events of a paused file descriptor again.
+func (p *Poll) Resume(fd int) (err error) {
+	if p.uring != nil {
+		return p.uring.resume(fd)
+	}
+	return p.control(syscall.EPOLL_CTL_MOD, fd, epollIN)
+}
+
+// Rearm enables a file descriptor again after its event has been reported
+// in OneShot mode.
+func (p *Poll) Rearm(fd int) (err error) {
+	if p.uring != nil {
+		return p.uring.rearm(fd)
+	}
+	if p.mode != OneShot {
+		return nil
+	}
+	return p.control(syscall.EPOLL_CTL_MOD, fd, epollIN)
+}
+
+func (p *Poll) control(op int, fd int, events uint32) (err error) {
 	event := p.pool.Get().(syscall.EpollEvent)
-	event.Fd, event.Events = int32(fd), syscall.EPOLLIN|syscall.EPOLLOUT
-	err = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd, &event)
+	event.Fd, event.Events = int32(fd), events|p.flags
+	err = syscall.EpollCtl(p.fd, op, fd, &event)
 	p.pool.Put(event)
 	return
 }
 
 // Unregister unregisters a file descriptor.
 func (p *Poll) Unregister(fd int) (err error) {
+	if p.uring != nil {
+		return p.uring.unregister(fd)
+	}
 	event := p.pool.Get().(syscall.EpollEvent)
 	event.Fd, event.Events = int32(fd), syscall.EPOLLIN|syscall.EPOLLOUT
 	err = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, &event)
@@ -76,8 +170,22 @@ func (p *Poll) Unregister(fd int) (err error) {
 	return
 }
 
+// Submit performs the operations, and sets their results. IOURingBackend
+// submits them to the kernel in batches, while DefaultBackend performs them
+// one by one. It returns an error only if they cannot be submitted.
+func (p *Poll) Submit(ops []Op) error {
+	if p.uring != nil {
+		return p.uring.submitOps(ops)
+	}
+	performOps(ops)
+	return nil
+}
+
 // Wait waits events.
 func (p *Poll) Wait(events []Event) (n int, err error) {
+	if p.uring != nil {
+		return p.uring.wait(events, p.timeout)
+	}
 	if cap(p.events) >= len(events) {
 		p.events = p.events[:len(events)]
 	} else {
@@ -88,19 +196,23 @@ func (p *Poll) Wait(events []Event) (n int, err error) {
 		if err != syscall.EINTR {
 			return 0, err
 		}
-		err = nil
+		return 0, nil
 	}
 	for i := 0; i < n; i++ {
 		ev := p.events[i]
 		events[i].Fd = int(ev.Fd)
+		events[i].Mode = 0
 		if ev.Events&syscall.EPOLLIN != 0 {
-			events[i].Mode = READ
-		} else if ev.Events&syscall.EPOLLOUT != 0 {
-			events[i].Mode = WRITE
-			event := p.pool.Get().(syscall.EpollEvent)
-			event.Fd, event.Events = ev.Fd, syscall.EPOLLIN
-			syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, int(ev.Fd), &event)
-			p.pool.Put(event)
+			events[i].Mode |= READ
+		}
+		if ev.Events&syscall.EPOLLOUT != 0 {
+			events[i].Mode |= WRITE
+		}
+		if ev.Events&(syscall.EPOLLRDHUP|syscall.EPOLLHUP) != 0 {
+			events[i].Mode |= HUP
+		}
+		if ev.Events&syscall.EPOLLERR != 0 {
+			events[i].Mode |= ERROR
 		}
 	}
 	return
@@ -109,5 +221,8 @@ func (p *Poll) Wait(events []Event) (n int, err error) {
 // Close closes the poll fd. The underlying file descriptor is closed by the
 // destroy method when there are no remaining references.
 func (p *Poll) Close() error {
+	if p.uring != nil {
+		return p.uring.Close()
+	}
 	return syscall.Close(p.fd)
 }
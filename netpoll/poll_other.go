@@ -20,11 +20,27 @@ func Create() (*Poll, error) {
 	return nil, errors.New("system not supported")
 }
 
+// CreateBackend creates a new poll. The backend falls back to DefaultBackend
+// for consisted with other system.
+func CreateBackend(backend Backend) (*Poll, error) {
+	return Create()
+}
+
+// Backend returns the backend of the poll.
+func (p *Poll) Backend() Backend {
+	return DefaultBackend
+}
+
 // SetTimeout sets the wait timeout.
 func (p *Poll) SetTimeout(d time.Duration) (err error) {
 	return nil
 }
 
+// SetMode sets the trigger mode of the file descriptors registered later.
+func (p *Poll) SetMode(mode PollMode) error {
+	return nil
+}
+
 // Register registers a file descriptor.
 func (p *Poll) Register(fd int) (err error) {
 	return
@@ -35,11 +51,39 @@ func (p *Poll) Write(fd int) (err error) {
 	return
 }
 
+// Pause stops reporting the read events of a file descriptor
+// and adds a write event.
+func (p *Poll) Pause(fd int) (err error) {
+	return
+}
+
+// Suspend stops reporting the read events of a file descriptor
+// without adding a write event.
+func (p *Poll) Suspend(fd int) (err error) {
+	return
+}
+
+// Resume reports the read events of a paused file descriptor again.
+func (p *Poll) Resume(fd int) (err error) {
+	return
+}
+
+// Rearm enables a file descriptor again after its event has been reported
+// in OneShot mode.
+func (p *Poll) Rearm(fd int) (err error) {
+	return
+}
+
 // Unregister unregisters a file descriptor.
 func (p *Poll) Unregister(fd int) (err error) {
 	return
 }
 
+// Submit performs the operations, and sets their results.
+func (p *Poll) Submit(ops []Op) error {
+	return nil
+}
+
 // Wait waits events.
 func (p *Poll) Wait(events []Event) (n int, err error) {
 	return
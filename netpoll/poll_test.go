@@ -70,3 +70,232 @@ func TestPoll(t *testing.T) {
 	l.Close()
 	wg.Wait()
 }
+
+func TestPollMode(t *testing.T) {
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+		p, err := Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetMode(mode); err != nil {
+			t.Error(err)
+		}
+		p.SetTimeout(time.Millisecond * 10)
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Register(fds[0])
+		syscall.Write(fds[1], []byte("Hello World"))
+		events := make([]Event, 8)
+		if n, err := p.Wait(events); err != nil {
+			t.Error(err)
+		} else if n != 1 || events[0].Mode != READ {
+			t.Error(mode, n, events[0])
+		}
+		n, _ := p.Wait(events)
+		if mode == LevelTriggered && n != 1 || mode != LevelTriggered && n != 0 {
+			t.Error(mode, n)
+		}
+		p.Rearm(fds[0])
+		syscall.Close(fds[1])
+		syscall.Read(fds[0], make([]byte, 64))
+		if n, err := p.Wait(events); err != nil {
+			t.Error(err)
+		} else if n != 1 || events[0].Mode&HUP == 0 {
+			t.Error(mode, n, events[0])
+		}
+		p.Unregister(fds[0])
+		syscall.Close(fds[0])
+		p.Close()
+	}
+	p, _ := Create()
+	if err := p.SetMode(PollMode(-1)); err != ErrPollMode {
+		t.Error(err)
+	}
+	p.Close()
+}
+
+func TestPollBackend(t *testing.T) {
+	for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+		p, err := CreateBackend(IOURingBackend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Backend() != IOURingBackend {
+			p.Close()
+			t.Skip("io_uring is not supported")
+		}
+		p.SetMode(mode)
+		p.SetTimeout(time.Millisecond * 10)
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Register(fds[0])
+		syscall.Write(fds[1], []byte("Hello World"))
+		events := make([]Event, 8)
+		if n, err := p.Wait(events); err != nil {
+			t.Error(err)
+		} else if n != 1 || events[0].Fd != fds[0] || events[0].Mode != READ {
+			t.Error(mode, n, events[0])
+		}
+		n, _ := p.Wait(events)
+		if mode == LevelTriggered && n != 1 || mode != LevelTriggered && n != 0 {
+			t.Error(mode, n)
+		}
+		syscall.Read(fds[0], make([]byte, 64))
+		p.Rearm(fds[0])
+		p.Pause(fds[0])
+		syscall.Write(fds[1], []byte("Hello World"))
+		if n, err := p.Wait(events); err != nil {
+			t.Error(err)
+		} else if n != 1 || events[0].Mode != WRITE {
+			t.Error(mode, n, events[0])
+		}
+		p.Resume(fds[0])
+		if n, err := p.Wait(events); err != nil {
+			t.Error(err)
+		} else if n != 1 || events[0].Mode != READ {
+			t.Error(mode, n, events[0])
+		}
+		syscall.Read(fds[0], make([]byte, 64))
+		p.Rearm(fds[0])
+		syscall.Close(fds[1])
+		if n, err := p.Wait(events); err != nil {
+			t.Error(err)
+		} else if n != 1 || events[0].Mode&HUP == 0 {
+			t.Error(mode, n, events[0])
+		}
+		p.Unregister(fds[0])
+		syscall.Close(fds[0])
+		p.Close()
+	}
+}
+
+func TestPollSuspend(t *testing.T) {
+	for _, backend := range []Backend{DefaultBackend, IOURingBackend} {
+		for _, mode := range []PollMode{LevelTriggered, EdgeTriggered, OneShot} {
+			p, err := CreateBackend(backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetMode(mode)
+			p.SetTimeout(time.Millisecond * 10)
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Register(fds[0])
+			p.Suspend(fds[0])
+			syscall.Write(fds[1], []byte("Hello World"))
+			events := make([]Event, 8)
+			if n, err := p.Wait(events); err != nil {
+				t.Error(err)
+			} else if n != 0 {
+				t.Error(backend, mode, n, events[0])
+			}
+			p.Resume(fds[0])
+			if n, err := p.Wait(events); err != nil {
+				t.Error(err)
+			} else if n != 1 || events[0].Mode != READ {
+				t.Error(backend, mode, n, events[0])
+			}
+			p.Unregister(fds[0])
+			syscall.Close(fds[0])
+			syscall.Close(fds[1])
+			p.Close()
+		}
+	}
+}
+
+func TestPollPauseTwice(t *testing.T) {
+	p, err := Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.SetTimeout(time.Millisecond * 10)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	p.Register(fds[0])
+	if err := p.Pause(fds[0]); err != nil {
+		t.Error(err)
+	}
+	// The read events are already gone.
+	if err := p.Pause(fds[0]); err != nil {
+		t.Error(err)
+	}
+	events := make([]Event, 8)
+	if n, err := p.Wait(events); err != nil {
+		t.Error(err)
+	} else if n != 1 || events[0].Mode&WRITE == 0 {
+		t.Error(n, events[0])
+	}
+	if err := p.Unregister(fds[0]); err != nil {
+		t.Error(err)
+	}
+	syscall.Close(fds[0])
+}
+
+func TestPollSubmit(t *testing.T) {
+	for _, backend := range []Backend{DefaultBackend, IOURingBackend} {
+		p, err := CreateBackend(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, _ := l.(*net.TCPListener).File()
+		lfd := int(file.Fd())
+		syscall.SetNonblock(lfd, true)
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+		ops := []Op{{Kind: OpAccept, Fd: lfd}, {Kind: OpAccept, Fd: lfd}}
+		if err := p.Submit(ops); err != nil {
+			t.Fatal(err)
+		}
+		if ops[0].Err != nil || ops[1].Err != syscall.EAGAIN {
+			t.Fatal(backend, ops[0].Err, ops[1].Err)
+		}
+		nfd := ops[0].N
+		if sa, ok := ops[0].Addr.(*syscall.SockaddrInet4); !ok || sa.Port != conn.LocalAddr().(*net.TCPAddr).Port {
+			t.Error(backend, ops[0].Addr)
+		}
+		ops = []Op{{Kind: OpWrite, Fd: nfd, Buf: []byte("Hello")}, {Kind: OpRead, Fd: nfd, Buf: make([]byte, 64)}, {Kind: 0}}
+		if err := p.Submit(ops); err != nil {
+			t.Fatal(err)
+		}
+		if ops[0].N != 5 || ops[0].Err != nil || ops[1].Err != syscall.EAGAIN || ops[2].Err != syscall.EINVAL {
+			t.Error(backend, ops)
+		}
+		buf := make([]byte, 64)
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "Hello" {
+			t.Error(backend, string(buf[:n]), err)
+		}
+		conn.Write([]byte("World"))
+		time.Sleep(time.Millisecond * 10)
+		ops = ops[1:2]
+		if err := p.Submit(ops); err != nil {
+			t.Fatal(err)
+		} else if ops[0].Err != nil || string(ops[0].Buf[:ops[0].N]) != "World" {
+			t.Error(backend, ops[0].N, ops[0].Err)
+		}
+		syscall.Close(nfd)
+		conn.Close()
+		file.Close()
+		l.Close()
+		p.Close()
+		if err := p.Submit(ops); backend == IOURingBackend && p.Backend() == IOURingBackend && err != syscall.EBADF {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package netpoll
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrProxyHeader is the error when the PROXY protocol header of a conn
+// is invalid.
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// The types of the PROXY protocol v2 TLVs.
+const (
+	ProxyTypeALPN      = 0x01
+	ProxyTypeAuthority = 0x02
+	ProxyTypeCRC32C    = 0x03
+	ProxyTypeNoop      = 0x04
+	ProxyTypeUniqueID  = 0x05
+	ProxyTypeSSL       = 0x20
+	ProxyTypeNetNS     = 0x30
+)
+
+const (
+	// proxyV1MaxSize is the max size of a PROXY protocol v1 header.
+	proxyV1MaxSize = 107
+	// proxyV2HeaderSize is the size of the fixed part of a PROXY protocol v2 header.
+	proxyV2HeaderSize = 16
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyTLV is a type-length-value of a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is the PROXY protocol header sent by a proxy or a load
+// balancer in front of a Server.
+type ProxyHeader struct {
+	// Version is the version of the PROXY protocol, which is 1 or 2.
+	Version int
+	// Local reports whether the conn was made by the proxy itself,
+	// such as a health check, so the addresses are not rewritten.
+	// It is the LOCAL command of v2 or the UNKNOWN protocol of v1.
+	Local bool
+	// SourceAddr is the address of the client.
+	SourceAddr net.Addr
+	// DestinationAddr is the address the client connected to.
+	DestinationAddr net.Addr
+	// TLVs are the TLVs of a v2 header.
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of the type typ.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ALPN returns the application protocol negotiated by the proxy.
+func (h *ProxyHeader) ALPN() string {
+	v, _ := h.TLV(ProxyTypeALPN)
+	return string(v)
+}
+
+// Authority returns the host name requested by the client, such as
+// the TLS SNI.
+func (h *ProxyHeader) Authority() string {
+	v, _ := h.TLV(ProxyTypeAuthority)
+	return string(v)
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header from r.
+// The bytes after the header are left in r.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	data, err := r.Peek(len(proxyV1Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(data, proxyV2Signature[:len(data)]) {
+		if data, err = r.Peek(proxyV2HeaderSize); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(data, proxyV2Signature) {
+			return nil, ErrProxyHeader
+		}
+		data, err = r.Peek(proxyV2HeaderSize + int(binary.BigEndian.Uint16(data[14:16])))
+	} else if bytes.Equal(data, proxyV1Signature) {
+		// Peeks until the CRLF without reading the bytes after the header.
+		for i := len(data) + 1; i <= proxyV1MaxSize; i++ {
+			if data, err = r.Peek(i); err != nil || bytes.HasSuffix(data, []byte("\r\n")) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, n, err := parseProxyHeader(data)
+	if err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrProxyHeader
+	}
+	r.Discard(n)
+	return h, nil
+}
+
+// parseProxyHeader parses the PROXY protocol header at the beginning of
+// data, and returns the header and its size, or zero if data does not
+// hold a complete header yet.
+func parseProxyHeader(data []byte) (h *ProxyHeader, n int, err error) {
+	if len(data) >= len(proxyV2Signature) && bytes.HasPrefix(data, proxyV2Signature) {
+		return parseProxyV2(data)
+	} else if len(data) >= len(proxyV1Signature) && bytes.HasPrefix(data, proxyV1Signature) {
+		return parseProxyV1(data)
+	} else if bytes.HasPrefix(proxyV2Signature, data) || bytes.HasPrefix(proxyV1Signature, data) {
+		return nil, 0, nil
+	}
+	return nil, 0, ErrProxyHeader
+}
+
+func parseProxyV1(data []byte) (h *ProxyHeader, n int, err error) {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i < 0 {
+		if len(data) >= proxyV1MaxSize {
+			return nil, 0, ErrProxyHeader
+		}
+		return nil, 0, nil
+	} else if i+2 > proxyV1MaxSize {
+		return nil, 0, ErrProxyHeader
+	}
+	fields := strings.Split(string(data[:i]), " ")
+	h = &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, i + 2, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, 0, ErrProxyHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || srcErr != nil || dstErr != nil ||
+		(src.To4() != nil) != (fields[1] == "TCP4") || (dst.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, 0, ErrProxyHeader
+	}
+	h.SourceAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	h.DestinationAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return h, i + 2, nil
+}
+
+func parseProxyV2(data []byte) (h *ProxyHeader, n int, err error) {
+	if len(data) < proxyV2HeaderSize {
+		return nil, 0, nil
+	}
+	n = proxyV2HeaderSize + int(binary.BigEndian.Uint16(data[14:16]))
+	if len(data) < n {
+		return nil, 0, nil
+	}
+	if data[12]>>4 != 2 {
+		return nil, 0, ErrProxyHeader
+	}
+	h = &ProxyHeader{Version: 2}
+	switch data[12] & 0xf {
+	case 0:
+		h.Local = true
+	case 1:
+	default:
+		return nil, 0, ErrProxyHeader
+	}
+	payload := data[proxyV2HeaderSize:n]
+	var size int
+	switch family, proto := data[13]>>4, data[13]&0xf; family {
+	case 0:
+		h.Local = true
+	case 1, 2:
+		ipSize := net.IPv4len
+		if family == 2 {
+			ipSize = net.IPv6len
+		}
+		size = 2*ipSize + 4
+		if len(payload) < size {
+			return nil, 0, ErrProxyHeader
+		}
+		src := net.IP(append([]byte{}, payload[:ipSize]...))
+		dst := net.IP(append([]byte{}, payload[ipSize:2*ipSize]...))
+		srcPort := int(binary.BigEndian.Uint16(payload[2*ipSize:]))
+		dstPort := int(binary.BigEndian.Uint16(payload[2*ipSize+2:]))
+		if proto == 2 {
+			h.SourceAddr = &net.UDPAddr{IP: src, Port: srcPort}
+			h.DestinationAddr = &net.UDPAddr{IP: dst, Port: dstPort}
+		} else {
+			h.SourceAddr = &net.TCPAddr{IP: src, Port: srcPort}
+			h.DestinationAddr = &net.TCPAddr{IP: dst, Port: dstPort}
+		}
+	case 3:
+		size = 216
+		if len(payload) < size {
+			return nil, 0, ErrProxyHeader
+		}
+		network := "unix"
+		if proto == 2 {
+			network = "unixgram"
+		}
+		h.SourceAddr = &net.UnixAddr{Name: unixName(payload[:108]), Net: network}
+		h.DestinationAddr = &net.UnixAddr{Name: unixName(payload[108:216]), Net: network}
+	default:
+		return nil, 0, ErrProxyHeader
+	}
+	for tlvs := payload[size:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, ErrProxyHeader
+		}
+		length := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < length {
+			return nil, 0, ErrProxyHeader
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: append([]byte{}, tlvs[3:length]...)})
+		tlvs = tlvs[length:]
+	}
+	if h.Local {
+		h.SourceAddr, h.DestinationAddr = nil, nil
+	}
+	return h, n, nil
+}
+
+// unixName returns the NUL terminated name of a unix socket.
+func unixName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
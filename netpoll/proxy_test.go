@@ -0,0 +1,133 @@
+package netpoll
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a PROXY protocol v2 header of the TCP over IPv4
+// addresses with the TLVs.
+func proxyV2Header(src, dst *net.TCPAddr, tlvs ...ProxyTLV) []byte {
+	var payload []byte
+	payload = append(payload, src.IP.To4()...)
+	payload = append(payload, dst.IP.To4()...)
+	payload = append(payload, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestParseProxyHeaderV1(t *testing.T) {
+	h, n, err := parseProxyHeader([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET /"))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 47 || h.Version != 1 || h.Local {
+		t.Error(n, h)
+	} else if h.SourceAddr.String() != "192.168.0.1:56324" || h.DestinationAddr.String() != "192.168.0.11:443" {
+		t.Error(h.SourceAddr, h.DestinationAddr)
+	}
+	h, _, err = parseProxyHeader([]byte("PROXY TCP6 ::1 ::2 1 2\r\n"))
+	if err != nil {
+		t.Error(err)
+	} else if h.SourceAddr.String() != "[::1]:1" {
+		t.Error(h.SourceAddr)
+	}
+	h, n, err = parseProxyHeader([]byte("PROXY UNKNOWN\r\n"))
+	if err != nil || n != 15 || !h.Local {
+		t.Error(h, n, err)
+	}
+	if _, n, err = parseProxyHeader([]byte("PROXY TCP4 192.168.0.1")); err != nil || n != 0 {
+		t.Error(n, err)
+	}
+	if _, n, err = parseProxyHeader([]byte("PRO")); err != nil || n != 0 {
+		t.Error(n, err)
+	}
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.168.0.1 ::1 1 2\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 2\r\n",
+		"PROXY TCP5 192.168.0.1 192.168.0.11 1 2\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", proxyV1MaxSize),
+	} {
+		if _, _, err := parseProxyHeader([]byte(data)); err != ErrProxyHeader {
+			t.Error(data, err)
+		}
+	}
+}
+
+func TestParseProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	data := proxyV2Header(src, dst,
+		ProxyTLV{Type: ProxyTypeALPN, Value: []byte("h2")},
+		ProxyTLV{Type: ProxyTypeAuthority, Value: []byte("example.com")},
+	)
+	for i := 0; i < len(data); i++ {
+		if _, n, err := parseProxyHeader(data[:i]); err != nil || n != 0 {
+			t.Fatal(i, n, err)
+		}
+	}
+	h, n, err := parseProxyHeader(append(data, "GET /"...))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != len(data) || h.Version != 2 || h.Local {
+		t.Error(n, h)
+	} else if h.SourceAddr.String() != src.String() || h.DestinationAddr.String() != dst.String() {
+		t.Error(h.SourceAddr, h.DestinationAddr)
+	} else if h.ALPN() != "h2" || h.Authority() != "example.com" {
+		t.Error(h.ALPN(), h.Authority())
+	}
+	if _, ok := h.TLV(ProxyTypeUniqueID); ok {
+		t.Error("unexpected TLV")
+	}
+	local := append([]byte{}, data...)
+	local[12] = 0x20
+	if h, _, err := parseProxyHeader(local); err != nil || !h.Local || h.SourceAddr != nil {
+		t.Error(h, err)
+	}
+	invalid := append([]byte{}, data...)
+	invalid[12] = 0x31
+	if _, _, err := parseProxyHeader(invalid); err != ErrProxyHeader {
+		t.Error(err)
+	}
+	invalid = append([]byte{}, data...)
+	invalid[len(invalid)-len("example.com")-2]++
+	if _, _, err := parseProxyHeader(invalid); err != ErrProxyHeader {
+		t.Error(err)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	for _, header := range [][]byte{
+		proxyV2Header(src, dst, ProxyTLV{Type: ProxyTypeALPN, Value: []byte("http/1.1")}),
+		[]byte("PROXY TCP4 10.0.0.1 10.0.0.2 1234 443\r\n"),
+	} {
+		r := bufio.NewReader(bytes.NewReader(append(header, "GET /"...)))
+		h, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		} else if h.SourceAddr.String() != src.String() {
+			t.Error(h.SourceAddr)
+		}
+		if rest, _ := r.Peek(5); string(rest) != "GET /" {
+			t.Error(string(rest))
+		}
+	}
+	if _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))); err != ErrProxyHeader {
+		t.Error(err)
+	}
+	if _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader("PROXY TCP4"))); err == nil {
+		t.Error("unexpected nil error")
+	}
+}
@@ -0,0 +1,75 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"io"
+	"syscall"
+	"time"
+)
+
+// proxyBufferSize is the initial size of the buffer peeking the PROXY
+// protocol header, which holds a v1 header or a v2 header without TLVs.
+const proxyBufferSize = 256
+
+// readProxyHeader reads the PROXY protocol header of the conn c before it
+// is upgraded, and rewrites its addresses. The bytes are peeked so that the
+// bytes after the header are left to the poll, while an incomplete header
+// is consumed so that the poll does not report it again.
+func (c *conn) readProxyHeader(timeout time.Duration) error {
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+	buf := make([]byte, proxyBufferSize)
+	var header []byte
+	for {
+		c.rLock.Lock()
+		n, _, err := syscall.Recvfrom(c.fd, buf, syscall.MSG_PEEK)
+		c.rLock.Unlock()
+		if n > 0 {
+			data := append(header, buf[:n]...)
+			h, size, err := parseProxyHeader(data)
+			if err != nil {
+				return err
+			} else if size > 0 {
+				// Consumes the rest of the header peeked.
+				if _, err = io.ReadFull(c, buf[:size-len(header)]); err != nil {
+					return err
+				}
+				c.setProxyHeader(h)
+				return nil
+			} else if len(data) >= proxyV2HeaderSize+0xffff {
+				return ErrProxyHeader
+			}
+			if _, err = io.ReadFull(c, buf[:n]); err != nil {
+				return err
+			}
+			header = data
+			continue
+		} else if err == nil {
+			return EOF
+		} else if err != syscall.EAGAIN {
+			return err
+		}
+		if !c.blocking() {
+			return ErrProxyHeader
+		}
+		if err = c.waitReadable(); err != nil {
+			return err
+		}
+	}
+}
+
+// setProxyHeader sets the PROXY protocol header h of the conn c, and
+// rewrites its addresses unless the header is LOCAL.
+func (c *conn) setProxyHeader(h *ProxyHeader) {
+	c.lock.Lock()
+	c.proxy = h
+	if !h.Local && h.SourceAddr != nil {
+		c.rAddr = h.SourceAddr
+		c.lAddr = h.DestinationAddr
+	}
+	c.lock.Unlock()
+}
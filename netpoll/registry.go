@@ -0,0 +1,130 @@
+package netpoll
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrConnNotFound is the error when no live conn has the ID.
+var ErrConnNotFound = errors.New("conn not found")
+
+// registry tracks the live conns by ID and by topic.
+type registry struct {
+	lock   sync.RWMutex
+	conns  map[uint64]*entry
+	topics map[string]map[uint64]net.Conn
+}
+
+// entry is a live conn and the topics it subscribes.
+type entry struct {
+	conn   net.Conn
+	topics map[string]struct{}
+}
+
+func (r *registry) add(id uint64, c net.Conn) {
+	r.lock.Lock()
+	if r.conns == nil {
+		r.conns = make(map[uint64]*entry)
+	}
+	r.conns[id] = &entry{conn: c}
+	r.lock.Unlock()
+}
+
+func (r *registry) remove(id uint64) {
+	r.lock.Lock()
+	if e, ok := r.conns[id]; ok {
+		for topic := range e.topics {
+			r.leave(id, topic)
+		}
+		delete(r.conns, id)
+	}
+	r.lock.Unlock()
+}
+
+func (r *registry) get(id uint64) (net.Conn, bool) {
+	r.lock.RLock()
+	e, ok := r.conns[id]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return e.conn, true
+}
+
+// all returns a snapshot of the live conns.
+func (r *registry) all() []net.Conn {
+	r.lock.RLock()
+	conns := make([]net.Conn, 0, len(r.conns))
+	for _, e := range r.conns {
+		conns = append(conns, e.conn)
+	}
+	r.lock.RUnlock()
+	return conns
+}
+
+func (r *registry) subscribe(id uint64, topic string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.conns[id]
+	if !ok {
+		return ErrConnNotFound
+	}
+	if e.topics == nil {
+		e.topics = make(map[string]struct{})
+	}
+	e.topics[topic] = struct{}{}
+	if r.topics == nil {
+		r.topics = make(map[string]map[uint64]net.Conn)
+	}
+	subscribers, ok := r.topics[topic]
+	if !ok {
+		subscribers = make(map[uint64]net.Conn)
+		r.topics[topic] = subscribers
+	}
+	subscribers[id] = e.conn
+	return nil
+}
+
+func (r *registry) unsubscribe(id uint64, topic string) {
+	r.lock.Lock()
+	if e, ok := r.conns[id]; ok {
+		delete(e.topics, topic)
+		r.leave(id, topic)
+	}
+	r.lock.Unlock()
+}
+
+// leave removes the conn from the subscribers of the topic. It must be
+// called with the lock held.
+func (r *registry) leave(id uint64, topic string) {
+	if subscribers, ok := r.topics[topic]; ok {
+		delete(subscribers, id)
+		if len(subscribers) == 0 {
+			delete(r.topics, topic)
+		}
+	}
+}
+
+// subscribers returns a snapshot of the conns subscribing the topic.
+func (r *registry) subscribers(topic string) []net.Conn {
+	r.lock.RLock()
+	subscribers := r.topics[topic]
+	conns := make([]net.Conn, 0, len(subscribers))
+	for _, c := range subscribers {
+		conns = append(conns, c)
+	}
+	r.lock.RUnlock()
+	return conns
+}
+
+// writeAll writes b to the conns and returns the number of the conns
+// written without an error.
+func writeAll(conns []net.Conn, b []byte) (n int) {
+	for _, c := range conns {
+		if _, err := c.Write(b); err == nil {
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,58 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"net"
+)
+
+// Conn returns the live conn with the ID, which is the ConnInfo ID.
+// A conn is live from StateUpgraded until it is closed.
+func (s *Server) Conn(id uint64) (net.Conn, bool) {
+	return s.registry.get(id)
+}
+
+// RangeConns calls f for every live conn until f returns false.
+// The conns are a snapshot, so f may write to or close them.
+func (s *Server) RangeConns(f func(c net.Conn) bool) {
+	for _, c := range s.registry.all() {
+		if !f(c) {
+			return
+		}
+	}
+}
+
+// Push writes b to the live conn with the ID. It is safe to call from
+// any goroutine while the conn is being served.
+func (s *Server) Push(id uint64, b []byte) error {
+	c, ok := s.registry.get(id)
+	if !ok {
+		return ErrConnNotFound
+	}
+	_, err := c.Write(b)
+	return err
+}
+
+// Broadcast writes b to all the live conns, and returns the number of
+// the conns written without an error.
+func (s *Server) Broadcast(b []byte) int {
+	return writeAll(s.registry.all(), b)
+}
+
+// Subscribe subscribes the live conn with the ID to the topic. The conn
+// unsubscribes all its topics when it is closed.
+func (s *Server) Subscribe(id uint64, topic string) error {
+	return s.registry.subscribe(id, topic)
+}
+
+// Unsubscribe unsubscribes the conn with the ID from the topic.
+func (s *Server) Unsubscribe(id uint64, topic string) {
+	s.registry.unsubscribe(id, topic)
+}
+
+// Publish writes b to the live conns subscribing the topic, and returns
+// the number of the conns written without an error.
+func (s *Server) Publish(topic string, b []byte) int {
+	return writeAll(s.registry.subscribers(topic), b)
+}
@@ -0,0 +1,94 @@
+package netpoll
+
+import (
+	"time"
+)
+
+// DefaultRescheduleInterval is the default interval between two reschedulings.
+const DefaultRescheduleInterval = time.Millisecond * 100
+
+// Activity is the activity of a conn in the last rescheduling interval.
+type Activity struct {
+	// Reads is the number of the Read calls.
+	Reads int64
+	// Bytes is the number of the bytes read.
+	Bytes int64
+	// Latency is the time spent by the Handler serving the conn.
+	Latency time.Duration
+	// Moved is the time when the conn was last moved by the rescheduler,
+	// or the zero time if it has never been moved.
+	Moved time.Time
+	// Score is the score of the conn returned by Rescheduler.Score.
+	Score int64
+}
+
+// Rescheduler is the policy to move the hot conns from the shared workers
+// to the unshared workers, in exchange for the cold conns.
+type Rescheduler interface {
+	// Interval returns the interval between two reschedulings.
+	Interval() time.Duration
+	// Score returns the score of a conn from its activity. The conns with
+	// the highest scores are the hot conns.
+	Score(a *Activity) int64
+	// Swap reports whether the hot conn on a shared worker should be
+	// exchanged for the cold conn on an unshared worker.
+	Swap(hot, cold *Activity) bool
+}
+
+// DefaultRescheduler scores a conn by the weighted sum of its activity.
+// The zero value scores a conn by its Read calls and swaps a hot conn
+// for a cold one whenever it has a higher score every 100ms.
+type DefaultRescheduler struct {
+	// Period is the interval between two reschedulings.
+	// If zero, DefaultRescheduleInterval is used.
+	Period time.Duration
+	// ReadWeight is the weight of a Read call.
+	// If all the weights are zero, it is 1.
+	ReadWeight int64
+	// ByteWeight is the weight of a byte read.
+	ByteWeight int64
+	// LatencyWeight is the weight of a microsecond spent by the Handler.
+	LatencyWeight int64
+	// Hysteresis is the fraction of the score of the cold conn by which
+	// the score of the hot conn must exceed it, so that the conns with
+	// similar scores do not flap between the workers.
+	Hysteresis float64
+	// MinGain is the minimum difference between the scores of the hot
+	// and the cold conns for them to be swapped.
+	MinGain int64
+	// Hold is the minimum time a conn stays on a worker after being moved.
+	Hold time.Duration
+}
+
+// Interval implements the Rescheduler Interval method.
+func (r *DefaultRescheduler) Interval() time.Duration {
+	if r.Period > 0 {
+		return r.Period
+	}
+	return DefaultRescheduleInterval
+}
+
+// Score implements the Rescheduler Score method.
+func (r *DefaultRescheduler) Score(a *Activity) int64 {
+	if r.ReadWeight == 0 && r.ByteWeight == 0 && r.LatencyWeight == 0 {
+		return a.Reads
+	}
+	return r.ReadWeight*a.Reads + r.ByteWeight*a.Bytes + r.LatencyWeight*int64(a.Latency/time.Microsecond)
+}
+
+// Swap implements the Rescheduler Swap method.
+func (r *DefaultRescheduler) Swap(hot, cold *Activity) bool {
+	gain := hot.Score - cold.Score
+	if gain <= 0 || gain < r.MinGain || float64(gain) < float64(cold.Score)*r.Hysteresis {
+		return false
+	}
+	if r.Hold > 0 {
+		now := time.Now()
+		for _, a := range []*Activity{hot, cold} {
+			if !a.Moved.IsZero() && now.Sub(a.Moved) < r.Hold {
+				return false
+			}
+		}
+	}
+	return true
+}
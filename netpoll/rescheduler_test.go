@@ -0,0 +1,67 @@
+package netpoll
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultRescheduler(t *testing.T) {
+	r := &DefaultRescheduler{}
+	if r.Interval() != DefaultRescheduleInterval {
+		t.Error(r.Interval())
+	}
+	a := &Activity{Reads: 3, Bytes: 100, Latency: time.Millisecond}
+	if score := r.Score(a); score != 3 {
+		t.Error(score)
+	}
+	r = &DefaultRescheduler{Period: time.Second, ByteWeight: 1, LatencyWeight: 2}
+	if r.Interval() != time.Second {
+		t.Error(r.Interval())
+	}
+	if score := r.Score(a); score != 2100 {
+		t.Error(score)
+	}
+}
+
+func TestDefaultReschedulerSwap(t *testing.T) {
+	hot, cold := &Activity{Score: 110}, &Activity{Score: 100}
+	if !(&DefaultRescheduler{}).Swap(hot, cold) {
+		t.Error("no swap")
+	}
+	if (&DefaultRescheduler{}).Swap(cold, hot) {
+		t.Error("swap a colder conn")
+	}
+	if (&DefaultRescheduler{Hysteresis: 0.2}).Swap(hot, cold) {
+		t.Error("swap within hysteresis")
+	}
+	if !(&DefaultRescheduler{Hysteresis: 0.05}).Swap(hot, cold) {
+		t.Error("no swap beyond hysteresis")
+	}
+	if (&DefaultRescheduler{MinGain: 20}).Swap(hot, cold) {
+		t.Error("swap below min gain")
+	}
+	hot.Moved = time.Now()
+	if (&DefaultRescheduler{Hold: time.Second}).Swap(hot, cold) {
+		t.Error("swap within hold")
+	}
+	hot.Moved = time.Now().Add(-time.Second * 2)
+	if !(&DefaultRescheduler{Hold: time.Second}).Swap(hot, cold) {
+		t.Error("no swap after hold")
+	}
+}
+
+func TestInsertionSort(t *testing.T) {
+	l := list{{score: 3}, {score: 1}, {score: 2}, {score: 1}}
+	insertionSort(l, false)
+	for i, score := range []int64{1, 1, 2, 3} {
+		if l[i].score != score {
+			t.Error(i, l[i].score)
+		}
+	}
+	insertionSort(l, true)
+	for i, score := range []int64{3, 2, 1, 1} {
+		if l[i].score != score {
+			t.Error(i, l[i].score)
+		}
+	}
+}
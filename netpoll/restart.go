@@ -0,0 +1,116 @@
+package netpoll
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ListenFdsEnv is the environment variable describing the listening fds
+// inherited from the parent process by Server.StartProcess. It holds the
+// comma separated network and address of every inherited fd in order,
+// the first of which is fd 3.
+const ListenFdsEnv = "NETPOLL_LISTEN_FDS"
+
+// listenFdsStart is the first inherited fd.
+var listenFdsStart = 3
+
+var inherited struct {
+	once  sync.Once
+	lock  sync.Mutex
+	files map[string][]*os.File
+	keys  map[net.Listener]string
+}
+
+// listenKey returns the key of the listener on the network address.
+func listenKey(network, address string) string {
+	return network + " " + address
+}
+
+// inheritFiles returns the files of the inherited fds by key.
+func inheritFiles(env string, start int) map[string][]*os.File {
+	files := make(map[string][]*os.File)
+	if env == "" {
+		return files
+	}
+	for i, key := range strings.Split(env, ",") {
+		files[key] = append(files[key], os.NewFile(uintptr(start+i), key))
+	}
+	return files
+}
+
+// inheritedListeners takes at most n of the inherited listeners on the network
+// address, or all of them if n is negative.
+func inheritedListeners(network, address string, n int) (lns []net.Listener, err error) {
+	inherited.once.Do(func() {
+		inherited.files = inheritFiles(os.Getenv(ListenFdsEnv), listenFdsStart)
+		os.Unsetenv(ListenFdsEnv)
+	})
+	key := listenKey(network, address)
+	inherited.lock.Lock()
+	defer inherited.lock.Unlock()
+	files := inherited.files[key]
+	if n < 0 || n > len(files) {
+		n = len(files)
+	}
+	inherited.files[key] = files[n:]
+	for _, file := range files[:n] {
+		var ln net.Listener
+		if err == nil {
+			if ln, err = net.FileListener(file); err == nil {
+				lns = append(lns, ln)
+			}
+		}
+		file.Close()
+	}
+	if err != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, err
+	}
+	return lns, nil
+}
+
+// Listen announces on the local network address like net.Listen, unless
+// a listener on the network address is inherited from the parent process.
+//
+// The listeners served by a Server are passed to the new process by
+// Server.StartProcess under the network address they were listened on.
+func Listen(network, address string) (net.Listener, error) {
+	lns, err := inheritedListeners(network, address, 1)
+	if err != nil {
+		return nil, err
+	}
+	var ln net.Listener
+	if len(lns) > 0 {
+		ln = lns[0]
+	} else if ln, err = net.Listen(network, address); err != nil {
+		return nil, err
+	}
+	setListenKey(ln, listenKey(network, address))
+	return ln, nil
+}
+
+func setListenKey(ln net.Listener, key string) {
+	inherited.lock.Lock()
+	if inherited.keys == nil {
+		inherited.keys = make(map[net.Listener]string)
+	}
+	inherited.keys[ln] = key
+	inherited.lock.Unlock()
+}
+
+// takeListenKey returns the key of the listener ln, which is the network
+// address it was listened on by Listen, or else its local address.
+func takeListenKey(ln net.Listener) string {
+	inherited.lock.Lock()
+	key, ok := inherited.keys[ln]
+	delete(inherited.keys, ln)
+	inherited.lock.Unlock()
+	if ok {
+		return key
+	}
+	return listenKey(ln.Addr().Network(), ln.Addr().String())
+}
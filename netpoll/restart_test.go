@@ -0,0 +1,111 @@
+package netpoll
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInheritFiles(t *testing.T) {
+	files := inheritFiles("tcp :9999,unix /tmp/a.sock,tcp :9999", 1000)
+	if len(files[listenKey("tcp", ":9999")]) != 2 || len(files[listenKey("unix", "/tmp/a.sock")]) != 1 {
+		t.Error(files)
+	}
+	if files[listenKey("tcp", ":9999")][1].Fd() != 1002 {
+		t.Error(files[listenKey("tcp", ":9999")][1].Fd())
+	}
+	if len(inheritFiles("", 3)) != 0 {
+		t.Error()
+	}
+}
+
+func TestListen(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if key := takeListenKey(l); key != listenKey("tcp", "127.0.0.1:0") {
+		t.Error(key)
+	}
+	if key := takeListenKey(l); key != listenKey("tcp", l.Addr().String()) {
+		t.Error(key)
+	}
+}
+
+func TestServerRestart(t *testing.T) {
+	if os.Getenv("NETPOLL_TEST_RESTART") == "1" {
+		// The new process started by the test serves a single conn.
+		server := &Server{
+			Network: "tcp",
+			Address: "127.0.0.1:9999",
+			Handler: &DataHandler{
+				HandlerFunc: func(req []byte) (res []byte) {
+					return []byte("child")
+				},
+			},
+		}
+		server.ConnState = func(c net.Conn, state ConnState, err error) {
+			if state == StateClosed {
+				go server.Close()
+			}
+		}
+		time.AfterFunc(time.Second*10, func() { server.Close() })
+		server.ListenAndServe()
+		return
+	}
+	server := &Server{
+		Network: "tcp",
+		Address: "127.0.0.1:9999",
+		Handler: &DataHandler{
+			HandlerFunc: func(req []byte) (res []byte) {
+				return []byte("parent")
+			},
+		},
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.ListenAndServe()
+	}()
+	time.Sleep(time.Millisecond * 10)
+	os.Setenv("NETPOLL_TEST_RESTART", "1")
+	args := os.Args
+	os.Args = []string{os.Args[0], "-test.run=^TestServerRestart$"}
+	p, err := server.StartProcess()
+	os.Args = args
+	os.Unsetenv("NETPOLL_TEST_RESTART")
+	if err == ErrNotSupported {
+		server.Close()
+		wg.Wait()
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+	conn, err := net.Dial("tcp", "127.0.0.1:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	conn.Write([]byte("Hello World"))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != "child" {
+		t.Error(string(buf[:n]))
+	}
+	conn.Close()
+	if _, err := p.Wait(); err != nil {
+		t.Error(err)
+	}
+}
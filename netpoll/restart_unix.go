@@ -0,0 +1,115 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Files returns the duplicates of the listening fds of the server.
+// The caller should close them.
+func (s *Server) Files() ([]*os.File, error) {
+	files, _, err := s.inheritance()
+	return files, err
+}
+
+// inheritance returns the duplicates of the listening fds and the value
+// of ListenFdsEnv describing them.
+func (s *Server) inheritance() (files []*os.File, env string, err error) {
+	s.lock.Lock()
+	listeners := s.listeners
+	s.lock.Unlock()
+	if atomic.LoadInt32(&s.unlistened) != 0 {
+		return nil, "", ErrServerClosed
+	}
+	keys := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		syscall.ForkLock.RLock()
+		fd, err := syscall.Dup(l.fd)
+		if err == nil {
+			syscall.CloseOnExec(fd)
+		}
+		syscall.ForkLock.RUnlock()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, "", os.NewSyscallError("dup", err)
+		}
+		files = append(files, os.NewFile(uintptr(fd), l.key))
+		keys = append(keys, l.key)
+	}
+	return files, strings.Join(keys, ","), nil
+}
+
+// StartProcess starts a new process of the same executable with the same
+// arguments, which inherits the listening fds of the server. The new
+// process serves them by ListenAndServe, or by Serve with the listeners
+// returned by Listen, on the same network addresses.
+func (s *Server) StartProcess() (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	files, value, err := s.inheritance()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, ListenFdsEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, ListenFdsEnv+"="+value)
+	return os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+}
+
+// Restart starts a new process by StartProcess, and then shuts down
+// the server gracefully by Shutdown, so that the new process takes
+// over the incoming conns without refusing any.
+func (s *Server) Restart(ctx context.Context) error {
+	if _, err := s.StartProcess(); err != nil {
+		return err
+	}
+	return s.Shutdown(ctx)
+}
+
+func (s *Server) handleRestart() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, s.RestartSignal)
+	defer signal.Stop(sigs)
+	select {
+	case <-sigs:
+		ctx, cancel := s.restartContext()
+		defer cancel()
+		s.Restart(ctx)
+	case <-s.done:
+	}
+}
+
+// restartContext returns the context bounding the shutdown of a restart
+// on RestartSignal by RestartTimeout.
+func (s *Server) restartContext() (context.Context, context.CancelFunc) {
+	switch {
+	case s.RestartTimeout < 0:
+		return context.WithCancel(context.Background())
+	case s.RestartTimeout == 0:
+		return context.WithTimeout(context.Background(), restartTimeout)
+	}
+	return context.WithTimeout(context.Background(), s.RestartTimeout)
+}
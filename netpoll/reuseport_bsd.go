@@ -0,0 +1,9 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import "syscall"
+
+// soReusePort is the SO_REUSEPORT socket option.
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,7 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+// soReusePort is the SO_REUSEPORT socket option.
+const soReusePort = 0xf
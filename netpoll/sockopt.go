@@ -0,0 +1,41 @@
+package netpoll
+
+import (
+	"time"
+)
+
+// SocketOptions represents the options set on the sockets of a Server.
+// The zero value of an option keeps the system default.
+type SocketOptions struct {
+	// NoDelay disables the Nagle's algorithm by TCP_NODELAY.
+	NoDelay bool
+	// KeepAlive enables the keep-alive probes by SO_KEEPALIVE, and sets
+	// the idle time before the first probe if positive. Negative
+	// KeepAlive disables the keep-alive probes.
+	KeepAlive time.Duration
+	// KeepAliveInterval is the interval between the keep-alive probes.
+	KeepAliveInterval time.Duration
+	// KeepAliveCount is the number of the unacknowledged keep-alive
+	// probes before the conn is dropped.
+	KeepAliveCount int
+	// Linger sets SO_LINGER, so Close blocks until the unsent data is
+	// sent or the Linger has passed if positive. Negative Linger discards
+	// the unsent data and resets the conn on Close.
+	Linger time.Duration
+	// ReadBuffer is the size of the receive buffer by SO_RCVBUF.
+	ReadBuffer int
+	// WriteBuffer is the size of the send buffer by SO_SNDBUF.
+	WriteBuffer int
+	// UserTimeout is the max time that the sent data may remain
+	// unacknowledged before the conn is dropped by TCP_USER_TIMEOUT.
+	// It is only supported on linux.
+	UserTimeout time.Duration
+	// FastOpen is the queue length of the pending TCP Fast Open requests
+	// set on the listener by TCP_FASTOPEN.
+	// It is only supported on linux and darwin.
+	FastOpen int
+	// DeferAccept defers the accept until the data arrives within the
+	// DeferAccept, and is set on the listener by TCP_DEFER_ACCEPT.
+	// It is only supported on linux.
+	DeferAccept time.Duration
+}
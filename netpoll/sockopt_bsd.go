@@ -0,0 +1,15 @@
+//go:build dragonfly || freebsd || netbsd
+// +build dragonfly freebsd netbsd
+
+package netpoll
+
+import "syscall"
+
+const (
+	tcpKeepIdle    = syscall.TCP_KEEPIDLE
+	tcpKeepIntvl   = syscall.TCP_KEEPINTVL
+	tcpKeepCnt     = syscall.TCP_KEEPCNT
+	tcpUserTimeout = optUnsupported
+	tcpFastOpen    = optUnsupported
+	tcpDeferAccept = optUnsupported
+)
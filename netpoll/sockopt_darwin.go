@@ -0,0 +1,15 @@
+//go:build darwin
+// +build darwin
+
+package netpoll
+
+import "syscall"
+
+const (
+	tcpKeepIdle    = syscall.TCP_KEEPALIVE
+	tcpKeepIntvl   = 0x101
+	tcpKeepCnt     = 0x102
+	tcpUserTimeout = optUnsupported
+	tcpFastOpen    = 0x105
+	tcpDeferAccept = optUnsupported
+)
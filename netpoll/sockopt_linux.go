@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import "syscall"
+
+const (
+	tcpKeepIdle    = syscall.TCP_KEEPIDLE
+	tcpKeepIntvl   = syscall.TCP_KEEPINTVL
+	tcpKeepCnt     = syscall.TCP_KEEPCNT
+	tcpUserTimeout = 0x12
+	tcpFastOpen    = 0x17
+	tcpDeferAccept = syscall.TCP_DEFER_ACCEPT
+)
@@ -0,0 +1,13 @@
+//go:build openbsd
+// +build openbsd
+
+package netpoll
+
+const (
+	tcpKeepIdle    = optUnsupported
+	tcpKeepIntvl   = optUnsupported
+	tcpKeepCnt     = optUnsupported
+	tcpUserTimeout = optUnsupported
+	tcpFastOpen    = optUnsupported
+	tcpDeferAccept = optUnsupported
+)
@@ -0,0 +1,112 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// optUnsupported is the option which is not supported by the system.
+const optUnsupported = -1
+
+// apply sets the options on the conn socket fd. The TCP options are
+// only set if tcp is true.
+func (o *SocketOptions) apply(fd int, tcp bool) error {
+	if o.ReadBuffer > 0 {
+		if err := setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	if o.Linger != 0 {
+		var l = &syscall.Linger{Onoff: 1}
+		if o.Linger > 0 {
+			l.Linger = int32(seconds(o.Linger))
+		}
+		if err := syscall.SetsockoptLinger(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, l); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if !tcp {
+		return nil
+	}
+	if o.NoDelay {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1); err != nil {
+			return err
+		}
+	}
+	if o.KeepAlive < 0 {
+		if err := setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0); err != nil {
+			return err
+		}
+	} else if o.KeepAlive > 0 {
+		if err := setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+			return err
+		}
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, tcpKeepIdle, seconds(o.KeepAlive)); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveInterval > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, tcpKeepIntvl, seconds(o.KeepAliveInterval)); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveCount > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, tcpKeepCnt, o.KeepAliveCount); err != nil {
+			return err
+		}
+	}
+	if o.UserTimeout > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, int(o.UserTimeout/time.Millisecond)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate returns ErrNotSupported if a TCP option is set but not supported
+// by the system, instead of failing on every conn.
+func (o *SocketOptions) validate() error {
+	if o.KeepAlive > 0 && tcpKeepIdle == optUnsupported ||
+		o.KeepAliveInterval > 0 && tcpKeepIntvl == optUnsupported ||
+		o.KeepAliveCount > 0 && tcpKeepCnt == optUnsupported ||
+		o.UserTimeout > 0 && tcpUserTimeout == optUnsupported {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// applyListener sets the listener options on the TCP listen socket fd.
+func (o *SocketOptions) applyListener(fd int) error {
+	if o.FastOpen > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, o.FastOpen); err != nil {
+			return err
+		}
+	}
+	if o.DeferAccept > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, tcpDeferAccept, seconds(o.DeferAccept)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setsockoptInt(fd, level, opt, value int) error {
+	if opt == optUnsupported {
+		return ErrNotSupported
+	}
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, level, opt, value))
+}
+
+// seconds rounds the positive duration d up to the seconds.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,43 @@
+package netpoll
+
+// ConnState represents the state of a conn served by a Server.
+// It is used by the optional Server.ConnState hook.
+type ConnState int
+
+const (
+	// StateNew represents a conn that has just been accepted
+	// and is about to be upgraded.
+	StateNew ConnState = iota
+	// StateUpgraded represents a conn that has been upgraded by
+	// Handler.Upgrade and is ready to be served by the poll.
+	StateUpgraded
+	// StateActive represents a conn that is being served by Handler.Serve.
+	StateActive
+	// StateIdle represents a conn that has been served and is waiting
+	// for the poll to trigger the next request.
+	StateIdle
+	// StateRescheduled represents a conn that has been moved to
+	// another worker by the rescheduler.
+	StateRescheduled
+	// StateClosed represents a closed conn. The error passed to
+	// the hook is the reason why the conn was closed.
+	StateClosed
+	// StateRejected represents an accepted conn that was closed
+	// before it was registered. The error passed to the hook
+	// is the reason why the conn was rejected.
+	StateRejected
+)
+
+var stateName = map[ConnState]string{
+	StateNew:         "new",
+	StateUpgraded:    "upgraded",
+	StateActive:      "active",
+	StateIdle:        "idle",
+	StateRescheduled: "rescheduled",
+	StateClosed:      "closed",
+	StateRejected:    "rejected",
+}
+
+func (c ConnState) String() string {
+	return stateName[c]
+}
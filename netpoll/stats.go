@@ -0,0 +1,63 @@
+package netpoll
+
+import (
+	"time"
+)
+
+// Stats is a snapshot of the runtime statistics of a Server.
+type Stats struct {
+	// Conns is the number of the conns served by the workers.
+	Conns int
+	// Accepted is the number of the conns accepted since the server started.
+	Accepted int64
+	// Rescheduled is the number of the conns moved between the unshared
+	// and the shared workers by the rescheduler.
+	Rescheduled int64
+	// Panics is the number of the Handler panics recovered by RecoverPanic.
+	Panics int64
+	// Workers is the statistics of every worker.
+	Workers []WorkerStats
+	// Started is the time the server started serving.
+	Started time.Time
+	// Time is the time of the snapshot.
+	Time time.Time
+}
+
+// AcceptRate returns the number of the conns accepted per second between
+// the snapshot prev and s, or since the server started if prev is nil.
+func (s *Stats) AcceptRate(prev *Stats) float64 {
+	accepted, since := s.Accepted, s.Started
+	if prev != nil {
+		accepted, since = s.Accepted-prev.Accepted, prev.Time
+	}
+	if since.IsZero() || !s.Time.After(since) {
+		return 0
+	}
+	return float64(accepted) / s.Time.Sub(since).Seconds()
+}
+
+// WorkerStats is a snapshot of the runtime statistics of a worker.
+type WorkerStats struct {
+	// Index is the index of the worker in the server.
+	Index int
+	// Shared reports whether the worker serves its conns by async tasks.
+	Shared bool
+	// Running reports whether the worker is polling, or is asleep
+	// after being idle.
+	Running bool
+	// Conns is the number of the conns served by the worker.
+	Conns int
+	// Events is the number of the poll events processed by the worker.
+	Events int64
+	// Busy is the total time spent serving the events.
+	Busy time.Duration
+	// Sleeps is the number of times the worker went to sleep after being idle.
+	Sleeps int64
+	// Wakes is the number of times the worker was woken up to poll.
+	Wakes int64
+	// Tasks is the number of the running task goroutines of a shared worker.
+	Tasks int
+	// TasksSpawned is the number of the task goroutines spawned by a shared
+	// worker. A task goroutine serves the events until it is idle.
+	TasksSpawned int64
+}
@@ -0,0 +1,813 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 loong64 ppc64 ppc64le riscv64 s390x
+
+package netpoll
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+
+	uringEntries    = 1024
+	uringOpsEntries = 64
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringEnterGetEvents = 1
+	uringSQELink        = 1 << 2
+	uringPollAddMulti   = 1
+	uringCQEFMore       = 1 << 1
+
+	uringOpNop         = 0
+	uringOpPollAdd     = 6
+	uringOpPollRemove  = 7
+	uringOpTimeout     = 11
+	uringOpAccept      = 13
+	uringOpLinkTimeout = 15
+	uringOpRead        = 22
+	uringOpWrite       = 23
+
+	pollIN    = 0x1
+	pollOUT   = 0x4
+	pollERR   = 0x8
+	pollHUP   = 0x10
+	pollRDHUP = 0x2000
+)
+
+// The kinds of the requests, encoded in the top byte of the user data.
+const (
+	uringRead = iota + 1
+	uringWrite
+	uringRemove
+	uringTimeout
+	uringProbe
+)
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+type uringSQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringCQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type uringTimespec struct {
+	sec  int64
+	nsec int64
+}
+
+// uringFd is the state of a file descriptor registered to the ring.
+type uringFd struct {
+	gen     uint32
+	reading bool
+	writing bool
+	paused  bool
+	armed   bool
+}
+
+// uring is the io_uring based poller. A file descriptor is watched by a
+// poll request, which is queued into the submission ring and submitted
+// with the others by the next Wait. A poll request queued while Wait is
+// blocking is submitted at once so that it is not delayed by the timeout.
+// The operations of Submit are submitted to a ring of their own.
+type uring struct {
+	fd        int
+	lock      sync.Mutex
+	mode      PollMode
+	multishot bool
+	sqRing    []byte
+	cqRing    []byte
+	sqes      []byte
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqSize    uint32
+	sqArray   uint32
+	cqHead    *uint32
+	cqTail    *uint32
+	cqMask    uint32
+	cqes      uint32
+	tail      uint32
+	queued    uint32
+	waiting   bool
+	timing    bool
+	closed    bool
+	ts        uringTimespec
+	gen       uint32
+	fds       map[int]*uringFd
+	rearms    []int
+	opsLock   sync.Mutex
+	ops       *uring
+	opsClosed bool
+	addrs     []syscall.RawSockaddrAny
+	addrLens  []uint32
+}
+
+func newURing() (*uring, error) {
+	r, err := setupURing(uringEntries)
+	if err != nil {
+		return nil, err
+	}
+	if r.multishot, err = r.probeMultishot(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// setupURing sets up a ring of the entries and maps its queues.
+func setupURing(entries uint32) (*uring, error) {
+	var params uringParams
+	fd, _, e := syscall.Syscall(sysIOURingSetup, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if e != 0 {
+		return nil, e
+	}
+	r := &uring{fd: int(fd), fds: make(map[int]*uringFd)}
+	var err error
+	r.sqRing, err = syscall.Mmap(r.fd, uringOffSQRing, int(params.sqOff.array+params.sqEntries*4),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.cqRing, err = syscall.Mmap(r.fd, uringOffCQRing, int(params.cqOff.cqes+params.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.sqes, err = syscall.Mmap(r.fd, uringOffSQEs, int(params.sqEntries*uint32(unsafe.Sizeof(uringSQE{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqSize = params.sqEntries
+	r.sqArray = params.sqOff.array
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = params.cqOff.cqes
+	r.tail = atomic.LoadUint32(r.sqTail)
+	return r, nil
+}
+
+// probeMultishot reports whether the kernel supports the multishot poll
+// requests of Linux 5.13. IORING_REGISTER_PROBE only reports the opcodes,
+// so a multishot request is polled on a pipe, which the older kernels
+// reject with EINVAL.
+func (r *uring) probeMultishot() (bool, error) {
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC); err != nil {
+		return false, err
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	ufd := &uringFd{}
+	if err := r.pollAdd(uringProbe, ufd, fds[1], pollOUT, uringPollAddMulti); err != nil {
+		return false, err
+	}
+	if err := r.submit(); err != nil {
+		return false, err
+	}
+	for atomic.LoadUint32(r.cqTail) == atomic.LoadUint32(r.cqHead) {
+		if _, err := r.enter(0, 1, uringEnterGetEvents); err != nil {
+			return false, err
+		}
+	}
+	head := atomic.LoadUint32(r.cqHead)
+	cqe := (*uringCQE)(unsafe.Pointer(&r.cqRing[uintptr(r.cqes)+uintptr(head&r.cqMask)*unsafe.Sizeof(uringCQE{})]))
+	res, more := cqe.res, cqe.flags&uringCQEFMore != 0
+	atomic.StoreUint32(r.cqHead, head+1)
+	if res == -int32(syscall.EINVAL) {
+		return false, nil
+	}
+	if more {
+		// The completions of the removal are dropped by reap.
+		if err := r.pollRemove(uringProbe, ufd, fds[1]); err != nil {
+			return false, err
+		}
+		if err := r.submit(); err != nil {
+			return false, err
+		}
+	}
+	return res >= 0, nil
+}
+
+// bigEndian reports whether the poll mask of a request must be swapped,
+// as the kernel reads it in 16-bit halves.
+var bigEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}()
+
+func uringUserData(kind int, gen uint32, fd int) uint64 {
+	return uint64(kind)<<56 | uint64(gen&0xffffff)<<32 | uint64(uint32(fd))
+}
+
+// sqe returns a cleared submission queue entry. It submits the queued
+// entries first if the submission ring is full.
+func (r *uring) sqe() (*uringSQE, error) {
+	if r.closed {
+		return nil, syscall.EBADF
+	}
+	if r.tail-atomic.LoadUint32(r.sqHead) >= r.sqSize {
+		if err := r.submit(); err != nil {
+			return nil, err
+		}
+	}
+	index := r.tail & r.sqMask
+	sqe := (*uringSQE)(unsafe.Pointer(&r.sqes[uintptr(index)*unsafe.Sizeof(uringSQE{})]))
+	*sqe = uringSQE{}
+	*(*uint32)(unsafe.Pointer(&r.sqRing[r.sqArray+index*4])) = index
+	r.tail++
+	r.queued++
+	return sqe, nil
+}
+
+// submit submits the queued entries to the kernel.
+func (r *uring) submit() error {
+	if r.queued == 0 {
+		return nil
+	}
+	atomic.StoreUint32(r.sqTail, r.tail)
+	for r.queued > 0 {
+		n, err := r.enter(r.queued, 0, 0)
+		if err != nil {
+			return err
+		}
+		r.queued -= n
+	}
+	return nil
+}
+
+func (r *uring) enter(toSubmit, minComplete, flags uint32) (uint32, error) {
+	for {
+		n, _, e := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if e == syscall.EINTR {
+			if toSubmit > 0 {
+				continue
+			}
+			return 0, nil
+		}
+		if e != 0 {
+			return 0, e
+		}
+		return uint32(n), nil
+	}
+}
+
+// flush submits the queued entries at once when Wait is blocking.
+func (r *uring) flush() error {
+	if r.waiting {
+		return r.submit()
+	}
+	return nil
+}
+
+func (r *uring) pollAdd(kind int, ufd *uringFd, fd int, events uint32, flags uint32) error {
+	sqe, err := r.sqe()
+	if err != nil {
+		return err
+	}
+	sqe.opcode = uringOpPollAdd
+	sqe.fd = int32(fd)
+	sqe.len = flags
+	if bigEndian {
+		events = events<<16 | events>>16
+	}
+	sqe.opFlags = events
+	sqe.userData = uringUserData(kind, ufd.gen, fd)
+	return nil
+}
+
+func (r *uring) pollRemove(kind int, ufd *uringFd, fd int) error {
+	sqe, err := r.sqe()
+	if err != nil {
+		return err
+	}
+	sqe.opcode = uringOpPollRemove
+	sqe.fd = -1
+	sqe.addr = uringUserData(kind, ufd.gen, fd)
+	sqe.userData = uringUserData(uringRemove, ufd.gen, fd)
+	return nil
+}
+
+func (r *uring) read(ufd *uringFd, fd int) error {
+	if ufd.reading || ufd.paused {
+		return nil
+	}
+	var flags uint32
+	if r.mode == EdgeTriggered && r.multishot {
+		// Without multishot requests, a single-shot request is rearmed
+		// by the next Wait as in LevelTriggered mode.
+		flags = uringPollAddMulti
+	}
+	ufd.reading = true
+	return r.pollAdd(uringRead, ufd, fd, pollIN|pollRDHUP, flags)
+}
+
+func (r *uring) write(ufd *uringFd, fd int) error {
+	if ufd.writing {
+		return nil
+	}
+	ufd.writing = true
+	return r.pollAdd(uringWrite, ufd, fd, pollOUT, 0)
+}
+
+func (r *uring) register(fd int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ufd, ok := r.fds[fd]; ok {
+		r.cancel(ufd, fd)
+	}
+	r.gen++
+	ufd := &uringFd{gen: r.gen}
+	r.fds[fd] = ufd
+	if err := r.read(ufd, fd); err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+func (r *uring) addWrite(fd int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ufd, ok := r.fds[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	ufd.paused = false
+	if ufd.armed {
+		ufd.armed = false
+		if err := r.read(ufd, fd); err != nil {
+			return err
+		}
+	}
+	if err := r.write(ufd, fd); err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+func (r *uring) pause(fd int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ufd, ok := r.fds[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	ufd.paused = true
+	if ufd.reading {
+		ufd.reading = false
+		if err := r.pollRemove(uringRead, ufd, fd); err != nil {
+			return err
+		}
+	}
+	if err := r.write(ufd, fd); err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+func (r *uring) suspend(fd int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ufd, ok := r.fds[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	ufd.paused = true
+	if ufd.reading {
+		ufd.reading = false
+		if err := r.pollRemove(uringRead, ufd, fd); err != nil {
+			return err
+		}
+	}
+	return r.flush()
+}
+
+func (r *uring) resume(fd int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ufd, ok := r.fds[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	ufd.paused = false
+	if err := r.read(ufd, fd); err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+func (r *uring) rearm(fd int) error {
+	if r.mode != OneShot {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ufd, ok := r.fds[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	ufd.armed = false
+	if err := r.read(ufd, fd); err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+func (r *uring) unregister(fd int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ufd, ok := r.fds[fd]
+	if !ok {
+		return syscall.ENOENT
+	}
+	delete(r.fds, fd)
+	if err := r.cancel(ufd, fd); err != nil {
+		return err
+	}
+	// A pending poll request holds a reference to the file, so the
+	// requests are removed at once for the file to be released on close.
+	return r.submit()
+}
+
+// cancel removes the poll requests of a file descriptor.
+func (r *uring) cancel(ufd *uringFd, fd int) (err error) {
+	if ufd.reading {
+		ufd.reading = false
+		err = r.pollRemove(uringRead, ufd, fd)
+	}
+	if ufd.writing && err == nil {
+		ufd.writing = false
+		err = r.pollRemove(uringWrite, ufd, fd)
+	}
+	return
+}
+
+func (r *uring) wait(events []Event, timeout int) (n int, err error) {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return 0, syscall.EBADF
+	}
+	for _, fd := range r.rearms {
+		if ufd, ok := r.fds[fd]; ok && !ufd.armed {
+			if err = r.read(ufd, fd); err != nil {
+				break
+			}
+		}
+	}
+	r.rearms = r.rearms[:0]
+	if err == nil && !r.timing && atomic.LoadUint32(r.cqTail) == atomic.LoadUint32(r.cqHead) {
+		err = r.timeout(timeout)
+	}
+	if err == nil {
+		err = r.submit()
+	}
+	r.waiting = err == nil
+	r.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	_, err = r.enter(0, 1, uringEnterGetEvents)
+	r.lock.Lock()
+	r.waiting = false
+	if r.closed {
+		r.lock.Unlock()
+		return 0, syscall.EBADF
+	}
+	if err == nil {
+		err = r.submit()
+	}
+	n = r.reap(events)
+	r.lock.Unlock()
+	return
+}
+
+func (r *uring) timeout(ms int) error {
+	sqe, err := r.sqe()
+	if err != nil {
+		return err
+	}
+	r.ts.sec = int64(ms / 1000)
+	r.ts.nsec = int64(ms%1000) * 1e6
+	sqe.opcode = uringOpTimeout
+	sqe.addr = uint64(uintptr(unsafe.Pointer(&r.ts)))
+	sqe.len = 1
+	sqe.userData = uringUserData(uringTimeout, 0, 0)
+	r.timing = true
+	return nil
+}
+
+// reap consumes the completion queue entries and converts them to events.
+func (r *uring) reap(events []Event) (n int) {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail && n < len(events); head++ {
+		cqe := (*uringCQE)(unsafe.Pointer(&r.cqRing[uintptr(r.cqes)+uintptr(head&r.cqMask)*unsafe.Sizeof(uringCQE{})]))
+		kind := int(cqe.userData >> 56)
+		gen := uint32(cqe.userData>>32) & 0xffffff
+		fd := int(int32(uint32(cqe.userData)))
+		if kind == uringTimeout {
+			r.timing = false
+			continue
+		}
+		if kind != uringRead && kind != uringWrite {
+			continue
+		}
+		ufd, ok := r.fds[fd]
+		if !ok || ufd.gen&0xffffff != gen || cqe.res == -int32(syscall.ECANCELED) {
+			continue
+		}
+		var mode Mode
+		if kind == uringWrite {
+			if !ufd.writing {
+				continue
+			}
+			ufd.writing = false
+			mode = WRITE
+		} else {
+			if !ufd.reading {
+				continue
+			}
+			if cqe.flags&uringCQEFMore == 0 {
+				ufd.reading = false
+				if r.mode == OneShot {
+					ufd.armed = true
+				} else {
+					r.rearms = append(r.rearms, fd)
+				}
+			}
+		}
+		if cqe.res < 0 {
+			mode |= ERROR
+		} else {
+			if kind == uringRead && cqe.res&pollIN != 0 {
+				mode |= READ
+			}
+			if cqe.res&(pollRDHUP|pollHUP) != 0 {
+				mode |= HUP
+			}
+			if cqe.res&pollERR != 0 {
+				mode |= ERROR
+			}
+		}
+		events[n] = Event{Fd: fd, Mode: mode}
+		n++
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return
+}
+
+// submitOps submits the operations in batches to the ring of the
+// operations, so that their completions are not reaped by Wait, and waits
+// for them to complete.
+func (r *uring) submitOps(ops []Op) error {
+	r.opsLock.Lock()
+	defer r.opsLock.Unlock()
+	if r.opsClosed {
+		return syscall.EBADF
+	}
+	if r.ops == nil {
+		ops, err := setupURing(uringOpsEntries)
+		if err != nil {
+			return err
+		}
+		r.ops = ops
+	}
+	for len(ops) > 0 {
+		// An operation takes an entry and its linked timeout another one.
+		n := len(ops)
+		if n > int(r.ops.sqSize/2) {
+			n = int(r.ops.sqSize / 2)
+		}
+		if err := r.perform(ops[:n]); err != nil {
+			// The ring may have completions left, so a new one is set up
+			// by the next call.
+			r.ops.Close()
+			r.ops = nil
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// perform submits a batch of the operations to the ring of the operations
+// by one syscall, and reaps their completions. The batch must fit in the
+// submission ring. Every operation is linked to a timeout of zero, which
+// cancels it if it would wait, as an accept does even on a non-blocking
+// socket; it then fails with EAGAIN.
+func (r *uring) perform(ops []Op) error {
+	ring := r.ops
+	if cap(r.addrs) < len(ops) {
+		r.addrs = make([]syscall.RawSockaddrAny, len(ops))
+		r.addrLens = make([]uint32, len(ops))
+	}
+	for i := range ops {
+		op := &ops[i]
+		op.N, op.Addr, op.Err = 0, nil, nil
+		sqe, err := ring.sqe()
+		if err != nil {
+			return err
+		}
+		sqe.fd = int32(op.Fd)
+		sqe.userData = uint64(i)
+		switch op.Kind {
+		case OpAccept:
+			r.addrLens[i] = uint32(unsafe.Sizeof(r.addrs[i]))
+			sqe.opcode = uringOpAccept
+			sqe.addr = uint64(uintptr(unsafe.Pointer(&r.addrs[i])))
+			sqe.off = uint64(uintptr(unsafe.Pointer(&r.addrLens[i])))
+			sqe.opFlags = syscall.SOCK_NONBLOCK | syscall.SOCK_CLOEXEC
+		case OpRead, OpWrite:
+			sqe.opcode = uringOpRead
+			if op.Kind == OpWrite {
+				sqe.opcode = uringOpWrite
+			}
+			if len(op.Buf) > 0 {
+				sqe.addr = uint64(uintptr(unsafe.Pointer(&op.Buf[0])))
+			}
+			sqe.len = uint32(len(op.Buf))
+		default:
+			sqe.opcode = uringOpNop
+			sqe.fd = -1
+		}
+		sqe.flags = uringSQELink
+		if sqe, err = ring.sqe(); err != nil {
+			return err
+		}
+		sqe.opcode = uringOpLinkTimeout
+		sqe.fd = -1
+		sqe.addr = uint64(uintptr(unsafe.Pointer(&ring.ts)))
+		sqe.len = 1
+		sqe.userData = uringUserData(uringTimeout, 0, i)
+	}
+	ring.ts = uringTimespec{}
+	if err := ring.submit(); err != nil {
+		return err
+	}
+	for done := 0; done < 2*len(ops); {
+		head := atomic.LoadUint32(ring.cqHead)
+		if head == atomic.LoadUint32(ring.cqTail) {
+			if _, err := ring.enter(0, uint32(2*len(ops)-done), uringEnterGetEvents); err != nil {
+				return err
+			}
+			continue
+		}
+		cqe := (*uringCQE)(unsafe.Pointer(&ring.cqRing[uintptr(ring.cqes)+uintptr(head&ring.cqMask)*unsafe.Sizeof(uringCQE{})]))
+		i, res := int(cqe.userData), cqe.res
+		atomic.StoreUint32(ring.cqHead, head+1)
+		done++
+		if cqe.userData>>56 == uringTimeout || i >= len(ops) {
+			continue
+		}
+		op := &ops[i]
+		switch {
+		case op.Kind != OpAccept && op.Kind != OpRead && op.Kind != OpWrite:
+			op.Err = syscall.EINVAL
+		case res == -int32(syscall.ECANCELED):
+			op.Err = syscall.EAGAIN
+		case res < 0:
+			op.Err = syscall.Errno(-res)
+		case op.Kind == OpAccept:
+			op.N, op.Addr = int(res), uringSockaddr(&r.addrs[i], r.addrLens[i])
+		default:
+			op.N = int(res)
+		}
+	}
+	// Keeps the buffers alive until the kernel has completed with them.
+	runtime.KeepAlive(ops)
+	return nil
+}
+
+// uringSockaddr converts the address of an accepted socket.
+func uringSockaddr(rsa *syscall.RawSockaddrAny, size uint32) syscall.Sockaddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		return &syscall.SockaddrInet4{Port: int(port[0])<<8 | int(port[1]), Addr: raw.Addr}
+	case syscall.AF_INET6:
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		return &syscall.SockaddrInet6{Port: int(port[0])<<8 | int(port[1]), ZoneId: raw.Scope_id, Addr: raw.Addr}
+	case syscall.AF_UNIX:
+		raw := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrUnix{}
+		// An unnamed socket has no path past the family.
+		if n := int(size) - 2; n > 0 {
+			if n > len(raw.Path) {
+				n = len(raw.Path)
+			}
+			path := make([]byte, n)
+			for i, b := range raw.Path[:n] {
+				path[i] = byte(b)
+			}
+			if path[0] == 0 {
+				// The abstract sockets are named with a leading @.
+				path[0] = '@'
+			} else if i := bytes.IndexByte(path, 0); i >= 0 {
+				path = path[:i]
+			}
+			sa.Name = string(path)
+		}
+		return sa
+	}
+	return nil
+}
+
+// Close removes the poll requests, unmaps the rings and closes the ring fd.
+func (r *uring) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.opsLock.Lock()
+	if r.ops != nil {
+		r.ops.Close()
+		r.ops = nil
+	}
+	r.opsClosed = true
+	r.opsLock.Unlock()
+	if r.closed {
+		return nil
+	}
+	for fd, ufd := range r.fds {
+		r.cancel(ufd, fd)
+	}
+	r.submit()
+	r.closed = true
+	for _, b := range [][]byte{r.sqes, r.cqRing, r.sqRing} {
+		if b != nil {
+			syscall.Munmap(b)
+		}
+	}
+	return syscall.Close(r.fd)
+}
@@ -0,0 +1,44 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 loong64 ppc64 ppc64le riscv64 s390x
+
+package netpoll
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestURingSingleShot(t *testing.T) {
+	p, err := CreateBackend(IOURingBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Backend() != IOURingBackend {
+		t.Skip("io_uring is not supported")
+	}
+	// Polls as the kernels without multishot requests.
+	p.uring.multishot = false
+	p.SetMode(EdgeTriggered)
+	p.SetTimeout(time.Millisecond * 10)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	p.Register(fds[0])
+	events := make([]Event, 8)
+	for i := 0; i < 3; i++ {
+		syscall.Write(fds[1], []byte("Hello World"))
+		if n, err := p.Wait(events); err != nil {
+			t.Error(err)
+		} else if n != 1 || events[0].Mode != READ {
+			t.Error(i, n, events[0])
+		}
+		syscall.Read(fds[0], make([]byte, 64))
+	}
+	p.Unregister(fds[0])
+	syscall.Close(fds[0])
+}
@@ -0,0 +1,28 @@
+//go:build linux && !386 && !amd64 && !arm && !arm64 && !loong64 && !ppc64 && !ppc64le && !riscv64 && !s390x
+// +build linux,!386,!amd64,!arm,!arm64,!loong64,!ppc64,!ppc64le,!riscv64,!s390x
+
+package netpoll
+
+import (
+	"syscall"
+)
+
+// uring is not supported on this architecture.
+type uring struct {
+	mode PollMode
+}
+
+func newURing() (*uring, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (r *uring) register(fd int) error                         { return syscall.ENOSYS }
+func (r *uring) addWrite(fd int) error                         { return syscall.ENOSYS }
+func (r *uring) pause(fd int) error                            { return syscall.ENOSYS }
+func (r *uring) suspend(fd int) error                          { return syscall.ENOSYS }
+func (r *uring) resume(fd int) error                           { return syscall.ENOSYS }
+func (r *uring) rearm(fd int) error                            { return syscall.ENOSYS }
+func (r *uring) unregister(fd int) error                       { return syscall.ENOSYS }
+func (r *uring) submitOps(ops []Op) error                      { return syscall.ENOSYS }
+func (r *uring) wait(events []Event, timeout int) (int, error) { return 0, syscall.ENOSYS }
+func (r *uring) Close() error                                  { return syscall.ENOSYS }